@@ -1,13 +1,12 @@
 package common
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"slices"
@@ -20,18 +19,36 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("average", 2).
+	Register(1, duplicates.MigrateLastReceived)
+
 type Filter struct {
-	m        *mid.Middleware
+	m        mid.Broker
 	workerId string
 	clientId string
 	sink     string
 	workdir  string
 	filter   *duplicates.DuplicateFilter
+	sent     mid.MessageCounter
+	handoffs *mid.Handoffs
 	stateMan *state.StateManager
+	// the fares of every route, as float32s
+	fares *state.SegmentStore
 }
 
-func NewFilter(m *mid.Middleware, workerId, clientId, sink, workdir string) (*Filter, error) {
-	err := os.MkdirAll(filepath.Join(workdir, "fares"), 0755)
+// Name of the file in the workdir keeping the fares.
+const FaresFile = "fares.kv"
+
+func NewFilter(m mid.Broker, workerId, clientId, sink, workdir string) (*Filter, error) {
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return nil, err
+	}
+	fares, err := state.OpenSegmentStore(filepath.Join(workdir, FaresFile))
+	if err != nil {
+		return nil, err
+	}
+	handoffs, errHandoffs := mid.NewHandoffs(workerId)
 	return &Filter{
 		m,
 		workerId,
@@ -39,21 +56,34 @@ func NewFilter(m *mid.Middleware, workerId, clientId, sink, workdir string) (*Fi
 		sink,
 		workdir,
 		duplicates.NewDuplicateFilter(),
-		state.NewStateManager(workdir),
-	}, err
+		mid.NewMessageCounter(),
+		handoffs,
+		// the number of fares of every route is kept in the state
+		state.NewLogStateManager(workdir).WithSchema(Schema),
+		fares,
+	}, errHandoffs
 }
 
-func RecoverFromState(m *mid.Middleware, workerId, clientId, sink, workdir string, stateMan *state.StateManager) (*Filter, error) {
+func RecoverFromState(m mid.Broker, workerId, clientId, sink, workdir string, stateMan *state.StateManager) (*Filter, error) {
 	f, err := NewFilter(m, workerId, clientId, sink, workdir)
+	if f == nil {
+		return nil, err
+	}
 	if err == nil {
 		err = f.filter.RecoverFromState(stateMan)
 	}
+	if err == nil {
+		f.sent, err = mid.MessageCounterFromState(stateMan)
+	}
+	if err == nil {
+		f.handoffs, err = mid.HandoffsFromState(stateMan, workerId)
+	}
 	f.stateMan = stateMan
 	return f, err
 }
 
 func (f *Filter) ShouldRestart() bool {
-	processed, _ := f.stateMan.State["processed"].(bool)
+	processed, _ := state.Get[bool](f.stateMan, "processed")
 	return processed
 }
 
@@ -67,79 +97,141 @@ func (f *Filter) Restart(ctx context.Context) error {
 	return f.sendResults(ctx, fares, float32(fareSum/float64(count)))
 }
 
+// Batches sent for the client, to be sent along with its EOF.
+func (f *Filter) Sent() mid.MessageCounter {
+	return f.sent
+}
+
+// Nodes this one handed off routes to, consumers of the results wait for
+// their EOF as well.
+func (f *Filter) Peers() []string {
+	return f.handoffs.Peers()
+}
+
+// Sends a HandoffEOF to the nodes waiting for this one, once done with the
+// client.
+func (f *Filter) HandoffEOF(ctx context.Context) error {
+	return f.handoffs.EOF(ctx, f.m, f.workerId, f.clientId, f.sent)
+}
+
 func (f *Filter) Close() error {
-	return state.RemoveWorkdir(f.workdir)
+	return errors.Join(f.fares.Close(), state.RemoveWorkdir(f.workdir))
 }
 
-func recoverFares(stateMan *state.StateManager, faresDir string) (fares map[string]fareWriter, err error) {
-	fares = make(map[string]fareWriter)
-	values, err := stateMan.GetMapStringInt64("fares")
+// Number of fares of every route, as committed along with the state. Fares
+// stored past them, by a crash before committing the state, are truncated, as
+// well as the routes not in the state.
+func (f *Filter) recoverFares() (map[string]int64, error) {
+	values, err := f.stateMan.GetMapStringInt64("fares")
 	if err != nil && errors.Is(err, state.ErrNotFound) {
-		stateMan.NewMap("fares")
+		f.stateMan.NewMap("fares")
+	} else if err != nil {
+		return nil, err
+	}
+	if err := f.importFareFiles(); err != nil {
+		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			for _, fw := range fares {
-				fw.Close()
-			}
+	fares := make(map[string]int64, len(values))
+	for route, count := range values {
+		size, ok := f.fares.Size(route)
+		if !ok || size < count*4 {
+			return nil, fmt.Errorf("recovering fares for %s: %d bytes stored, expected %d", route, size, count*4)
+		} else if size > count*4 {
+			f.fares.Truncate(route, count*4)
+		}
+		fares[route] = count
+	}
+	for _, route := range f.fares.Keys() {
+		if _, ok := values[route]; !ok {
+			f.fares.Delete(route)
 		}
-	}()
+	}
+	return fares, f.fares.Commit()
+}
 
-	for file, count := range values {
-		writer, err := recoverFareWriter(filepath.Join(faresDir, file), count)
+// Moves the fares stored by previous versions, a file for each route in the
+// fares directory, to the store.
+func (f *Filter) importFareFiles() error {
+	dir := filepath.Join(f.workdir, "fares")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
 		if err != nil {
-			return fares, fmt.Errorf("recovering fares for %s: %w", file, err)
-		} else {
-			fares[file] = writer
+			return err
 		}
+		f.fares.Put(entry.Name(), buf)
 	}
-
-	return fares, nil
+	if err := f.fares.Commit(); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
 }
 
-func (f *Filter) GetRunVariables() (map[string]fareWriter, float64, int, error) {
+func (f *Filter) GetRunVariables() (map[string]int64, float64, int, error) {
 
 	fareSum, _ := f.stateMan.GetFloat("sum")
 	fareCount, _ := f.stateMan.GetInt("count")
-	fares, err := recoverFares(f.stateMan, filepath.Join(f.workdir, "fares"))
+	fares, err := f.recoverFares()
 
 	return fares, fareSum, fareCount, err
 }
 
-func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) (err error) {
+func (f *Filter) Run(ctx context.Context, client mid.Client) (err error) {
 	fares, fareSum, count, err := f.GetRunVariables()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		var errs []error
-		for _, fw := range fares {
-			errs = append(errs, fw.Close())
-		}
-		if err == nil {
-			err = errors.Join(errs...)
-		}
-	}()
 
-	for d := range ch {
-		msg, tag := d.Msg, d.Tag
-		r := bytes.NewReader(msg)
-		dup, err := f.filter.Update(r)
-		if err != nil {
+	h, err := typing.RecoverHeader(f.stateMan, f.workerId)
+	if err != nil {
+		return err
+	}
+	dc := f.m.NewDeferredConfirmer(ctx)
+
+	client.Resume(f.filter)
+	for d := range client.Ch {
+		tag := d.Tag
+		if err := d.Expect(mid.AveragePayload, mid.HandoffPayload); err != nil {
 			log.Errorf("action: reading_batch | status: failed | reason: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		dup, err := f.filter.Update(d.Header)
+		if d.IsHandoff() {
+			// handled even if duplicated, it's idempotent
+			if err := f.receiveHandoff(ctx, dc, d, fares, &h); err != nil {
+				return err
+			}
+			continue
 		}
-		if dup || err != nil {
+		if err != nil {
+			log.Errorf("action: dedup | result: failure | error: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		} else if dup {
 			f.m.Ack(tag)
 			continue
 		}
-		f.filter.AddToState(f.stateMan)
-		for r.Len() > 0 {
-			data, err := typing.AverageFilterUnmarshal(r)
-			if err != nil {
+		batch, err := readBatch(bytes.NewReader(d.Msg))
+		if err != nil {
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
 				return err
 			}
-
+			continue
+		}
+		f.filter.AddToState(f.stateMan)
+		batches := f.handoffs.NewBatches(f.m, dc, f.clientId, mid.AveragePayload, &h, f.sent)
+		for _, data := range batch {
 			switch v := data.(type) {
 			case typing.AverageFare:
 				fareSum += v.Sum
@@ -148,7 +240,15 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) (err error) {
 				f.stateMan.State["count"] = count
 				f.stateMan.State["sum"] = fareSum
 			case typing.AverageFilterFlight:
-				key := v.Origin + "." + v.Destination
+				key := mid.RouteKey(v.Origin, v.Destination)
+				if node := f.handoffs.Owner(key); node != 0 {
+					if err := batches.Add(ctx, node, v.Marshal); errors.Is(err, mid.ErrRecord) {
+						log.Errorf("action: handoff | client: %x | route: %s | result: failure | error: %s | dropping the fare", f.clientId, key, err)
+					} else if err != nil {
+						return err
+					}
+					continue
+				}
 				if err := f.appendFare(fares, key, v.Fare); err != nil {
 					return err
 				}
@@ -156,13 +256,7 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) (err error) {
 			}
 		}
 
-		for _, fw := range fares {
-			if err := fw.Flush(); err != nil {
-				return err
-			}
-		}
-
-		if err := f.stateMan.DumpState(); err != nil {
+		if err := f.commitHandoff(ctx, dc, batches, &h); err != nil {
 			return err
 		}
 		if err := f.m.Ack(tag); err != nil {
@@ -184,17 +278,97 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) (err error) {
 	return f.sendResults(ctx, fares, float32(fareSum/float64(count)))
 }
 
-func (f *Filter) sendResults(ctx context.Context, fares map[string]fareWriter, avg float32) error {
-	log.Infof("start publishing results into %q queue", f.sink)
-	var bc mid.BasicConfirmer
-	i := mid.MaxMessageSize / typing.ResultQ4Size
-	b := bytes.NewBufferString(f.clientId)
+// Updates the client's ring with the Handoff, handing off the fares stored
+// for the routes this node no longer owns.
+func (f *Filter) receiveHandoff(ctx context.Context, c mid.DeferredConfirmer, d mid.Delivery, fares map[string]int64, h *typing.BatchHeader) error {
+	var handoff mid.Handoff
+	if err := handoff.Unmarshal(bytes.NewReader(d.Msg)); err != nil {
+		return f.m.Reject(ctx, d, err.Error())
+	}
+	f.filter.AddToState(f.stateMan)
+	batches := f.handoffs.NewBatches(f.m, c, f.clientId, mid.AveragePayload, h, f.sent)
+	var moved []string
+	if f.handoffs.Update(handoff) {
+		for route := range fares {
+			node := f.handoffs.Owner(route)
+			if node == 0 {
+				continue
+			}
+			routeFares, err := f.readFares(route)
+			if err != nil {
+				return err
+			}
+			origin, destination, _ := strings.Cut(route, ".")
+			for _, fare := range routeFares {
+				v := typing.AverageFilterFlight{Origin: origin, Destination: destination, Fare: fare}
+				if err := batches.Add(ctx, node, v.Marshal); errors.Is(err, mid.ErrRecord) {
+					log.Errorf("action: handoff | client: %x | route: %s | result: failure | error: %s | dropping the fare", f.clientId, route, err)
+				} else if err != nil {
+					return err
+				}
+			}
+			moved = append(moved, route)
+			f.stateMan.Remove("fares", route)
+			f.fares.Delete(route)
+		}
+	}
+	if err := f.commitHandoff(ctx, c, batches, h); err != nil {
+		return err
+	}
+	for _, route := range moved {
+		delete(fares, route)
+	}
+	return f.m.Ack(d.Tag)
+}
+
+// Publishes the rest of the batches handed off, and commits the fares along
+// with the state, which counts them and the batches, once confirmed. A crash
+// before committing results in the same batches being published again, with
+// the same headers.
+func (f *Filter) commitHandoff(ctx context.Context, c mid.DeferredConfirmer, batches *mid.HandoffBatches, h *typing.BatchHeader) error {
+	if err := batches.Flush(ctx); err != nil {
+		return err
+	}
+	h.AddToState(f.stateMan.State)
+	f.handoffs.AddToState(f.stateMan)
+	f.sent.AddToState(f.stateMan)
+	tx, err := state.NewTx(f.workdir)
+	if err != nil {
+		return err
+	}
+	if err := tx.CommitStore(f.fares); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if err := tx.WriteState(f.stateMan); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if err := c.Confirm(ctx); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// Decodes the whole batch before applying any of it, so that a malformed
+// batch can be rejected without leaving it half processed.
+func readBatch(r *bytes.Reader) ([]any, error) {
+	var batch []any
+	for r.Len() > 0 {
+		data, err := typing.AverageFilterUnmarshal(r)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, data)
+	}
+	return batch, nil
+}
 
+func (f *Filter) sendResults(ctx context.Context, fares map[string]int64, avg float32) error {
+	log.Infof("start publishing results into %q queue", f.sink)
 	h, err := typing.RecoverHeader(f.stateMan, f.workerId)
 	if err != nil {
 		return err
 	}
-	h.Marshal(b)
+	p := mid.NewBatchPublisher(f.m, f.clientId, mid.ResultsPayload, &h, f.sent, mid.To("", f.sink)).WithState(f.stateMan, nil)
 
 	keys := make([]string, 0, len(fares))
 	for key := range fares {
@@ -202,71 +376,48 @@ func (f *Filter) sendResults(ctx context.Context, fares map[string]fareWriter, a
 	}
 	slices.Sort(keys)
 	for _, file := range keys {
-		fw := fares[file]
-		if newResult, err := f.aggregate(ctx, b, file, fw, avg); err != nil {
-			return err
-		} else if newResult {
-			f.stateMan.Remove("fares", file)
-			if i--; i <= 0 {
-				h.MessageId++
-				h.AddToState(f.stateMan.State)
-				if err := f.stateMan.Prepare(); err != nil {
-					return err
-				}
-				if err := bc.Publish(ctx, f.m, "", f.sink, b.Bytes()); err != nil {
-					return err
-				}
-				if err := f.stateMan.Commit(); err != nil {
-					// This may result in duplicated messages
-					log.Errorf("action: commit | status: failure | reason: %s", err)
-				}
-				i = mid.MaxMessageSize / typing.ResultQ4Size
-				b = bytes.NewBufferString(f.clientId)
-				h.Marshal(b)
-			}
-		}
-	}
-	if i != mid.MaxMessageSize/typing.ResultQ4Size {
-		if err := f.stateMan.Prepare(); err != nil {
+		v, err := f.aggregate(file, avg)
+		if err != nil {
 			return err
+		} else if v == nil {
+			continue
 		}
-		if err := bc.Publish(ctx, f.m, "", f.sink, b.Bytes()); err != nil {
+		err = p.Add(ctx, func(b *bytes.Buffer) error {
+			return typing.ResultQ4Marshal(b, v)
+		})
+		if err != nil {
 			return err
 		}
-		if err := f.stateMan.Commit(); err != nil {
-			log.Errorf("action: commit | status: failure | reason: %s", err)
-		}
+		// stored along with the batch holding the result
+		f.stateMan.Remove("fares", file)
+	}
+	if err := p.Flush(ctx); err != nil {
+		return err
 	}
 	log.Infof("finished publishing results into %q queue", f.sink)
 
 	return nil
 }
 
-func (f *Filter) aggregate(ctx context.Context, b *bytes.Buffer, file string, fw fareWriter, avg float32) (bool, error) {
+// Result for the route, nil if none of its fares is above average.
+func (f *Filter) aggregate(route string, avg float32) (*typing.ResultQ4, error) {
 	fareSum, fareMax, count := 0.0, float32(0), 0
-	r, err := fw.Reader()
+	fares, err := f.readFares(route)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	for {
-		v, err := r.ReadFloat()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return false, err
-		}
+	for _, v := range fares {
 		if avg < v {
 			fareSum += float64(v)
 			count++
 			fareMax = max(fareMax, v)
 		}
 	}
-	origin, destination, _ := strings.Cut(file, ".")
+	origin, destination, _ := strings.Cut(route, ".")
 	if count == 0 {
 		log.Debugf("no flights with above average fare for route %s-%s", origin, destination)
-		return false, nil
+		return nil, nil
 	}
 
 	v := typing.ResultQ4{
@@ -275,84 +426,27 @@ func (f *Filter) aggregate(ctx context.Context, b *bytes.Buffer, file string, fw
 		AverageFare: float32(fareSum / float64(count)),
 		MaxFare:     fareMax,
 	}
-	typing.ResultQ4Marshal(b, &v)
 	log.Debugf("route: %s-%s | average: %f | max: %f", origin, destination, v.AverageFare, fareMax)
-	return true, nil
-}
-
-type fareWriter struct {
-	bw    *bufio.Writer
-	file  *os.File
-	Fares int64
-}
-
-func newFareWriter(path string) (fw fareWriter, err error) {
-	fw.file, err = os.Create(path)
-	fw.bw = bufio.NewWriter(fw.file)
-
-	return fw, err
-}
-
-func recoverFareWriter(path string, fares int64) (fw fareWriter, err error) {
-	fw.file, err = os.OpenFile(path, os.O_RDWR, 0644)
-	fw.bw = bufio.NewWriter(fw.file)
-	fw.Fares = fares
-	if err == nil {
-		if _, err = fw.file.Seek(fares*4, 0); err != nil {
-			fw.file.Close()
-		}
-	}
-
-	return fw, err
-}
-
-func (fw *fareWriter) Write(fare float32) error {
-	fw.Fares++
-	return binary.Write(fw.bw, binary.LittleEndian, fare)
-}
-
-func (fw *fareWriter) Flush() error {
-	return fw.bw.Flush()
+	return &v, nil
 }
 
-func (fw *fareWriter) Close() error {
-	return fw.file.Close()
+// Stages the fare to be committed along with the rest of the batch.
+func (f *Filter) appendFare(fares map[string]int64, route string, fare float32) error {
+	f.fares.Append(route, binary.LittleEndian.AppendUint32(nil, math.Float32bits(fare)))
+	fares[route]++
+	f.stateMan.Add(fares[route], "fares", route)
+	return nil
 }
 
-func (f *Filter) appendFare(fares map[string]fareWriter, file string, fare float32) error {
-	fw, ok := fares[file]
-	if !ok {
-		v, err := newFareWriter(filepath.Join(f.workdir, "fares", file))
-		if err != nil {
-			return err
-		}
-		fw = v
+// Fares committed for the route.
+func (f *Filter) readFares(route string) ([]float32, error) {
+	buf, err := f.fares.Get(route)
+	if err != nil {
+		return nil, err
 	}
-
-	err := fw.Write(fare)
-	if err == nil {
-		f.stateMan.Add(fw.Fares, "fares", file)
+	fares := make([]float32, len(buf)/4)
+	for i := range fares {
+		fares[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
 	}
-	fares[file] = fw
-	return err
-}
-
-func (fw fareWriter) Reader() (fareReader, error) {
-	_, err := fw.file.Seek(0, 0)
-	return newFareReader(fw.file), err
-}
-
-type fareReader struct {
-	br *bufio.Reader
-}
-
-func newFareReader(r io.Reader) fareReader {
-	return fareReader{
-		bufio.NewReader(r),
-	}
-}
-
-func (fr *fareReader) ReadFloat() (fare float32, err error) {
-	err = binary.Read(fr.br, binary.LittleEndian, &fare)
-	return fare, err
+	return fares, nil
 }
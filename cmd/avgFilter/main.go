@@ -18,7 +18,7 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, string, error) {
 	eof, err := m.ExchangeDeclare(v.GetString("source.eof"))
 	if err != nil {
 		return "", "", err
@@ -35,24 +35,31 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 	if _, err = m.QueueDeclare(q); err != nil {
 		return "", "", err
 	}
-	// Subscribe to average and EOF events.
-	if err := m.QueueBind(q, eof, average); err != nil {
+	// Handed off batches are published to an exchange named after the queue.
+	handoff, err := m.ExchangeDeclare(q)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := m.ExchangeDeclare(mid.RebalanceExchange); err != nil {
 		return "", "", err
 	}
-	m.SetExpectedEofCount(q, v.GetInt("demuxers"))
+	// Subscribe to average, handoff and EOF events.
+	if err := m.QueueBind(q, eof, average, handoff); err != nil {
+		return "", "", err
+	}
+	m.SetEofProducers(q, v.GetStringSlice("source.producers")...)
 
 	sink := v.GetString("sink.results")
 	if sink == "" {
 		return "", "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "sink.results")
 	}
 
-	status, err := m.QueueDeclare(v.GetString("status"))
-	if err != nil {
+	log.Info("average filter worker up")
+	if err := m.Ready(ctx, q); err != nil {
 		return "", "", err
 	}
-
-	log.Info("average filter worker up")
-	return q, sink, m.Ready(ctx, status, q)
+	node, _ := strconv.Atoi(v.GetString("id"))
+	return q, sink, mid.Join(ctx, m, v.GetString("source.queue"), node)
 }
 
 func main() {
@@ -67,7 +74,7 @@ func main() {
 		log.Fatal(fmt.Errorf("Could not parse AVG_ID env var as int: %w", err))
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -87,7 +94,8 @@ func main() {
 	beaterClient.Run()
 	toRestart := make(map[string]*common.Filter)
 	workdir := fmt.Sprintf("/clients/%d", v.GetInt("id"))
-	recovered := state.RecoverStateFiles(workdir)
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), workdir).Run(signalCtx, v.GetDuration("gc.interval"))
+	recovered := state.RecoverStateFiles(workdir, common.Schema)
 	for _, rec := range recovered {
 		id, workdir, stateMan := rec.Id, rec.Workdir, rec.State
 		filter, err := common.RecoverFromState(middleware, workerId, id, sink, workdir, stateMan)
@@ -95,6 +103,10 @@ func main() {
 			log.Error(err)
 			continue
 		}
+		if mid.IsAborted(id) {
+			filter.Close()
+			continue
+		}
 		if filter.ShouldRestart() {
 			go func() {
 				ctx, cancel := context.WithCancel(signalCtx)
@@ -102,7 +114,9 @@ func main() {
 				defer filter.Close()
 				if err := filter.Restart(ctx); err != nil {
 					log.Errorf("action: re-start filter sending results | status: failed | reason: %s", err)
-				} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+				} else if err := middleware.EOF(ctx, sink, workerId, id, filter.Sent(), filter.Peers()...); err != nil {
+					log.Fatal(err)
+				} else if err := filter.HandoffEOF(ctx); err != nil {
 					log.Fatal(err)
 				}
 			}()
@@ -125,16 +139,21 @@ func main() {
 				log.Fatal(err)
 			}
 		}
-		go func(id string, ch <-chan mid.Delivery) {
-			ctx, cancel := context.WithCancel(signalCtx)
+		go func(client mid.Client) {
+			ctx, cancel := client.Context(signalCtx)
 			defer cancel()
 			defer f.Close()
-			if err := f.Run(ctx, ch); err != nil {
+			err := f.Run(ctx, client)
+			if client.Aborted() {
+				log.Infof("action: run | result: aborted | client: %x", client.Id)
+			} else if err != nil {
+				log.Fatal(err)
+			} else if err := middleware.EOF(ctx, sink, workerId, client.Id, f.Sent(), f.Peers()...); err != nil {
 				log.Fatal(err)
-			} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+			} else if err := f.HandoffEOF(ctx); err != nil {
 				log.Fatal(err)
 			}
-		}(queue.Id, queue.Ch)
+		}(queue)
 	}
 	beater.StopBeaterClient(beaterClient)
 }
@@ -12,15 +12,18 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var ErrResultFiles = errors.New("need 4 result files")
+var ErrResultFiles = errors.New("need 4 to 6 result files")
 
 type ResultsReader struct {
 	bws   []*bufio.Writer
 	files []*os.File
 }
 
+// Files for the results of each query, optionally followed by those for the
+// rejects summary and the flights rejected. Results without a file are
+// dropped.
 func NewResultsReader(dir string, files []string) (*ResultsReader, error) {
-	if len(files) != 4 {
+	if len(files) < 4 || len(files) > 6 {
 		return nil, fmt.Errorf("%w: have %v", ErrResultFiles, files)
 	}
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -71,6 +74,11 @@ func (rr *ResultsReader) ReadResults(r io.Reader) (progress int, err error) {
 			}
 			return progress, err
 		}
+		if index > len(rr.bws) {
+			log.Debugf("action: drop_result | query: %d | value: %s", index, record)
+			progress++
+			continue
+		}
 		log.Infof("query: %d | value: %s", index, record)
 		// Add back the newline removed by the scanner
 		record = append(record, '\n')
@@ -71,6 +71,11 @@ func main() {
 			id     string
 			offset int64 = -2
 		)
+		defer func() {
+			if data != nil {
+				(*data).Close()
+			}
+		}()
 
 		for {
 			for timer := connection.NewBackoff(); ; timer.Backoff() {
@@ -121,7 +126,6 @@ func main() {
 			}
 			log.Error(err)
 		}
-		(*data).Close()
 	}()
 
 	id := <-idChan
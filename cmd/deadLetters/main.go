@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/middleware/id"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/utils"
+)
+
+const usage = `usage:
+	deadLetters list <queue> [client]
+	deadLetters inspect <queue> <index> [client]
+	deadLetters replay <queue> [client]
+	deadLetters migrate <queue>...
+
+<client> is the hex encoded client id, all clients are considered if omitted.
+migrate redeclares as quorum queues the queues left as classic queues by
+previous versions, with their workers stopped.`
+
+var ErrUsage = errors.New("invalid arguments")
+
+func parseClientId(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	clientId, err := hex.DecodeString(args[0])
+	if err == nil && len(clientId) != id.Len {
+		err = fmt.Errorf("%w: client id %q", ErrUsage, args[0])
+	}
+	return string(clientId), err
+}
+
+func list(m *mid.Middleware, queue string, args []string) error {
+	clientId, err := parseClientId(args)
+	if err != nil {
+		return err
+	}
+	dls, err := m.ListDeadLetters(queue, clientId)
+	if err != nil {
+		return err
+	}
+	for i, dl := range dls {
+		fmt.Printf("%d\tclient: %x\tsize: %d\t%s\treason: %s\n", i, dl.ClientId, len(dl.Msg), envelope(dl.Envelope), dl.Reason)
+	}
+	return nil
+}
+
+func inspect(m *mid.Middleware, queue string, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	i, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("%w: index: %s", ErrUsage, err)
+	}
+	clientId, err := parseClientId(args[1:])
+	if err != nil {
+		return err
+	}
+	dls, err := m.ListDeadLetters(queue, clientId)
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(dls) {
+		return fmt.Errorf("%w: index %d out of range [0, %d)", ErrUsage, i, len(dls))
+	}
+	dl := dls[i]
+	fmt.Printf("client: %x\nrouting key: %s\nreason: %s\n%s\n", dl.ClientId, dl.RoutingKey, dl.Reason, envelope(dl.Envelope))
+	for key, value := range dl.Headers {
+		fmt.Printf("header %s: %v\n", key, value)
+	}
+	fmt.Print(hex.Dump(dl.Msg))
+	return nil
+}
+
+func replay(m *mid.Middleware, queue string, args []string) error {
+	clientId, err := parseClientId(args)
+	if err != nil {
+		return err
+	}
+	if _, err := m.QueueDeclare(queue); err != nil {
+		return err
+	}
+	n, err := m.ReplayDeadLetters(context.Background(), queue, clientId)
+	log.Infof("action: replay | queue: %q | messages: %d", queue, n)
+	return err
+}
+
+func migrate(m *mid.Middleware, queues []string) error {
+	for _, queue := range queues {
+		if err := m.MigrateQueue(queue); err != nil {
+			return fmt.Errorf("failed to migrate queue %q: %w", queue, err)
+		}
+	}
+	return nil
+}
+
+func envelope(e mid.Envelope) string {
+	return fmt.Sprintf("type: %s/%d\tworker: %s\tmessage: %d", e.Type, e.Schema, e.Header.WorkerId, e.Header.MessageId)
+}
+
+func main() {
+	v, err := utils.InitConfig("dlq", "cmd/deadLetters")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := utils.InitLogger(v.GetString("log.level")); err != nil {
+		log.Fatal(err)
+	}
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer middleware.Close()
+
+	cmd, queue, args := os.Args[1], os.Args[2], os.Args[3:]
+	switch cmd {
+	case "list":
+		err = list(middleware, queue, args)
+	case "inspect":
+		err = inspect(middleware, queue, args)
+	case "replay":
+		err = replay(middleware, queue, args)
+	case "migrate":
+		err = migrate(middleware, append([]string{queue}, args...))
+	default:
+		err = fmt.Errorf("%w: unknown command %q", ErrUsage, cmd)
+	}
+	if errors.Is(err, ErrUsage) {
+		fmt.Fprintln(os.Stderr, usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
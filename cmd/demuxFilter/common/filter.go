@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/duplicates"
 	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
@@ -30,23 +29,40 @@ const (
 
 var ErrUnsupported = errors.New("unsupported operation")
 
+// Fields of the flights read to route them, the rest are only forwarded.
+var (
+	flightOrigin      = typing.FlightRecord.Field("Origin")
+	flightDestination = typing.FlightRecord.Field("Destination")
+	flightFare        = typing.FlightRecord.Field("Fare")
+	flightDistance    = typing.FlightRecord.Field("Distance")
+	flightStops       = typing.FlightRecord.Field("Stops")
+)
+
+var stopSeparator = []byte("||")
+
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("demux", 2).
+	Register(1, duplicates.MigrateLastReceived)
+
 type Filter struct {
-	m        *mid.Middleware
+	m        mid.Broker
 	workerId string
 	clientId string
 	sinks    []string
 	keyGens  []mid.KeyGenerator
+	sharding *Sharding
 	workdir  string
 	filter   *duplicates.DuplicateFilter
+	sent     mid.MessageCounter
 	stateMan *state.StateManager
 }
 
-func NewFilter(m *mid.Middleware, workerId, clientId string, sinks []string, workdir string, nWorkers []int) (*Filter, error) {
+func NewFilter(m mid.Broker, workerId, clientId string, sinks []string, workdir string, sharding *Sharding) (*Filter, error) {
 	err := os.MkdirAll(workdir, 0755)
 
-	kgs := make([]mid.KeyGenerator, 0, len(nWorkers))
-	for _, mod := range nWorkers {
-		kgs = append(kgs, mid.NewKeyGenerator(mod))
+	kgs := make([]mid.KeyGenerator, 0, len(sharding.nodes))
+	for i := range sharding.nodes {
+		kgs = append(kgs, mid.NewKeyGenerator(sharding.Nodes(i)))
 	}
 	return &Filter{
 		m:        m,
@@ -55,16 +71,27 @@ func NewFilter(m *mid.Middleware, workerId, clientId string, sinks []string, wor
 		sinks:    sinks,
 		workdir:  workdir,
 		keyGens:  kgs,
+		sharding: sharding,
 		filter:   duplicates.NewDuplicateFilter(),
-		stateMan: state.NewStateManager(workdir),
+		sent:     mid.NewMessageCounter(),
+		stateMan: state.NewStateManager(workdir).WithSchema(Schema),
 	}, err
 }
 
-func RecoverFromState(m *mid.Middleware, workerId, clientId string, sinks []string, workdir string, nWorkers []int, stateMan *state.StateManager) (*Filter, error) {
-	f, err := NewFilter(m, workerId, clientId, sinks, workdir, nWorkers)
+func RecoverFromState(m mid.Broker, workerId, clientId string, sinks []string, workdir string, sharding *Sharding, stateMan *state.StateManager) (*Filter, error) {
+	f, err := NewFilter(m, workerId, clientId, sinks, workdir, sharding)
 	if err == nil {
 		err = f.filter.RecoverFromState(stateMan)
 	}
+	// the client keeps being sharded as before, until its next batch
+	if nodes, errNodes := stateMan.GetIntSlice("nodes"); errNodes == nil && len(nodes) == len(f.keyGens) {
+		for i, n := range nodes {
+			f.keyGens[i] = mid.NewKeyGenerator(n)
+		}
+	}
+	if err == nil {
+		f.sent, err = mid.MessageCounterFromState(stateMan)
+	}
 	f.stateMan = stateMan
 	return f, err
 }
@@ -93,6 +120,11 @@ func (f *Filter) Restart(ctx context.Context) error {
 	}
 }
 
+// Batches sent for the client, to be sent along with its EOF.
+func (f *Filter) Sent() mid.MessageCounter {
+	return f.sent
+}
+
 func (f *Filter) Close() error {
 	return state.RemoveWorkdir(f.workdir)
 }
@@ -102,6 +134,12 @@ func (f *Filter) Prepare(sum float64, count, state int) error {
 	f.stateMan.State["sum"] = sum
 	f.stateMan.State["count"] = count
 	f.stateMan.State["state"] = state
+	f.sent.AddToState(f.stateMan)
+	nodes := make([]int, 0, len(f.keyGens))
+	for _, kg := range f.keyGens {
+		nodes = append(nodes, kg.Nodes())
+	}
+	f.stateMan.State["nodes"] = nodes
 
 	return f.stateMan.Prepare()
 }
@@ -112,11 +150,16 @@ func (f *Filter) GetFareInfo() (float64, int) {
 	return sum, count
 }
 
-func (f *Filter) marshalHeaderInto(b *bytes.Buffer, h *typing.BatchHeader) {
-	h.Marshal(b)
+// Buffer for a batch of the given type, starting with its Envelope.
+func (f *Filter) newBuffer(h *typing.BatchHeader, t mid.PayloadType) (*bytes.Buffer, error) {
+	env, err := mid.NewEnvelope(f.clientId, *h, t)
+	if err != nil {
+		return nil, err
+	}
+	return env.Buffer(), nil
 }
 
-func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
+func (f *Filter) Run(ctx context.Context, client mid.Client) error {
 	fareSum, fareCount := f.GetFareInfo()
 	dc := f.m.NewDeferredConfirmer(ctx)
 	h, err := typing.RecoverHeader(f.stateMan, f.workerId)
@@ -124,65 +167,67 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
 		return err
 	}
 
-	rr, err := mid.RoundRobinFromState(f.stateMan, f.keyGens[Distance])
+	rr, err := mid.RoundRobinFromShards(f.stateMan, f.sharding.DistanceShards())
 	if err != nil {
 		return err
 	}
-	for d := range ch {
-		msg, tag := d.Msg, d.Tag
-		r := bytes.NewReader(msg)
-		dup, err := f.filter.Update(r)
-		if err != nil {
+	flights := typing.FlightRecord.NewScanner(typing.NewInterner())
+	client.Resume(f.filter)
+	for d := range client.Ch {
+		tag := d.Tag
+		if err := d.Expect(mid.FlightsPayload); err != nil {
 			log.Errorf("action: reading_batch | status: failed | reason: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
 		}
-		if dup || err != nil {
+		if dup, err := f.filter.Update(d.Header); err != nil {
+			log.Errorf("action: dedup | result: failure | error: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		} else if dup {
 			f.m.Ack(tag)
 			continue
 		}
-		var (
-			bDistance = bytes.NewBufferString(f.clientId)
-			bResult   = bytes.NewBufferString(f.clientId)
-			mAverage  = make(map[string]*bytes.Buffer)
-			mFastest  = make(map[string]*bytes.Buffer)
-		)
-		f.marshalHeaderInto(bDistance, &h)
-		f.marshalHeaderInto(bResult, &h)
-		for r.Len() > 0 {
-			data, err := typing.FlightUnmarshal(r)
-			if err != nil {
+		if err := checkBatch(flights, d.Msg); err != nil {
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
 				return err
 			}
-			fareSum += float64(data.Fare)
+			continue
+		}
+		handoffs, err := f.rebalance(&h)
+		if err != nil {
+			return err
+		}
+		// sent first, so that nodes learn about the new ring before the
+		// batches sharded with it
+		for exchange, b := range handoffs {
+			f.sent.Add(exchange, mid.HandoffRoutingKey)
+			if err := f.m.Publish(ctx, dc, exchange, mid.HandoffRoutingKey, mid.Seal(b)); err != nil {
+				return err
+			}
+		}
+		bs := f.newBatches(dc, &h, &rr)
+		for flights.Reset(d.Msg); flights.Next(); {
+			data := flights.View()
+			fareSum += float64(data.Float32(flightFare))
 			fareCount++
 
-			f.marshalDistanceFilter(bDistance, &data)
-			f.marshalAverageFilter(mAverage, f.sinks[Average], &h, &data)
-			if strings.Count(data.Stops, "||") >= 3 {
-				f.marshalFastestFilter(mFastest, f.sinks[Fastest], &data)
-				f.marshalResult(bResult, &data)
+			if err := bs.add(ctx, data); err != nil {
+				return err
 			}
 		}
-		h.MessageId++
+		if err := bs.flush(ctx); err != nil {
+			return err
+		}
 		h.AddToState(f.stateMan.State)
-		distanceKey := rr.NextKey(f.sinks[Distance])
 		rr.AddToState(f.stateMan)
 		if err := f.Prepare(fareSum, fareCount, Receiving); err != nil {
 			return err
 		}
-		if err := f.sendBuffer(ctx, dc, distanceKey, bDistance); err != nil {
-			return err
-		}
-		if err := f.sendMap(ctx, dc, mAverage); err != nil {
-			return err
-		}
-		if len(mFastest) > 0 {
-			if err := f.sendMap(ctx, dc, mFastest); err != nil {
-				return err
-			}
-			if err := f.sendBuffer(ctx, dc, f.sinks[Result], bResult); err != nil {
-				return err
-			}
-		}
 		if err := dc.Confirm(ctx); err != nil {
 			return err
 		}
@@ -209,66 +254,148 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
 	return f.sendAverageFare(ctx, &h, fareSum, fareCount)
 }
 
-func (f *Filter) marshalDistanceFilter(b *bytes.Buffer, data *typing.Flight) {
-	// ignore flights with missing required field
-	if data.Distance > 0 {
-		typing.DistanceFilterMarshal(b, data)
+// Scans the whole batch before applying any of it, so that a malformed batch
+// can be rejected without leaving it half processed.
+func checkBatch(flights *typing.Scanner[typing.Flight], msg []byte) error {
+	for flights.Reset(msg); flights.Next(); {
 	}
+	return flights.Err()
 }
 
-func (f *Filter) marshalAverageFilter(m map[string]*bytes.Buffer, sink string, h *typing.BatchHeader, data *typing.Flight) {
-	key := f.keyGens[Average].KeyFrom(sink, data.Origin, data.Destination)
-	b, ok := m[key]
-	if !ok {
-		b = bytes.NewBufferString(f.clientId)
-		f.marshalHeaderInto(b, h)
-		m[key] = b
+// Grows the rings of the client's sinks which got new nodes. Returns the
+// Handoff to be sent to each of their nodes, by exchange, marshalled with the
+// given header which is then moved past.
+func (f *Filter) rebalance(h *typing.BatchHeader) (map[string]*bytes.Buffer, error) {
+	handoffs := make(map[string]*bytes.Buffer)
+	for _, i := range []int{Fastest, Average} {
+		from, to := f.keyGens[i].Nodes(), f.sharding.Nodes(i)
+		if to <= from {
+			continue
+		}
+		log.Infof("action: rebalance | client: %x | sink: %q | from: %d | to: %d", f.clientId, f.sinks[i], from, to)
+		f.keyGens[i] = mid.NewKeyGenerator(to)
+		for node := 1; node <= to; node++ {
+			b, err := f.newBuffer(h, mid.HandoffPayload)
+			if err != nil {
+				return nil, err
+			}
+			if err := mid.NewHandoff(f.sinks[i], node, from, to).Marshal(b); err != nil {
+				return nil, err
+			}
+			handoffs[fmt.Sprintf("%s.%d", f.sinks[i], node)] = b
+		}
+	}
+	if len(handoffs) > 0 {
+		h.MessageId++
 	}
+	return handoffs, nil
+}
 
-	typing.AverageFilterMarshal(b, data)
+// The batches a batch of flights is split into, which are published once
+// confirmed by the DeferredConfirmer. They share the header, and are stored
+// along with it once the flights were added.
+type batches struct {
+	f        *Filter
+	c        mid.Confirmer
+	h        *typing.BatchHeader
+	distance *mid.BatchPublisher
+	result   *mid.BatchPublisher
+	// by routing key
+	average map[string]*mid.BatchPublisher
+	fastest map[string]*mid.BatchPublisher
 }
 
-func (f *Filter) marshalFastestFilter(m map[string]*bytes.Buffer, sink string, data *typing.Flight) {
-	key := f.keyGens[Fastest].KeyFrom(sink, data.Origin, data.Destination)
-	b, ok := m[key]
-	if !ok {
-		b = bytes.NewBufferString(f.clientId)
-		m[key] = b
+func (f *Filter) newBatches(c mid.Confirmer, h *typing.BatchHeader, rr *mid.RoundRobinKeysGenerator) *batches {
+	distance := func() (string, string) {
+		return "", rr.NextKey(f.sinks[Distance])
+	}
+	return &batches{
+		f:        f,
+		c:        c,
+		h:        h,
+		distance: f.newPublisher(c, h, mid.DistancePayload, distance),
+		result:   f.newPublisher(c, h, mid.ResultsPayload, mid.To("", f.sinks[Result])),
+		average:  make(map[string]*mid.BatchPublisher),
+		fastest:  make(map[string]*mid.BatchPublisher),
 	}
+}
 
-	typing.FastestFilterMarshal(b, data)
+func (f *Filter) newPublisher(c mid.Confirmer, h *typing.BatchHeader, t mid.PayloadType, route mid.Route) *mid.BatchPublisher {
+	return mid.NewBatchPublisher(f.m, f.clientId, t, h, f.sent, route).WithConfirmer(c)
 }
 
-func (f *Filter) marshalResult(b *bytes.Buffer, data *typing.Flight) {
-	typing.ResultQ1Marshal(b, data)
+func (bs *batches) add(ctx context.Context, data *typing.View[typing.Flight]) error {
+	f := bs.f
+	// ignore flights with missing required field
+	if data.Uint32(flightDistance) > 0 {
+		if err := bs.distance.Add(ctx, marshalWith(typing.DistanceFilterMarshalView, data)); err != nil {
+			return err
+		}
+	}
+	origin, destination := data.String(flightOrigin), data.String(flightDestination)
+	key := f.keyGens[Average].KeyFrom(f.sinks[Average], origin, destination)
+	if err := bs.keyed(bs.average, key, mid.AveragePayload).Add(ctx, marshalWith(typing.AverageFilterMarshalView, data)); err != nil {
+		return err
+	}
+	if bytes.Count(data.Bytes(flightStops), stopSeparator) < 3 {
+		return nil
+	}
+	key = f.keyGens[Fastest].KeyFrom(f.sinks[Fastest], origin, destination)
+	if err := bs.keyed(bs.fastest, key, mid.FastestPayload).Add(ctx, marshalWith(typing.FastestFilterMarshalView, data)); err != nil {
+		return err
+	}
+	return bs.result.Add(ctx, marshalWith(typing.ResultQ1MarshalView, data))
 }
 
-func (f *Filter) sendBuffer(ctx context.Context, c mid.Confirmer, key string, b *bytes.Buffer) error {
-	return f.m.Publish(ctx, c, "", key, b.Bytes())
+func (bs *batches) keyed(m map[string]*mid.BatchPublisher, key string, t mid.PayloadType) *mid.BatchPublisher {
+	p, ok := m[key]
+	if !ok {
+		p = bs.f.newPublisher(bs.c, bs.h, t, mid.To("", key))
+		m[key] = p
+	}
+	return p
 }
 
-func (f *Filter) sendMap(ctx context.Context, c mid.Confirmer, m map[string]*bytes.Buffer) error {
-	for key, b := range m {
-		if err := f.m.Publish(ctx, c, "", key, b.Bytes()); err != nil {
-			return err
+func (bs *batches) flush(ctx context.Context) error {
+	if err := bs.distance.Flush(ctx); err != nil {
+		return err
+	}
+	for _, m := range []map[string]*mid.BatchPublisher{bs.average, bs.fastest} {
+		for _, p := range m {
+			if err := p.Flush(ctx); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	return bs.result.Flush(ctx)
+}
+
+func marshalWith(marshal func(*bytes.Buffer, *typing.View[typing.Flight]), data *typing.View[typing.Flight]) func(*bytes.Buffer) error {
+	return func(b *bytes.Buffer) error {
+		marshal(b, data)
+		return nil
+	}
 }
 
 func (f *Filter) sendAverageFare(ctx context.Context, h *typing.BatchHeader, fareSum float64, fareCount int) error {
 	var bc mid.BasicConfirmer
-	b := bytes.NewBufferString(f.clientId)
-	h.Marshal(b)
-	typing.AverageFareMarshal(b, fareSum, fareCount)
+	b, err := f.newBuffer(h, mid.AveragePayload)
+	if err != nil {
+		return err
+	}
+	if err := typing.AverageFareMarshal(b, fareSum, fareCount); err != nil {
+		return err
+	}
 	delete(f.stateMan.State, "sum")
 	delete(f.stateMan.State, "count")
 	f.stateMan.State["state"] = Finished
+	f.sent.Add(f.sinks[Average], "average")
+	f.sent.AddToState(f.stateMan)
 	if err := f.stateMan.Prepare(); err != nil {
 		return err
 	}
 
-	err := bc.Publish(ctx, f.m, f.sinks[Average], "average", b.Bytes())
+	err = bc.Publish(ctx, f.m, f.sinks[Average], "average", mid.Seal(b))
 	if err == nil {
 		f.stateMan.Commit()
 	}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"os"
+	"slices"
+	"sync"
+
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sharding keeps the amount of nodes of each sink, which grows as nodes join
+// through middleware.Join(). Clients already being sharded switch to the new
+// amount on their next batch.
+type Sharding struct {
+	mtx      sync.Mutex
+	sinks    []string
+	nodes    []int
+	stateMan *state.StateManager
+	// registered as the nodes of the Distance sink, if known
+	members      *mid.Membership
+	distanceRole string
+}
+
+func NewSharding(workdir string, sinks []string, nodes []int) (*Sharding, error) {
+	s := &Sharding{
+		sinks:    sinks,
+		nodes:    slices.Clone(nodes),
+		stateMan: state.NewStateManager(workdir),
+	}
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.stateMan.RecoverState(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	joined, err := s.stateMan.GetIntSlice("nodes")
+	if err == nil {
+		for i := 0; i < min(len(joined), len(s.nodes)); i++ {
+			s.nodes[i] = max(s.nodes[i], joined[i])
+		}
+	}
+	return s, nil
+}
+
+// Takes the nodes of the Distance sink from the members registered with the
+// given role, rather than from their amount.
+func (s *Sharding) WithMembers(ms *mid.Membership, distanceRole string) *Sharding {
+	s.members, s.distanceRole = ms, distanceRole
+	return s
+}
+
+// Nodes of the Distance sink to deal batches to in turns: the members with
+// its role, or every node if there are none.
+func (s *Sharding) DistanceShards() []int {
+	if s.members != nil {
+		if shards := s.members.Shards(s.distanceRole); len(shards) > 0 {
+			return shards
+		}
+	}
+	shards := make([]int, s.Nodes(Distance))
+	for i := range shards {
+		shards[i] = i + 1
+	}
+	return shards
+}
+
+func (s *Sharding) Nodes(sink int) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.nodes[sink]
+}
+
+func (s *Sharding) Join(sink string, node int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i := slices.Index(s.sinks, sink)
+	if i < 0 || i == Distance || node <= s.nodes[i] {
+		return nil
+	}
+	log.Infof("action: join | result: success | sink: %q | nodes: %d", sink, node)
+	s.nodes[i] = node
+	s.stateMan.State["nodes"] = s.nodes
+	return s.stateMan.DumpState()
+}
+
+// Handles the nodes announced through `msgs' until it's closed.
+func (s *Sharding) Run(msgs <-chan []byte) {
+	for msg := range msgs {
+		sink, node, err := mid.UnmarshalJoin(msg)
+		if err != nil {
+			log.Errorf("action: join | result: failure | error: %s", err)
+			continue
+		}
+		if err := s.Join(sink, node); err != nil {
+			log.Errorf("action: join | result: failure | sink: %q | error: %s", sink, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -17,7 +18,7 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, []string, string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, []string, string, error) {
 	source, err := m.ExchangeDeclare(v.GetString("source.queue"))
 	if err != nil {
 		return "", nil, "", err
@@ -35,6 +36,7 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 	if err := m.QueueBind(q, source); err != nil {
 		return "", nil, "", err
 	}
+	m.SetEofProducers(q, v.GetStringSlice("source.producers")...)
 
 	distance := v.GetString("sink.distance")
 	if distance == "" {
@@ -57,13 +59,27 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 		return "", nil, "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "sink.eof")
 	}
 
-	status, err := m.QueueDeclare(v.GetString("status"))
+	log.Info("demux filter worker up")
+	return q, []string{distance, fastest, average, results}, eof, m.Ready(ctx, q)
+}
+
+// Subscribes to the nodes joining the sinks, see middleware.Join().
+func setupRebalance(ctx context.Context, m mid.Broker, source string) (<-chan []byte, error) {
+	rebalance, err := m.ExchangeDeclare(mid.RebalanceExchange)
 	if err != nil {
-		return "", nil, "", err
+		return nil, err
 	}
-
-	log.Info("demux filter worker up")
-	return q, []string{distance, fastest, average, results}, eof, m.Ready(ctx, status, q)
+	q, err := mid.QueueName(rebalance, source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = m.QueueDeclare(q); err != nil {
+		return nil, err
+	}
+	if err := m.QueueBind(q, rebalance); err != nil {
+		return nil, err
+	}
+	return m.Subscribe(ctx, q)
 }
 
 func main() {
@@ -75,7 +91,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -98,15 +114,35 @@ func main() {
 		v.GetInt("workers.q4"),
 	}
 	workdir := fmt.Sprintf("/clients/%d", v.GetInt("id"))
+	sharding, err := common.NewSharding(filepath.Join(workdir, "sharding"), sinks, nWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if role := v.GetString("members.distance"); role != "" {
+		membership, err := middleware.Membership()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharding.WithMembers(membership, role)
+	}
+	joins, err := setupRebalance(signalCtx, middleware, source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go sharding.Run(joins)
 	toRestart := make(map[string]*common.Filter)
-	recovered := state.RecoverStateFiles(workdir)
+	recovered := state.RecoverStateFiles(workdir, common.Schema)
 	for _, rec := range recovered {
 		id, workdir, stateMan := rec.Id, rec.Workdir, rec.State
-		filter, err := common.RecoverFromState(middleware, workerId, id, sinks, workdir, nWorkers, stateMan)
+		filter, err := common.RecoverFromState(middleware, workerId, id, sinks, workdir, sharding, stateMan)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
+		if mid.IsAborted(id) {
+			filter.Close()
+			continue
+		}
 		if filter.ShouldRestart() {
 			go func() {
 				ctx, cancel := context.WithCancel(signalCtx)
@@ -121,7 +157,7 @@ func main() {
 				default:
 				}
 
-				if err := middleware.EOF(ctx, eof, workerId, id); err != nil {
+				if err := middleware.EOF(ctx, eof, workerId, id, filter.Sent()); err != nil {
 					log.Fatal(err)
 				}
 			}()
@@ -133,6 +169,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), workdir).Run(signalCtx, v.GetDuration("gc.interval"))
 	beaterClient := beater.StartBeaterClient(v)
 	beaterClient.Run()
 	for queue := range queues {
@@ -141,17 +178,21 @@ func main() {
 			delete(toRestart, queue.Id)
 		} else {
 			workdir := filepath.Join(workdir, hex.EncodeToString([]byte(queue.Id)))
-			filter, err = common.NewFilter(middleware, workerId, queue.Id, sinks, workdir, nWorkers)
+			filter, err = common.NewFilter(middleware, workerId, queue.Id, sinks, workdir, sharding)
 			if err != nil {
 				log.Fatalf("action worker_init | status: failure | reason: %s", err)
 			}
 		}
-		go func(clientId string, ch <-chan mid.Delivery) {
-			ctx, cancel := context.WithCancel(signalCtx)
+		go func(client mid.Client) {
+			ctx, cancel := client.Context(signalCtx)
 			defer cancel()
 			defer filter.Close()
 
-			if err := filter.Run(ctx, ch); err != nil {
+			err := filter.Run(ctx, client)
+			if client.Aborted() {
+				log.Infof("action: run | result: aborted | client: %x", client.Id)
+				return
+			} else if err != nil {
 				log.Fatal(err)
 			}
 
@@ -162,10 +203,15 @@ func main() {
 			}
 
 			// send EOF to sinks
-			if err := middleware.EOF(ctx, eof, workerId, clientId); err != nil {
+			if err := middleware.EOF(ctx, eof, workerId, client.Id, filter.Sent()); err != nil {
 				log.Fatal(err)
 			}
-		}(queue.Id, queue.Ch)
+		}(queue)
 	}
 	beater.StopBeaterClient(beaterClient)
+	deregisterCtx, cancelDeregister := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDeregister()
+	if err := mid.DeregisterIdle(deregisterCtx, middleware, workerId, workdir, source); err != nil {
+		log.Errorf("action: deregister | result: failure | error: %s", err)
+	}
 }
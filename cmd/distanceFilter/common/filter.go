@@ -19,16 +19,29 @@ import (
 
 const distanceFactor = 4
 
+// Fields of the flights read to filter them, the rest are only forwarded.
+var (
+	flightId          = typing.DistanceFilterRecord.Field("ID")
+	flightOrigin      = typing.DistanceFilterRecord.Field("Origin")
+	flightDestination = typing.DistanceFilterRecord.Field("Destination")
+	flightDistance    = typing.DistanceFilterRecord.Field("Distance")
+)
+
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("distance", 2).
+	Register(1, duplicates.MigrateLastReceived)
+
 type Filter struct {
-	m        *mid.Middleware
+	m        mid.Broker
 	workerId string
 	clientId string
 	sink     string
 	workdir  string
+	sent     mid.MessageCounter
 	stateMan *state.StateManager
 }
 
-func NewFilter(m *mid.Middleware, workerId, clientId, sink, workdir string) (*Filter, error) {
+func NewFilter(m mid.Broker, workerId, clientId, sink, workdir string) (*Filter, error) {
 	err := os.MkdirAll(filepath.Join(workdir, "coordinates"), 0755)
 	return &Filter{
 		m,
@@ -36,35 +49,83 @@ func NewFilter(m *mid.Middleware, workerId, clientId, sink, workdir string) (*Fi
 		clientId,
 		sink,
 		workdir,
-		state.NewStateManager(workdir),
+		mid.NewMessageCounter(),
+		state.NewStateManager(workdir).WithSchema(Schema),
 	}, err
 }
 
-func NewWithState(m *mid.Middleware, workerId, clientId, sink, workdir string, stateMan *state.StateManager) (*Filter, error) {
+func NewWithState(m mid.Broker, workerId, clientId, sink, workdir string, stateMan *state.StateManager) (*Filter, error) {
 	filter, err := NewFilter(m, workerId, clientId, sink, workdir)
+	if err == nil {
+		filter.sent, err = mid.MessageCounterFromState(stateMan)
+	}
 	filter.stateMan = stateMan
 	return filter, err
 }
 
+// Batches sent for the client, to be sent along with its EOF.
+func (f *Filter) Sent() mid.MessageCounter {
+	return f.sent
+}
+
 func (f *Filter) Close() error {
 	return state.RemoveWorkdir(f.workdir)
 }
 
-func (f *Filter) AddCoords(ctx context.Context, coords <-chan mid.Delivery) error {
+// Name of the file in the workdir keeping the batches of coordinates received,
+// apart from the state since that one is only stored once all of them are.
+const CoordsStateFile = "coords.json"
+
+func (f *Filter) AddCoords(ctx context.Context, coords mid.Client) error {
 
 	if err := f.stateMan.Prepare(); err != nil {
 		return err
 	}
-	for d := range coords {
-		msg, tag := d.Msg, d.Tag
-		code, err := typing.ReadString(bytes.NewReader(msg))
+	df, received, err := f.recoverCoordsFilter()
+	if err != nil {
+		return err
+	}
+	coords.Resume(df)
+	for d := range coords.Ch {
+		// the batch is stored without its envelope, named after its first
+		// airport
+		batch, tag := d.Msg, d.Tag
+		err := d.Expect(mid.CoordsPayload)
+		var code string
+		if err == nil {
+			code, err = typing.ReadString(bytes.NewReader(batch))
+		}
+		if err != nil {
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if dup, err := df.Update(d.Header); err != nil {
+			log.Errorf("action: dedup | result: failure | error: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		} else if dup {
+			if err := f.m.Ack(tag); err != nil {
+				return err
+			}
+			continue
+		}
+		// the batch is stored along with the ones received so far
+		tx, err := state.NewTx(f.workdir)
 		if err != nil {
 			return err
 		}
-		// We use state.WriteFile() because it conveniently syncs the
-		// filesystem after it's done.
-		// Otherwise, os.WriteFile() would suffice.
-		if err := state.WriteFile(filepath.Join(f.workdir, "coordinates", code), msg); err != nil {
+		df.AddToState(received)
+		if err := tx.WriteFile(filepath.Join("coordinates", code), batch); err != nil {
+			return err
+		}
+		if err := tx.WriteState(received); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
 			return err
 		}
 		if err := f.m.Ack(tag); err != nil {
@@ -79,7 +140,24 @@ func (f *Filter) AddCoords(ctx context.Context, coords <-chan mid.Delivery) erro
 	}
 }
 
-func (f *Filter) Run(ctx context.Context, flights <-chan mid.Delivery) error {
+// Recovers the batches of coordinates received before a crash, finishing the
+// transaction left by it if any.
+func (f *Filter) recoverCoordsFilter() (*duplicates.DuplicateFilter, *state.StateManager, error) {
+	df := duplicates.NewDuplicateFilter()
+	received := state.NewStateManager(f.workdir)
+	received.Filename = filepath.Join(f.workdir, CoordsStateFile)
+	if _, err := state.RecoverTx(f.workdir); err != nil {
+		return nil, nil, err
+	}
+	if err := received.RecoverState(); os.IsNotExist(err) {
+		return df, received, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return df, received, df.RecoverFromState(received)
+}
+
+func (f *Filter) Run(ctx context.Context, flights mid.Client) error {
 	df := duplicates.NewDuplicateFilter()
 	sm := f.stateMan
 	if err := df.RecoverFromState(sm); err != nil {
@@ -96,41 +174,54 @@ func (f *Filter) Run(ctx context.Context, flights <-chan mid.Delivery) error {
 		return err
 	}
 
-	for d := range flights {
-		msg, tag := d.Msg, d.Tag
-		r := bytes.NewReader(msg)
-		dup, err := df.Update(r)
-		if err != nil {
+	batch := typing.DistanceFilterRecord.NewScanner(typing.NewInterner())
+	flights.Resume(df)
+	for d := range flights.Ch {
+		tag := d.Tag
+		if err := d.Expect(mid.DistancePayload); err != nil {
 			log.Errorf("action: reading_batch | status: failed | reason: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
 		}
-		if dup || err != nil {
+		if dup, err := df.Update(d.Header); err != nil {
+			log.Errorf("action: dedup | result: failure | error: %s", err)
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		} else if dup {
 			f.m.Ack(tag)
 			continue
 		}
+		long, err := longFlights(comp, batch, d.Msg)
+		if err != nil {
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
 		h.MessageId++
 		h.AddToState(f.stateMan.State)
 		df.AddToState(sm)
-		if err := sm.Prepare(); err != nil {
+		env, err := mid.NewEnvelope(f.clientId, h, mid.ResultsPayload)
+		if err != nil {
 			return err
 		}
-		b := bytes.NewBufferString(f.clientId)
-		for r.Len() > 0 {
-			data, err := typing.DistanceFilterUnmarshal(r)
-			if err != nil {
-				return err
-			}
-			log.Debugf("new flight for route %s-%s", data.Origin, data.Destination)
-			distanceMi, err := comp.Distance(data.Origin, data.Destination)
-			if err != nil {
-				return err
-			}
-			if float64(data.Distance) > distanceFactor*distanceMi {
-				log.Debugf("long flight: %x", data.ID)
-				f.marshalResult(b, &h, &data)
-			}
+		b := env.Buffer()
+		for _, data := range long {
+			f.marshalResult(b, data)
 		}
-		if b.Len() > len(f.clientId) {
-			if err := bc.Publish(ctx, f.m, "", f.sink, b.Bytes()); err != nil {
+		if b.Len() > env.Len() {
+			f.sent.Add("", f.sink)
+			f.sent.AddToState(sm)
+		}
+		if err := sm.Prepare(); err != nil {
+			return err
+		}
+		if b.Len() > env.Len() {
+			if err := bc.Publish(ctx, f.m, "", f.sink, mid.Seal(b)); err != nil {
 				return err
 			}
 		}
@@ -145,12 +236,30 @@ func (f *Filter) Run(ctx context.Context, flights <-chan mid.Delivery) error {
 	return context.Cause(ctx)
 }
 
-func (f *Filter) marshalResult(b *bytes.Buffer, h *typing.BatchHeader, data *typing.DistanceFilter) {
-	if b.Len() == len(f.clientId) {
-		h.Marshal(b)
+// Scans the whole batch, returning the flights whose distance is more than
+// distanceFactor times the direct distance between its airports, as they're
+// encoded in the batch.
+func longFlights(comp *distance.DistanceComputer, batch *typing.Scanner[typing.DistanceFilter], msg []byte) ([][]byte, error) {
+	var long [][]byte
+	for batch.Reset(msg); batch.Next(); {
+		data := batch.View()
+		origin, destination := data.String(flightOrigin), data.String(flightDestination)
+		log.Debugf("new flight for route %s-%s", origin, destination)
+		distanceMi, err := comp.Distance(origin, destination)
+		if err != nil {
+			return nil, err
+		}
+		if float64(data.Uint32(flightDistance)) > distanceFactor*distanceMi {
+			log.Debugf("long flight: %x", data.Bytes(flightId))
+			long = append(long, data.Raw())
+		}
 	}
-	typing.ResultQ2Marshal(b, data)
+	return long, batch.Err()
+}
 
+// The results are the flights as they're received.
+func (f *Filter) marshalResult(b *bytes.Buffer, data []byte) {
+	typing.ResultQ2Record.MarshalRaw(b, data)
 }
 
 func (f *Filter) loadDistanceComputer() (*distance.DistanceComputer, error) {
@@ -174,13 +283,12 @@ func (f *Filter) loadDistanceComputer() (*distance.DistanceComputer, error) {
 }
 
 func loadCoordinates(comp *distance.DistanceComputer, file string) error {
-	f, err := os.Open(file)
+	buf, err := state.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	r := bufio.NewReader(f)
+	r := bufio.NewReader(bytes.NewReader(buf))
 	for {
 		data, err := typing.AirportCoordsUnmarshal(r)
 		if err != nil {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -18,7 +19,7 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, string, string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, string, string, error) {
 	coords, err := m.ExchangeDeclare(v.GetString("source.coords.exchange"))
 	if err != nil {
 		return "", "", "", err
@@ -36,6 +37,7 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 	if err := m.QueueBind(qCoords, coords); err != nil {
 		return "", "", "", err
 	}
+	m.SetEofProducers(qCoords, v.GetStringSlice("source.coords.producers")...)
 
 	eof, err := m.ExchangeDeclare(v.GetString("source.flights.eof"))
 	if err != nil {
@@ -54,20 +56,15 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 	if err := m.QueueBind(qFlights, eof); err != nil {
 		return "", "", "", err
 	}
-	m.SetExpectedEofCount(qFlights, v.GetInt("demuxers"))
+	m.SetEofProducers(qFlights, v.GetStringSlice("source.flights.producers")...)
 
 	sink := v.GetString("sink.results")
 	if sink == "" {
 		return "", "", "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "sink.results")
 	}
 
-	status, err := m.QueueDeclare(v.GetString("status"))
-	if err != nil {
-		return "", "", "", err
-	}
-
 	log.Info("distance filter worker up")
-	return qCoords, qFlights, sink, m.Ready(ctx, status, qCoords)
+	return qCoords, qFlights, sink, m.Ready(ctx, qCoords)
 }
 
 func main() {
@@ -79,7 +76,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,12 +93,16 @@ func main() {
 	}
 	workerId := coordsSource
 	workdir := fmt.Sprintf("/clients/%d", v.GetInt("id"))
-	flightsChs := make(map[string]chan (<-chan mid.Delivery))
+	flightsChs := make(map[string]chan mid.Client)
 	var mtx sync.Mutex
-	recovered := state.RecoverStateFiles(workdir)
+	recovered := state.RecoverStateFiles(workdir, common.Schema)
 	for _, rec := range recovered {
 		id, workdir, stateMan := rec.Id, rec.Workdir, rec.State
-		ch := make(chan (<-chan mid.Delivery))
+		if mid.IsAborted(id) {
+			state.RemoveWorkdir(workdir)
+			continue
+		}
+		ch := make(chan mid.Client)
 		flightsChs[id] = ch
 
 		go func(stateMan *state.StateManager) {
@@ -115,14 +116,19 @@ func main() {
 			select {
 			case <-ctx.Done():
 				return
-			case delivery := <-ch:
+			case flights := <-ch:
 				mtx.Lock()
 				delete(flightsChs, id)
 				mtx.Unlock()
 				log.Info("action: restart_worker | status: on_flights")
-				if err := filter.Run(ctx, delivery); err != nil {
+				ctx, cancel := flights.Context(ctx)
+				defer cancel()
+				err := filter.Run(ctx, flights)
+				if flights.Aborted() {
+					log.Infof("action: run | result: aborted | client: %x", id)
+				} else if err != nil {
 					log.Fatal(err)
-				} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+				} else if err := middleware.EOF(ctx, sink, workerId, id, filter.Sent()); err != nil {
 					log.Fatal(err)
 				}
 			}
@@ -136,6 +142,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), workdir).Run(signalCtx, v.GetDuration("gc.interval"))
 	beaterClient := beater.StartBeaterClient(v)
 	beaterClient.Run()
 	go func() {
@@ -144,16 +151,17 @@ func main() {
 			mtx.Lock()
 			ch, ok := flightsChs[id]
 			if !ok {
-				ch = make(chan (<-chan mid.Delivery), 1)
+				ch = make(chan mid.Client, 1)
 				flightsChs[id] = ch
 			}
 			mtx.Unlock()
-			ch <- flightsQueue.Ch
+			ch <- flightsQueue
 		}
 	}()
 	for coordsQueue := range coordsQueues {
-		go func(id string, ch <-chan mid.Delivery) {
-			ctx, cancel := context.WithCancel(signalCtx)
+		go func(coords mid.Client) {
+			id := coords.Id
+			ctx, cancel := coords.Context(signalCtx)
 			defer cancel()
 			workdir := filepath.Join(workdir, hex.EncodeToString([]byte(id)))
 			filter, err := common.NewFilter(middleware, workerId, id, sink, workdir)
@@ -162,30 +170,48 @@ func main() {
 			}
 			defer filter.Close()
 
-			if err := filter.AddCoords(ctx, ch); err != nil {
+			err = filter.AddCoords(ctx, coords)
+			if coords.Aborted() {
+				log.Infof("action: add_coords | result: aborted | client: %x", id)
+				return
+			} else if err != nil {
 				log.Fatal(err)
 			}
 			mtx.Lock()
 			flightsCh, ok := flightsChs[id]
 			if !ok {
-				flightsCh = make(chan (<-chan mid.Delivery))
+				flightsCh = make(chan mid.Client)
 				flightsChs[id] = flightsCh
 			}
 			mtx.Unlock()
+			var flights mid.Client
 			select {
 			case <-ctx.Done():
+				mtx.Lock()
+				delete(flightsChs, id)
+				mtx.Unlock()
 				return
-			case ch = <-flightsCh:
+			case flights = <-flightsCh:
 				mtx.Lock()
 				delete(flightsChs, id)
 				mtx.Unlock()
 			}
-			if err := filter.Run(ctx, ch); err != nil {
+			ctx, cancel = flights.Context(ctx)
+			defer cancel()
+			err = filter.Run(ctx, flights)
+			if flights.Aborted() {
+				log.Infof("action: run | result: aborted | client: %x", id)
+			} else if err != nil {
 				log.Fatal(err)
-			} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+			} else if err := middleware.EOF(ctx, sink, workerId, id, filter.Sent()); err != nil {
 				log.Fatal(err)
 			}
-		}(coordsQueue.Id, coordsQueue.Ch)
+		}(coordsQueue)
 	}
 	beater.StopBeaterClient(beaterClient)
+	deregisterCtx, cancelDeregister := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDeregister()
+	if err := mid.DeregisterIdle(deregisterCtx, middleware, workerId, workdir, coordsSource, flightsSource); err != nil {
+		log.Errorf("action: deregister | result: failure | error: %s", err)
+	}
 }
@@ -3,50 +3,112 @@ package common
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"slices"
 
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/duplicates"
 	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
 	log "github.com/sirupsen/logrus"
 )
 
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("fastest", 1)
+
 type Filter struct {
-	m        *mid.Middleware
+	m        mid.Broker
 	workerId string
 	clientId string
 	sink     string
 	workdir  string
+	sent     mid.MessageCounter
+	handoffs *mid.Handoffs
 	stateMan *state.StateManager
+	// the fastest flights of every route
+	fastest *state.SegmentStore
+	filter  *duplicates.DuplicateFilter
 }
 
-func NewFilter(m *mid.Middleware, workerId, clientId, sink, workdir string) (*Filter, error) {
-	err := os.MkdirAll(filepath.Join(workdir, "fastest"), 0755)
+// Name of the file in the workdir keeping the fastest flights.
+const FastestFile = "fastest.kv"
+
+// Key of the store holding the batches received, committed along with the
+// flights they updated. Routes never start with a NUL.
+const ReceivedKey = "\x00received"
+
+func NewFilter(m mid.Broker, workerId, clientId, sink, workdir string) (*Filter, error) {
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return nil, err
+	}
+	fastest, err := state.OpenSegmentStore(filepath.Join(workdir, FastestFile))
+	if err != nil {
+		return nil, err
+	}
+	handoffs, errHandoffs := mid.NewHandoffs(workerId)
 	return &Filter{
 		m,
 		workerId,
 		clientId,
 		sink,
 		workdir,
-		state.NewStateManager(workdir),
-	}, err
+		mid.NewMessageCounter(),
+		handoffs,
+		state.NewStateManager(workdir).WithSchema(Schema),
+		fastest,
+		duplicates.NewDuplicateFilter(),
+	}, errHandoffs
 }
 
-func RecoverFromState(m *mid.Middleware, workerId, clientId, sink, workdir string, stateMan *state.StateManager) *Filter {
-	f, _ := NewFilter(m, workerId, clientId, sink, workdir)
+func RecoverFromState(m mid.Broker, workerId, clientId, sink, workdir string, stateMan *state.StateManager) (*Filter, error) {
+	f, err := NewFilter(m, workerId, clientId, sink, workdir)
+	if f == nil {
+		return nil, err
+	}
+	if err == nil {
+		f.sent, err = mid.MessageCounterFromState(stateMan)
+	}
+	if err == nil {
+		f.handoffs, err = mid.HandoffsFromState(stateMan, workerId)
+	}
 	f.stateMan = stateMan
-	return f
+	return f, err
+}
+
+// Batches sent for the client, to be sent along with its EOF.
+func (f *Filter) Sent() mid.MessageCounter {
+	return f.sent
+}
+
+// Nodes this one handed off routes to, consumers of the results wait for
+// their EOF as well.
+func (f *Filter) Peers() []string {
+	return f.handoffs.Peers()
+}
+
+// Sends a HandoffEOF to the nodes waiting for this one, once done with the
+// client.
+func (f *Filter) HandoffEOF(ctx context.Context) error {
+	return f.handoffs.EOF(ctx, f.m, f.workerId, f.clientId, f.sent)
 }
 
+// Routes whose results were sent, stored once the results start being sent.
+var sentRoutes = state.NewValue[[]string]("sent")
+
 func (f *Filter) ShouldRestart() bool {
-	_, ok := f.stateMan.State["sent"]
-	return ok
+	return sentRoutes.Exists(f.stateMan)
 }
 
 func (f *Filter) Restart(ctx context.Context) error {
-	sent := f.stateMan.State["sent"].([]string)
+	sent, err := sentRoutes.Get(f.stateMan)
+	if err != nil {
+		return err
+	}
 	log.Info("action: re-start worker | result: re-sending results")
 	fastest, err := f.loadFastest()
 	if err != nil {
@@ -60,13 +122,13 @@ func (f *Filter) StoreState() error {
 }
 
 func (f *Filter) Close() error {
-	return state.RemoveWorkdir(f.workdir)
+	return errors.Join(f.fastest.Close(), state.RemoveWorkdir(f.workdir))
 }
 
 type FastestFlightsMap map[string][]typing.FastestFilter
 
 func updateFastest(fastest FastestFlightsMap, data typing.FastestFilter) string {
-	key := data.Origin + "." + data.Destination
+	key := mid.RouteKey(data.Origin, data.Destination)
 	if fast, ok := fastest[key]; !ok {
 		tmp := [2]typing.FastestFilter{data}
 		fastest[key] = tmp[:1]
@@ -83,17 +145,26 @@ func updateFastest(fastest FastestFlightsMap, data typing.FastestFilter) string
 
 func (f *Filter) loadFastest() (FastestFlightsMap, error) {
 	fastest := make(FastestFlightsMap)
-
-	files, err := os.ReadDir(filepath.Join(f.workdir, "fastest"))
-	if err != nil {
+	if err := f.importFastestFiles(); err != nil {
 		return nil, err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
+	if buf, err := f.fastest.Get(ReceivedKey); err == nil {
+		if err := f.filter.Unmarshal(bytes.NewReader(buf)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, route := range f.fastest.Keys() {
+		if route == ReceivedKey {
+			continue
+		}
+		// already handed off before a crash
+		if f.handoffs.Owner(route) != 0 {
+			f.fastest.Delete(route)
 			continue
 		}
-		buf, err := os.ReadFile(filepath.Join(f.workdir, "fastest", file.Name()))
+		buf, err := f.fastest.Get(route)
 		if err != nil {
 			return nil, err
 		}
@@ -106,30 +177,140 @@ func (f *Filter) loadFastest() (FastestFlightsMap, error) {
 			}
 			fast = append(fast, data)
 		}
-		fastest[file.Name()] = fast
+		fastest[route] = fast
 	}
 
-	return fastest, nil
+	return fastest, f.fastest.Commit()
 }
 
-func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
-	f.stateMan.State["sent"] = []string{}
-	if err := f.stateMan.Prepare(); err != nil {
+// Moves the fastest flights stored by previous versions, a file for each route
+// in the fastest directory, to the store. They're encoded again, as their
+// strings are preceded by their length in a single byte rather than a
+// uvarint.
+func (f *Filter) importFastestFiles() error {
+	dir := filepath.Join(f.workdir, "fastest")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		buf, err := state.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		for r := bytes.NewReader(buf); r.Len() > 0; {
+			data, err := unmarshalFastestFile(r)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			if err := data.Marshal(&b); err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+		}
+		f.fastest.Put(entry.Name(), b.Bytes())
+	}
+	if err := f.fastest.Commit(); err != nil {
 		return err
 	}
+	return os.RemoveAll(dir)
+}
+
+// Decodes a fastest flight as stored in the files of previous versions.
+func unmarshalFastestFile(r *bytes.Reader) (data typing.FastestFilter, err error) {
+	_, err = io.ReadFull(r, data.ID[:])
+	if err == nil {
+		data.Origin, err = readShortString(r)
+	}
+	if err == nil {
+		data.Destination, err = readShortString(r)
+	}
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &data.Duration)
+	}
+	if err == nil {
+		data.Stops, err = readShortString(r)
+	}
+	return data, err
+}
+
+// Reads a string preceded by its length in a single byte.
+func readShortString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (f *Filter) Run(ctx context.Context, client mid.Client) error {
 	fastest, err := f.loadFastest()
 	if err != nil {
 		return err
 	}
+	h, err := typing.RecoverHeader(f.stateMan, f.workerId)
+	if err != nil {
+		return err
+	}
+	dc := f.m.NewDeferredConfirmer(ctx)
 
-	for d := range ch {
+	client.Resume(f.filter)
+	for d := range client.Ch {
 		updated := make(map[string]bool)
-		msg, tag := d.Msg, d.Tag
-		for r := bytes.NewReader(msg); r.Len() > 0; {
-			data, err := typing.FastestFilterUnmarshal(r)
+		tag := d.Tag
+		err := d.Expect(mid.FastestPayload, mid.HandoffPayload)
+		if err == nil {
+			dup, err := f.filter.Update(d.Header)
+			if d.IsHandoff() {
+				// handled even if duplicated, it's idempotent
+				if err := f.receiveHandoff(ctx, dc, d, fastest, &h); err != nil {
+					return err
+				}
+				continue
+			}
 			if err != nil {
+				log.Errorf("action: dedup | result: failure | error: %s", err)
+				if err := f.m.Reject(ctx, d, err.Error()); err != nil {
+					return err
+				}
+				continue
+			} else if dup {
+				if err := f.m.Ack(tag); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		var batch []typing.FastestFilter
+		if err == nil {
+			batch, err = readBatch(bytes.NewReader(d.Msg))
+		}
+		if err != nil {
+			if err := f.m.Reject(ctx, d, err.Error()); err != nil {
 				return err
 			}
+			continue
+		}
+		batches := f.handoffs.NewBatches(f.m, dc, f.clientId, mid.FastestPayload, &h, f.sent)
+		for _, data := range batch {
+			if node := f.handoffs.Owner(mid.RouteKey(data.Origin, data.Destination)); node != 0 {
+				if err := batches.Add(ctx, node, data.Marshal); errors.Is(err, mid.ErrRecord) {
+					log.Errorf("action: handoff | client: %x | route: %s-%s | result: failure | error: %s | dropping the flight", f.clientId, data.Origin, data.Destination, err)
+				} else if err != nil {
+					return err
+				}
+				continue
+			}
 			if key := updateFastest(fastest, data); key != "" {
 				updated[key] = true
 			}
@@ -138,13 +319,23 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
 		for key := range updated {
 			var b bytes.Buffer
 			for _, v := range fastest[key] {
-				v.Marshal(&b)
-			}
-			if err := state.WriteFile(filepath.Join(f.workdir, "fastest", key), b.Bytes()); err != nil {
-				return err
+				if err := v.Marshal(&b); err != nil {
+					return err
+				}
 			}
+			f.fastest.Put(key, b.Bytes())
+		}
+		if err := f.putReceived(); err != nil {
+			return err
+		}
+		if f.handoffs.Rebalanced() {
+			err = f.commitHandoff(ctx, dc, batches, &h)
+		} else {
+			err = f.fastest.Commit()
+		}
+		if err != nil {
+			return err
 		}
-
 		if err := f.m.Ack(tag); err != nil {
 			return err
 		}
@@ -154,7 +345,8 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
 	case <-ctx.Done():
 		return context.Cause(ctx)
 	default:
-		if err := f.stateMan.Commit(); err != nil {
+		sentRoutes.Set(f.stateMan, []string{})
+		if err := f.stateMan.DumpState(); err != nil {
 			log.Error("action: commit | result: failure | reason:", err)
 		}
 	}
@@ -162,16 +354,105 @@ func (f *Filter) Run(ctx context.Context, ch <-chan mid.Delivery) error {
 	return f.SendResults(ctx, fastest, nil)
 }
 
-func (f *Filter) SendResults(ctx context.Context, fastest FastestFlightsMap, sent []string) error {
+// Updates the client's ring with the Handoff, handing off the fastest flights
+// of the routes this node no longer owns.
+func (f *Filter) receiveHandoff(ctx context.Context, c mid.DeferredConfirmer, d mid.Delivery, fastest FastestFlightsMap, h *typing.BatchHeader) error {
+	var handoff mid.Handoff
+	if err := handoff.Unmarshal(bytes.NewReader(d.Msg)); err != nil {
+		return f.m.Reject(ctx, d, err.Error())
+	}
+	batches := f.handoffs.NewBatches(f.m, c, f.clientId, mid.FastestPayload, h, f.sent)
+	var moved []string
+	if f.handoffs.Update(handoff) {
+		for route, fast := range fastest {
+			node := f.handoffs.Owner(route)
+			if node == 0 {
+				continue
+			}
+			for _, v := range fast {
+				if err := batches.Add(ctx, node, v.Marshal); errors.Is(err, mid.ErrRecord) {
+					log.Errorf("action: handoff | client: %x | route: %s | result: failure | error: %s | dropping the flight", f.clientId, route, err)
+				} else if err != nil {
+					return err
+				}
+			}
+			moved = append(moved, route)
+			f.fastest.Delete(route)
+		}
+	}
+	if err := f.putReceived(); err != nil {
+		return err
+	}
+	if err := f.commitHandoff(ctx, c, batches, h); err != nil {
+		return err
+	}
+	for _, route := range moved {
+		delete(fastest, route)
+	}
+	return f.m.Ack(d.Tag)
+}
 
+// Stages the batches received, committed along with the flights they
+// updated.
+func (f *Filter) putReceived() error {
+	var b bytes.Buffer
+	if err := f.filter.Marshal(&b); err != nil {
+		return err
+	}
+	f.fastest.Put(ReceivedKey, b.Bytes())
+	return nil
+}
+
+// Publishes the rest of the batches handed off, and commits the flights along
+// with the state, which counts the batches, once confirmed. A crash before
+// committing results in the same batches being published again, with the
+// same headers.
+func (f *Filter) commitHandoff(ctx context.Context, c mid.DeferredConfirmer, batches *mid.HandoffBatches, h *typing.BatchHeader) error {
+	if err := batches.Flush(ctx); err != nil {
+		return err
+	}
+	h.AddToState(f.stateMan.State)
+	f.handoffs.AddToState(f.stateMan)
+	f.sent.AddToState(f.stateMan)
+	tx, err := state.NewTx(f.workdir)
+	if err != nil {
+		return err
+	}
+	if err := tx.CommitStore(f.fastest); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if err := tx.WriteState(f.stateMan); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if err := c.Confirm(ctx); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// Decodes the whole batch before applying any of it, so that a malformed
+// batch can be rejected without leaving it half processed.
+func readBatch(r *bytes.Reader) ([]typing.FastestFilter, error) {
+	var batch []typing.FastestFilter
+	for r.Len() > 0 {
+		data, err := typing.FastestFilterUnmarshal(r)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, data)
+	}
+	return batch, nil
+}
+
+// Publishes the fastest flights of every route not in `sent', those of a route
+// always go in the same batch.
+func (f *Filter) SendResults(ctx context.Context, fastest FastestFlightsMap, sent []string) error {
 	log.Infof("start publishing results into %q queue", f.sink)
-	var bc mid.BasicConfirmer
-	i := mid.MaxMessageSize / typing.ResultQ3Size
-	b := bytes.NewBufferString(f.clientId)
 	h, err := typing.RecoverHeader(f.stateMan, f.workerId)
 	if err != nil {
 		return err
 	}
+	p := mid.NewBatchPublisher(f.m, f.clientId, mid.ResultsPayload, &h, f.sent, mid.To("", f.sink)).WithState(f.stateMan, nil)
 
 	keys := make([]string, 0, len(fastest))
 	for key := range fastest {
@@ -179,53 +460,31 @@ func (f *Filter) SendResults(ctx context.Context, fastest FastestFlightsMap, sen
 	}
 	slices.Sort(keys)
 	for _, key := range keys {
-		arr := fastest[key]
-		for _, s := range sent {
-			if key == s {
-				continue
-			}
+		if slices.Contains(sent, key) {
+			continue
 		}
-		sent = append(sent, key)
-		f.stateMan.State["sent"] = sent
-		for _, v := range arr {
-			f.marshalResult(b, &h, &v)
-			i--
-		}
-		if i <= 0 {
-			h.MessageId++
-			h.AddToState(f.stateMan.State)
-			if err := f.stateMan.Prepare(); err != nil {
-				return err
-			}
-			if err := bc.Publish(ctx, f.m, "", f.sink, b.Bytes()); err != nil {
-				return err
-			}
-			if err := f.stateMan.Commit(); err != nil {
-				return err
+		err := p.Add(ctx, func(b *bytes.Buffer) error {
+			for _, v := range fastest[key] {
+				if err := f.marshalResult(b, &v); err != nil {
+					return err
+				}
 			}
-			i = mid.MaxMessageSize / typing.ResultQ3Size
-			b = bytes.NewBufferString(f.clientId)
-		}
-	}
-	if i != mid.MaxMessageSize/typing.ResultQ3Size {
-		if err := f.stateMan.Prepare(); err != nil {
-			return err
-		}
-		if err := bc.Publish(ctx, f.m, "", f.sink, b.Bytes()); err != nil {
-			return err
-		}
-		if err := f.stateMan.Commit(); err != nil {
+			return nil
+		})
+		if err != nil {
 			return err
 		}
+		// stored along with the batch holding the route
+		sent = append(sent, key)
+		sentRoutes.Set(f.stateMan, sent)
+	}
+	if err := p.Flush(ctx); err != nil {
+		return err
 	}
 	log.Infof("finished publishing results into %q queue", f.sink)
 	return nil
 }
 
-func (f *Filter) marshalResult(b *bytes.Buffer, h *typing.BatchHeader, v *typing.FastestFilter) {
-	if b.Len() == len(f.clientId) {
-		h.Marshal(b)
-	}
-	typing.ResultQ3Marshal(b, v)
-
+func (f *Filter) marshalResult(b *bytes.Buffer, v *typing.FastestFilter) error {
+	return typing.ResultQ3Marshal(b, v)
 }
@@ -19,7 +19,7 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, string, error) {
 	eof, err := m.ExchangeDeclare(v.GetString("source.eof"))
 	if err != nil {
 		return "", "", err
@@ -33,21 +33,31 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 		return "", "", err
 	}
 
-	// Subscribe to EOF events.
-	if err := m.QueueBind(q, eof); err != nil {
+	// Handed off batches are published to an exchange named after the queue.
+	handoff, err := m.ExchangeDeclare(q)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := m.ExchangeDeclare(mid.RebalanceExchange); err != nil {
+		return "", "", err
+	}
+	// Subscribe to handoff and EOF events.
+	if err := m.QueueBind(q, eof, handoff); err != nil {
 		return "", "", err
 	}
-	m.SetExpectedEofCount(q, v.GetInt("demuxers"))
+	m.SetEofProducers(q, v.GetStringSlice("source.producers")...)
 
 	sink := v.GetString("sink.results")
 	if sink == "" {
 		return "", "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "sink.results")
 	}
 
-	status, err := m.QueueDeclare(v.GetString("status"))
-
 	log.Info("fastest filter worker up")
-	return q, sink, m.Ready(ctx, status, q)
+	if err := m.Ready(ctx, q); err != nil {
+		return "", "", err
+	}
+	node, _ := strconv.Atoi(v.GetString("id"))
+	return q, sink, mid.Join(ctx, m, v.GetString("source.queue"), node)
 }
 
 func main() {
@@ -62,7 +72,7 @@ func main() {
 		log.Fatal(fmt.Errorf("Could not parse FAST_ID env var as int: %w", err))
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -79,11 +89,19 @@ func main() {
 	}
 	workerId := source
 	workdir := fmt.Sprintf("/clients/%d", v.GetInt("id"))
-	recovered := state.RecoverStateFiles(workdir)
+	recovered := state.RecoverStateFiles(workdir, common.Schema)
 	toRestart := make(map[string]*common.Filter)
 	for _, rec := range recovered {
 		id, workdir, stateMan := rec.Id, rec.Workdir, rec.State
-		filter := common.RecoverFromState(middleware, workerId, id, sink, workdir, stateMan)
+		filter, err := common.RecoverFromState(middleware, workerId, id, sink, workdir, stateMan)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if mid.IsAborted(id) {
+			filter.Close()
+			continue
+		}
 		if filter.ShouldRestart() {
 			go func() {
 				ctx, cancel := context.WithCancel(signalCtx)
@@ -92,7 +110,9 @@ func main() {
 
 				if err := filter.Restart(signalCtx); err != nil {
 					log.Fatal(err)
-				} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+				} else if err := middleware.EOF(ctx, sink, workerId, id, filter.Sent(), filter.Peers()...); err != nil {
+					log.Fatal(err)
+				} else if err := filter.HandoffEOF(ctx); err != nil {
 					log.Fatal(err)
 				}
 			}()
@@ -104,37 +124,50 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), workdir).Run(signalCtx, v.GetDuration("gc.interval"))
 	beaterClient := beater.StartBeaterClient(v)
 	beaterClient.Run()
 	for queue := range queues {
 		if f, ok := toRestart[queue.Id]; ok {
-			go func(f *common.Filter, ch <-chan mid.Delivery) {
-				ctx, cancel := context.WithCancel(signalCtx)
+			go func(f *common.Filter, client mid.Client) {
+				ctx, cancel := client.Context(signalCtx)
 				defer cancel()
 				defer f.Close()
-				if err := f.Run(ctx, ch); err != nil {
+				err := f.Run(ctx, client)
+				if client.Aborted() {
+					log.Infof("action: run | result: aborted | client: %x", client.Id)
+				} else if err != nil {
 					logrus.Errorf("action: re-started | status: failed | reason: %s", err)
+				} else if err := middleware.EOF(ctx, sink, workerId, client.Id, f.Sent(), f.Peers()...); err != nil {
+					log.Fatal(err)
+				} else if err := f.HandoffEOF(ctx); err != nil {
+					log.Fatal(err)
 				}
-			}(f, queue.Ch)
+			}(f, queue)
 		} else {
-			go func(id string, ch <-chan mid.Delivery) {
-				ctx, cancel := context.WithCancel(signalCtx)
+			go func(client mid.Client) {
+				ctx, cancel := client.Context(signalCtx)
 				defer cancel()
 
-				workdir := filepath.Join("clients", hex.EncodeToString([]byte(id)))
-				filter, err := common.NewFilter(middleware, workerId, id, sink, workdir)
+				workdir := filepath.Join(workdir, hex.EncodeToString([]byte(client.Id)))
+				filter, err := common.NewFilter(middleware, workerId, client.Id, sink, workdir)
 				if err != nil {
 					log.Fatal(err)
 					return
 				}
 				defer filter.Close()
 
-				if err := filter.Run(ctx, ch); err != nil {
+				err = filter.Run(ctx, client)
+				if client.Aborted() {
+					log.Infof("action: run | result: aborted | client: %x", client.Id)
+				} else if err != nil {
+					log.Fatal(err)
+				} else if err := middleware.EOF(ctx, sink, workerId, client.Id, filter.Sent(), filter.Peers()...); err != nil {
 					log.Fatal(err)
-				} else if err := middleware.EOF(ctx, sink, workerId, id); err != nil {
+				} else if err := filter.HandoffEOF(ctx); err != nil {
 					log.Fatal(err)
 				}
-			}(queue.Id, queue.Ch)
+			}(queue)
 		}
 	}
 	beater.StopBeaterClient(beaterClient)
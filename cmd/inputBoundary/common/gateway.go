@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,7 +19,8 @@ import (
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
 )
 
-const workerId = "input"
+// Name the input boundary registers and sends its batches with.
+const WorkerId = "input"
 
 const (
 	_              = iota
@@ -26,35 +28,73 @@ const (
 	SentCoordsEof  // after coords EOF
 	SendFlights    // after reading file size
 	SendFlightsEof // after sending flights
+	SendRejects    // after flights EOF
 )
 
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("input", 2).
+	Register(1, migrateIndices)
+
+// Migrates the indices of the columns read from a file of flights stored
+// before typing.Flight had its last fields. These are not in the indices,
+// so they're sent empty for the rest of the file.
+func migrateIndices(s map[string]any) error {
+	indices, ok := s["indices"].([]any)
+	if !ok {
+		return nil
+	}
+	for len(indices) < len(typing.FlightFields) {
+		indices = append(indices, -1)
+	}
+	s["indices"] = indices
+	return nil
+}
+
 type Gateway struct {
-	m       *mid.Middleware
+	m       mid.Broker
 	id      string
 	coords  string
 	flights string
+	results string
 	workdir string
+	// whether the flights rejected are sent back, besides their count
+	keepRejected bool
+	// codes of the airports sent, nil if unknown
+	airports map[string]bool
 
+	sent     mid.MessageCounter
 	stateMan *state.StateManager
 }
 
-func NewGateway(m *mid.Middleware, id, coords, flights, workdir string, sm *state.StateManager) (*Gateway, error) {
+func NewGateway(m mid.Broker, id, coords, flights, results, workdir string, sm *state.StateManager) (*Gateway, error) {
 	err := os.MkdirAll(workdir, 0755)
+	sent, errSent := mid.MessageCounterFromState(sm)
 	return &Gateway{
-		m,
-		id,
-		coords,
-		flights,
-		workdir,
-		sm,
-	}, err
+		m:        m,
+		id:       id,
+		coords:   coords,
+		flights:  flights,
+		results:  results,
+		workdir:  workdir,
+		sent:     sent,
+		stateMan: sm,
+	}, errors.Join(err, errSent)
+}
+
+// Sends the flights rejected back to the client, along with the rejects
+// summary.
+func (g *Gateway) WithRejectedRows(keep bool) *Gateway {
+	g.keepRejected = keep
+	return g
 }
 
 func (g *Gateway) Close() error {
 	return state.RemoveWorkdir(g.workdir)
 }
 
-func (g *Gateway) Run(ctx context.Context, in io.Reader, demuxers int) error {
+// `demuxers' are the shards the client's flights are dealt to, unless it's
+// recovered along with its own.
+func (g *Gateway) Run(ctx context.Context, in io.Reader, demuxers []int) error {
 	var (
 		flightsReader protocol.ExactReader
 		lastOffset    int64
@@ -82,6 +122,8 @@ func (g *Gateway) Run(ctx context.Context, in io.Reader, demuxers int) error {
 		goto sendFlights
 	case SendFlightsEof:
 		goto sendFlightsEof
+	case SendRejects:
+		goto sendRejects
 	}
 
 	if err := g.SendCoords(ctx, r); err != nil {
@@ -101,7 +143,7 @@ sentCoordsEof:
 	g.stateMan.State["flights-size"] = flightsReader.N
 	g.stateMan.State["offset"] = -1
 	if err := g.stateMan.DumpState(); err != nil {
-		return fmt.Errorf("failed to dump state for sending flights", err)
+		return fmt.Errorf("failed to dump state for sending flights: %w", err)
 	}
 sendFlights:
 	if err := g.ForwardFlights(ctx, &flightsReader, demuxers, lastOffset); err != nil {
@@ -109,17 +151,25 @@ sendFlights:
 	}
 
 sendFlightsEof:
-	return g.m.EOF(ctx, g.flights, workerId, g.id)
+	if err := g.m.EOF(ctx, g.flights, WorkerId, g.id, g.sent); err != nil {
+		return err
+	}
+	g.stateMan.State["step"] = SendRejects
+	if err := g.stateMan.DumpState(); err != nil {
+		return fmt.Errorf("failed to dump state for sending rejects: %w", err)
+	}
+
+sendRejects:
+	if err := g.SendRejects(ctx); err != nil {
+		return err
+	}
+	return g.m.EOF(ctx, g.results, WorkerId, g.id, g.sent)
 }
 
 func (g *Gateway) SendCoords(ctx context.Context, r io.Reader) error {
 	if err := g.stateMan.DumpState(); err != nil {
 		return fmt.Errorf("failed to dump initial state: %w", err)
 	}
-	g.stateMan.State["step"] = SentCoords
-	if err := g.stateMan.Prepare(); err != nil {
-		return fmt.Errorf("failed to prepare state for sent coordinates: %w", err)
-	}
 	coordsReader, err := protocol.NewFileReader(r)
 	if err != nil {
 		return err
@@ -129,6 +179,16 @@ func (g *Gateway) SendCoords(ctx context.Context, r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if err := writeAirports(filepath.Join(g.workdir, AirportsFile), g.airports); err != nil {
+		return err
+	}
+	// Coordinates are sent again from the start if this is not committed,
+	// along with the same headers, so they are counted after sending them.
+	g.stateMan.State["step"] = SentCoords
+	g.sent.AddToState(g.stateMan)
+	if err := g.stateMan.Prepare(); err != nil {
+		return fmt.Errorf("failed to prepare state for sent coordinates: %w", err)
+	}
 	if err := g.stateMan.Commit(); err != nil {
 		return fmt.Errorf("failed to commit state for sent coordinates: %s", err)
 	}
@@ -141,32 +201,24 @@ func (g *Gateway) ForwardCoords(ctx context.Context, in io.Reader) (int, error)
 		return 0, err
 	}
 
-	var bc mid.BasicConfirmer
-	i := mid.MaxMessageSize / typing.AirportCoordsSize
-	b := bytes.NewBufferString(g.id)
+	// not stored, the coordinates are sent again from the start after a crash
+	h := typing.NewHeader(WorkerId, 0)
+	p := mid.NewBatchPublisher(g.m, g.id, mid.CoordsPayload, &h, g.sent, mid.To(g.coords, "coords"))
+	g.airports = make(map[string]bool)
 	for n := 0; ; n++ {
 		record, err := r.Read()
-		if err != nil {
-			if err == io.EOF {
-				if i != mid.MaxMessageSize/typing.AirportCoordsSize {
-					err = bc.Publish(ctx, g.m, g.coords, "coords", b.Bytes())
-				} else {
-					err = nil
-				}
-			}
+		if err == io.EOF {
+			return n, p.Flush(ctx)
+		} else if err != nil {
 			return n, err
 		}
-
-		if err := typing.AirportCoordsMarshal(b, record, indices); err != nil {
+		g.airports[typing.Column(record, indices, airportCode)] = true
+		err = p.Add(ctx, func(b *bytes.Buffer) error {
+			return typing.AirportCoordsMarshal(b, record, indices)
+		})
+		if err != nil {
 			return n, err
 		}
-		if i--; i <= 0 {
-			if err := bc.Publish(ctx, g.m, g.coords, "coords", b.Bytes()); err != nil {
-				return n, err
-			}
-			i = mid.MaxMessageSize / typing.AirportCoordsSize
-			b = bytes.NewBufferString(g.id)
-		}
 	}
 }
 
@@ -176,7 +228,7 @@ func (g *Gateway) SendCoordsEof(ctx context.Context) error {
 		return fmt.Errorf("failed to prepare state for sent coordinates EOF: %s", err)
 	}
 
-	if err := g.m.EOF(ctx, g.coords, workerId, g.id); err != nil {
+	if err := g.m.EOF(ctx, g.coords, WorkerId, g.id, g.sent); err != nil {
 		return err
 	}
 
@@ -186,7 +238,7 @@ func (g *Gateway) SendCoordsEof(ctx context.Context) error {
 	return nil
 }
 
-func (g *Gateway) ForwardFlights(ctx context.Context, in io.Reader, demuxers int, lastOffset int64) error {
+func (g *Gateway) ForwardFlights(ctx context.Context, in io.Reader, demuxers []int, lastOffset int64) error {
 	var r *csv.Reader
 	indices, err := g.stateMan.GetIntSlice("indices")
 	if err == nil {
@@ -198,10 +250,30 @@ func (g *Gateway) ForwardFlights(ctx context.Context, in io.Reader, demuxers int
 		return err
 	}
 	g.stateMan.State["indices"] = indices
-	rr, err := mid.RoundRobinFromState(g.stateMan, mid.KeyGenerator(demuxers))
+	rr, err := mid.RoundRobinFromShards(g.stateMan, demuxers)
 	if err != nil {
 		return err
 	}
+	if g.airports == nil {
+		if g.airports, err = readAirports(filepath.Join(g.workdir, AirportsFile)); err != nil {
+			return err
+		}
+	}
+	v := Validator{g.airports}
+	counts, err := rejectCounts.GetOr(g.stateMan, nil)
+	if err != nil {
+		return err
+	} else if counts == nil {
+		counts = make(map[string]int64)
+	}
+	rejectCounts.Set(g.stateMan, counts)
+	var rejected *state.SegmentStore
+	if g.keepRejected {
+		if rejected, err = g.openRejected(); err != nil {
+			return err
+		}
+		defer rejected.Close()
+	}
 	if err = g.Prepare(r, rr, lastOffset); err != nil {
 		return err
 	}
@@ -209,68 +281,90 @@ func (g *Gateway) ForwardFlights(ctx context.Context, in io.Reader, demuxers int
 		return err
 	}
 
-	var bc mid.BasicConfirmer
-	i := mid.MaxMessageSize / typing.FlightSize
-	b := bytes.NewBufferString(g.id)
-	h, err := typing.RecoverHeader(g.stateMan, workerId)
+	h, err := typing.RecoverHeader(g.stateMan, WorkerId)
 	if err != nil {
 		return err
 	}
-	h.Marshal(b)
-	for {
-		record, err := r.Read()
-		if err != nil {
-			if err == io.EOF {
-				rr.RemoveFromState(g.stateMan)
-				g.stateMan.Remove("indices")
-				g.stateMan.Remove("offset")
-				g.stateMan.Remove("flights-size")
-				g.stateMan.State["step"] = SendFlightsEof
-				if err := g.stateMan.Prepare(); err != nil {
-					return err
-				}
-				if i != mid.MaxMessageSize/typing.FlightSize {
-					err = bc.Publish(ctx, g.m, "", rr.NextKey(g.flights), b.Bytes())
-				} else {
-					err = nil
-				}
-				if err := g.stateMan.Commit(); err != nil {
-					return err
-				}
-			}
-			return err
+	// of the record being read, which is not part of the batch being
+	// published if it doesn't fit in it
+	var offset int64
+	route := func() (string, string) {
+		return "", rr.NextKey(g.flights)
+	}
+	// the flights rejected are committed to the store along with each
+	// batch, ahead of its state
+	var buf bytes.Buffer
+	commitRejected := func() error {
+		if rejected == nil {
+			return nil
 		}
-
-		switch err := typing.FlightMarshal(b, record, indices); err {
-		case nil:
-		case typing.ErrMissingDistance:
-			log.Warnf("action: ignore_error | id: %s | error: %s", record[0], err)
-		default:
-			log.Errorf("action: skip_flight | id: %s | error: %s", record[0], err)
-			continue
+		if err := rejected.Commit(); err != nil {
+			return err
 		}
-		if i--; i <= 0 {
-			h.MessageId++
-			h.AddToState(g.stateMan.State)
-			key := rr.NextKey(g.flights)
-			if err = g.Prepare(r, rr, lastOffset); err != nil {
+		size, _ := rejected.Size(rejectedKey)
+		rejectedSize.Set(g.stateMan, size)
+		return nil
+	}
+	p := mid.NewBatchPublisher(g.m, g.id, mid.FlightsPayload, &h, g.sent, route).WithState(g.stateMan, func() error {
+		rr.AddToState(g.stateMan)
+		g.stateMan.State["offset"] = offset + lastOffset
+		return commitRejected()
+	})
+	for {
+		offset = r.InputOffset()
+		record, err := r.Read()
+		if err == io.EOF {
+			if err := p.Flush(ctx); err != nil {
 				return err
 			}
-			if err := bc.Publish(ctx, g.m, "", key, b.Bytes()); err != nil {
+			rr.RemoveFromState(g.stateMan)
+			g.stateMan.Remove("indices")
+			g.stateMan.Remove("offset")
+			g.stateMan.Remove("flights-size")
+			if err := commitRejected(); err != nil {
 				return err
 			}
-			if err = g.stateMan.Commit(); err != nil {
+			g.stateMan.State["step"] = SendFlightsEof
+			return g.stateMan.DumpState()
+		} else if err != nil {
+			return err
+		}
+
+		data, reason := v.Validate(record, indices)
+		if reason == "" || reason == MissingDistance {
+			err = p.Add(ctx, func(b *bytes.Buffer) error {
+				return typing.FlightRecord.Marshal(b, &data)
+			})
+			if errors.Is(err, typing.ErrLength) {
+				reason = TooLong
+			} else if errors.Is(err, mid.ErrRecord) {
+				reason = Malformed
+			} else if err != nil {
 				return err
 			}
-			i = mid.MaxMessageSize / typing.FlightSize
-			b = bytes.NewBufferString(g.id)
-			h.Marshal(b)
 		}
+		if reason == "" {
+			continue
+		}
+		counts[reason]++
+		if reason == MissingDistance {
+			continue
+		}
+		log.Warnf("action: reject_flight | client: %x | id: %s | reason: %s", g.id, typing.Column(record, indices, flightId), reason)
+		if rejected == nil {
+			continue
+		}
+		buf.Reset()
+		if err := rejectedMarshal(&buf, reason, record, indices); err != nil {
+			return err
+		}
+		rejected.Append(rejectedKey, buf.Bytes())
 	}
 }
 
 func (g *Gateway) Prepare(r *csv.Reader, rr mid.RoundRobinKeysGenerator, lastOffset int64) error {
 	rr.AddToState(g.stateMan)
+	g.sent.AddToState(g.stateMan)
 	g.stateMan.State["offset"] = r.InputOffset() + lastOffset
 	return g.stateMan.Prepare()
 }
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+)
+
+// Reasons a flight of the file is rejected for, tallied and sent back to the
+// client along with the results.
+const (
+	InvalidLegId    = "invalid_leg_id"
+	InvalidDuration = "invalid_duration"
+	InvalidFare     = "invalid_fare"
+	NegativeFare    = "negative_fare"
+	UnknownAirport  = "unknown_airport"
+	TooLong         = "too_long"
+	Malformed       = "malformed"
+	// not rejected, the flight is sent with a distance of 0 and left out of
+	// the 2nd query
+	MissingDistance = "missing_distance"
+)
+
+// Reasons for the columns failing to parse, Malformed for the rest.
+var columnReasons = map[string]string{
+	"legId":          InvalidLegId,
+	"travelDuration": InvalidDuration,
+	"totalFare":      InvalidFare,
+}
+
+// Names of the files in the workdir keeping the codes of the airports sent,
+// and the flights rejected if they're sent back.
+const (
+	AirportsFile = "airports"
+	RejectsFile  = "rejects.kv"
+)
+
+// Key of the flights rejected in the RejectsFile, encoded as results.
+const rejectedKey = "rows"
+
+var (
+	// flights rejected by reason
+	rejectCounts = state.NewValue[map[string]int64]("rejects")
+	// of the flights rejected in the RejectsFile, as committed along with
+	// the state
+	rejectedSize = state.NewValue[int64]("rejects-size")
+	// records of the rejects already sent
+	rejectsSent = state.NewValue[int]("rejects-sent")
+)
+
+var (
+	airportCode    = typing.AirportCoordsRecord.Field("Code")
+	flightId       = typing.FlightRecord.Field("ID")
+	flightDistance = typing.FlightRecord.Field("Distance")
+)
+
+// Validator tells apart the flights to reject, checking their airports
+// against those of the coordinates if known.
+type Validator struct {
+	airports map[string]bool
+}
+
+// Parses the flight, returning the reason to reject it if any. Flights with
+// just a missing distance are returned along with MissingDistance.
+func (v Validator) Validate(record []string, indices []int) (typing.Flight, string) {
+	data, err := typing.FlightRecord.Parse(record, indices)
+	var fe *typing.FieldError
+	switch {
+	case errors.As(err, &fe):
+		if reason, ok := columnReasons[fe.Column]; ok {
+			return data, reason
+		}
+		return data, Malformed
+	case err != nil:
+		return data, Malformed
+	case data.Fare < 0:
+		return data, NegativeFare
+	case v.airports != nil && !(v.airports[data.Origin] && v.airports[data.Destination]):
+		return data, UnknownAirport
+	case typing.Column(record, indices, flightDistance) == "":
+		return data, MissingDistance
+	}
+	return data, ""
+}
+
+// Encodes the rejected flight as the reason followed by the columns read of
+// it, cut down to typing.MaxStringLen.
+func rejectedMarshal(b *bytes.Buffer, reason string, record []string, indices []int) error {
+	row := make([]string, 1, 1+len(indices))
+	row[0] = reason
+	for _, i := range indices {
+		var s string
+		if i >= 0 {
+			s = record[i]
+		}
+		if len(s) > typing.MaxStringLen {
+			s = s[:typing.MaxStringLen]
+		}
+		row = append(row, s)
+	}
+	return typing.ResultRejectedMarshal(b, row)
+}
+
+func writeAirports(filename string, airports map[string]bool) error {
+	codes := make([]string, 0, len(airports))
+	for code := range airports {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return state.WriteFile(filename, []byte(strings.Join(codes, "\n")))
+}
+
+// Returns nil if the file is missing, as for clients whose coordinates were
+// sent by a previous version.
+func readAirports(filename string) (map[string]bool, error) {
+	buf, err := state.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Warnf("missing %s, flights are not checked for unknown airports", filename)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	airports := make(map[string]bool)
+	for _, code := range strings.Split(string(buf), "\n") {
+		airports[code] = true
+	}
+	return airports, nil
+}
+
+// Opens the RejectsFile, dropping the flights rejected that weren't committed
+// along with the state.
+func (g *Gateway) openRejected() (*state.SegmentStore, error) {
+	rejected, err := state.OpenSegmentStore(filepath.Join(g.workdir, RejectsFile))
+	if err != nil {
+		return nil, err
+	}
+	size, err := rejectedSize.GetOr(g.stateMan, 0)
+	if err != nil {
+		return nil, errors.Join(err, rejected.Close())
+	}
+	if stored, _ := rejected.Size(rejectedKey); stored > size {
+		rejected.Truncate(rejectedKey, size)
+	}
+	return rejected, rejected.Commit()
+}
+
+// Sends the rejects summary, followed by the flights rejected if they were
+// kept, as results of the client. After a crash they're sent again from the
+// record of the last batch committed, along with the same headers.
+func (g *Gateway) SendRejects(ctx context.Context) error {
+	counts, err := rejectCounts.GetOr(g.stateMan, nil)
+	if err != nil {
+		return err
+	}
+	sent, err := rejectsSent.GetOr(g.stateMan, 0)
+	if err != nil {
+		return err
+	}
+	var rows []byte
+	if size, err := rejectedSize.GetOr(g.stateMan, 0); err != nil {
+		return err
+	} else if size > 0 {
+		rejected, err := g.openRejected()
+		if err != nil {
+			return err
+		}
+		rows, err = rejected.Get(rejectedKey)
+		if err := errors.Join(err, rejected.Close()); err != nil {
+			return err
+		}
+	}
+	h, err := typing.RecoverHeader(g.stateMan, WorkerId)
+	if err != nil {
+		return err
+	}
+
+	// of the record being added, which is not part of the batch being
+	// published if it doesn't fit in it
+	var next int
+	p := mid.NewBatchPublisher(g.m, g.id, mid.ResultsPayload, &h, g.sent, mid.To("", g.results)).WithState(g.stateMan, func() error {
+		rejectsSent.Set(g.stateMan, next)
+		return nil
+	})
+	add := func(marshal func(*bytes.Buffer) error) error {
+		defer func() { next++ }()
+		if next < sent {
+			return nil
+		}
+		return p.Add(ctx, marshal)
+	}
+
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		v := typing.RejectCount{Reason: reason, Count: uint64(counts[reason])}
+		log.Infof("action: rejects | client: %x | reason: %s | flights: %d", g.id, reason, v.Count)
+		err := add(func(b *bytes.Buffer) error {
+			return typing.ResultRejectsMarshal(b, &v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	r := bytes.NewReader(rows)
+	for r.Len() > 0 {
+		start := len(rows) - r.Len()
+		if _, err := r.ReadByte(); err != nil {
+			return err
+		}
+		if _, err := typing.ResultRejectedUnmarshal(r); err != nil {
+			return err
+		}
+		row := rows[start : len(rows)-r.Len()]
+		err := add(func(b *bytes.Buffer) error {
+			_, err := b.Write(row)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return p.Flush(ctx)
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
 	"path/filepath"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -19,29 +22,74 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, string, string, error) {
 	coords, err := m.ExchangeDeclare(v.GetString("sink.coords"))
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	flights, err := m.ExchangeDeclare(v.GetString("sink.flights"))
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-
-	status, err := m.QueueDeclare(v.GetString("status"))
-	if err != nil {
-		return "", "", err
+	results := v.GetString("sink.results")
+	if results == "" {
+		return "", "", "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "sink.results")
 	}
 
 	log.Info("input boundary up")
-	// wait for workers + 1*(outputBoundary)
-	if err := m.WaitReady(ctx, status, v.GetInt("workers")+1); err != nil {
-		return "", "", err
+	if err := m.Ready(ctx, common.WorkerId); err != nil {
+		return "", "", "", err
+	}
+	// wait for workers + 1*(outputBoundary) + 1*(inputBoundary), more may
+	// join later on
+	if err := m.WaitReady(ctx, v.GetInt("workers")+2); err != nil {
+		return "", "", "", err
 	}
 	log.Info("all workers are ready")
 
-	return coords, flights, nil
+	return coords, flights, results, nil
+}
+
+// Aborts the jobs of clients that disconnected, unless they reconnect in time
+// to resume them.
+type aborter struct {
+	m       mid.Broker
+	timeout time.Duration
+	mtx     sync.Mutex
+	timers  map[string]*time.Timer
+}
+
+func newAborter(m mid.Broker, timeout time.Duration) *aborter {
+	return &aborter{m: m, timeout: timeout, timers: make(map[string]*time.Timer)}
+}
+
+// Aborts the client's job once the timeout expires, closing its gateway.
+func (a *aborter) schedule(ctx context.Context, id string, gateway *common.Gateway) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	log.Infof("action: schedule_abort | client: %x | timeout: %s", id, a.timeout)
+	a.timers[id] = time.AfterFunc(a.timeout, func() {
+		a.mtx.Lock()
+		delete(a.timers, id)
+		a.mtx.Unlock()
+		if err := mid.Abort(ctx, a.m, id); err != nil {
+			log.Errorf("action: abort | result: failure | client: %x | error: %s", id, err)
+			return
+		}
+		gateway.Close()
+	})
+}
+
+// Cancels the client's abort, returns false if it's too late to do so.
+func (a *aborter) cancel(id string) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	t, ok := a.timers[id]
+	if !ok {
+		return true
+	}
+	delete(a.timers, id)
+	return t.Stop()
 }
 
 func main() {
@@ -53,7 +101,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -64,7 +112,7 @@ func main() {
 
 	signalCtx := utils.WithSignal(parentCtx)
 
-	coords, flights, err := setupMiddleware(signalCtx, middleware, v)
+	coords, flights, results, err := setupMiddleware(signalCtx, middleware, v)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -74,7 +122,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	demuxers := v.GetInt("demuxers")
+	membership, err := middleware.Membership()
+	if err != nil {
+		log.Fatal(err)
+	}
+	aborts := newAborter(middleware, v.GetDuration("abort_timeout"))
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), "clients").Run(signalCtx, v.GetDuration("gc.interval"))
 	beaterClient := beater.StartBeaterClient(v)
 	beaterClient.Run()
 	for conn := range clients {
@@ -88,8 +141,12 @@ func main() {
 				log.Error(err)
 				return
 			}
+			if !aborts.cancel(id) {
+				log.Errorf("action: reconnect | result: failure | client: %x | error: %s", id, mid.ErrAborted)
+				return
+			}
 			workdir := filepath.Join("clients", hex.EncodeToString([]byte(id)))
-			sm := state.NewStateManager(workdir)
+			sm := state.NewStateManager(workdir).WithSchema(common.Schema)
 			if reconnecting {
 				sm.RecoverState()
 				offset, err := sm.GetInt64("offset")
@@ -105,14 +162,21 @@ func main() {
 					return
 				}
 			}
-			gateway, err := common.NewGateway(middleware, id, coords, flights, workdir, sm)
+			gateway, err := common.NewGateway(middleware, id, coords, flights, results, workdir, sm)
 			if err != nil {
 				log.Fatal(err)
 			}
-			defer gateway.Close()
-			if err := gateway.Run(ctx, conn, demuxers); err != nil {
-				log.Fatal(err)
+			gateway.WithRejectedRows(v.GetBool("rejects.rows"))
+			if err := gateway.Run(ctx, conn, membership.Shards(flights)); err != nil {
+				if signalCtx.Err() != nil {
+					log.Fatal(err)
+				}
+				// the client may reconnect to resume its job
+				log.Errorf("action: receive_data | result: failure | client: %x | error: %s", id, err)
+				aborts.schedule(signalCtx, id, gateway)
+				return
 			}
+			defer gateway.Close()
 			connection.Done(conn)
 		}(conn)
 	}
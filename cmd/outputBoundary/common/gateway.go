@@ -29,22 +29,28 @@ var headers = [][]string{
 	typing.ResultQ2Header,
 	typing.ResultQ3Header,
 	typing.ResultQ4Header,
+	typing.ResultRejectsHeader,
+	typing.ResultRejectedHeader,
 }
 
+// Schema of the state kept for each client, see state.Schema.
+var Schema = state.NewSchema("output", 2).
+	Register(1, duplicates.MigrateLastReceived)
+
 type Gateway struct {
-	m        *mid.Middleware
+	m        mid.Broker
 	workdir  string
 	filter   *duplicates.DuplicateFilter
 	stateMan *state.StateManager
 }
 
-func NewGateway(m *mid.Middleware, workdir string) (*Gateway, error) {
+func NewGateway(m mid.Broker, workdir string) (*Gateway, error) {
 	err := os.MkdirAll(workdir, 0755)
 	return &Gateway{
 		m,
 		workdir,
 		duplicates.NewDuplicateFilter(),
-		state.NewStateManager(workdir),
+		state.NewStateManager(workdir).WithSchema(Schema),
 	}, err
 }
 
@@ -52,13 +58,14 @@ func (g *Gateway) Close() error {
 	return state.RemoveWorkdir(g.workdir)
 }
 
-func (g *Gateway) Run(ctx context.Context, out io.Writer, ch <-chan mid.Delivery, progress int) (err error) {
+func (g *Gateway) Run(ctx context.Context, out io.Writer, client mid.Client, progress int) (err error) {
 	if progress > 0 {
 		g.stateMan.RecoverState()
 		if err := g.filter.RecoverFromState(g.stateMan); err != nil {
 			return err
 		}
 	}
+	client.Resume(g.filter)
 	w := csv.NewWriter(out)
 	records := make([][]string, 0, 64)
 	recordsWritten, err := g.stateMan.GetInt("records")
@@ -73,7 +80,7 @@ func (g *Gateway) Run(ctx context.Context, out io.Writer, ch <-chan mid.Delivery
 		goto writingEof
 	}
 
-	recordsWritten = 4
+	recordsWritten = len(headers)
 	g.stateMan.State["records"] = recordsWritten
 	g.stateMan.State["step"] = WritingResults
 	if err := g.stateMan.Prepare(); err != nil {
@@ -89,23 +96,30 @@ func (g *Gateway) Run(ctx context.Context, out io.Writer, ch <-chan mid.Delivery
 	progress = recordsWritten
 writingResults:
 	progress -= recordsWritten
-	for d := range ch {
-		msg, tag := d.Msg, d.Tag
-		r := bytes.NewReader(msg)
-		dup, err := g.filter.Update(r)
-		if err != nil {
-			log.Errorf("action: recovering batch | status: failed | reason: %s", err)
+	for d := range client.Ch {
+		tag := d.Tag
+		if err := d.Expect(mid.ResultsPayload); err != nil {
+			if err := g.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
 		}
-		if dup || err != nil {
+		if dup, err := g.filter.Update(d.Header); err != nil {
+			log.Errorf("action: dedup | result: failure | error: %s", err)
+			if err := g.m.Reject(ctx, d, err.Error()); err != nil {
+				return err
+			}
+			continue
+		} else if dup {
 			g.m.Ack(tag)
 			continue
 		}
-		for r.Len() > 0 {
-			result, err := typing.ResultUnmarshal(r)
-			if err != nil {
+		if records, err = readResults(bytes.NewReader(d.Msg), records); err != nil {
+			records = records[:0]
+			if err := g.m.Reject(ctx, d, err.Error()); err != nil {
 				return err
 			}
-			records = append(records, result)
+			continue
 		}
 		recordsWritten += len(records)
 		g.stateMan.State["records"] = recordsWritten
@@ -125,12 +139,15 @@ writingResults:
 		records = records[:0]
 		progress = 0
 	}
+	if client.Aborted() {
+		return mid.ErrAborted
+	}
 
 	g.stateMan.Remove("records")
 	g.filter.RemoveFromState(g.stateMan)
 	g.stateMan.State["step"] = WritingEof
 	if err := g.stateMan.DumpState(); err != nil {
-		log.Warnf("failed to dump state for writing EOF: %w", err)
+		log.Warnf("failed to dump state for writing EOF: %s", err)
 	}
 
 writingEof:
@@ -140,3 +157,15 @@ writingEof:
 	w.Flush()
 	return w.Error()
 }
+
+// Appends every result in the batch to `records'.
+func readResults(r *bytes.Reader, records [][]string) ([][]string, error) {
+	for r.Len() > 0 {
+		result, err := typing.ResultUnmarshal(r)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, result)
+	}
+	return records, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"path/filepath"
@@ -19,7 +20,7 @@ import (
 )
 
 // Describes the topology around this node.
-func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (string, error) {
+func setupMiddleware(ctx context.Context, m mid.Broker, v *viper.Viper) (string, error) {
 	source := v.GetString("source.queue")
 	if source == "" {
 		return "", fmt.Errorf("%w: %q", utils.ErrMissingConfig, "source.queue")
@@ -40,12 +41,10 @@ func setupMiddleware(ctx context.Context, m *mid.Middleware, v *viper.Viper) (st
 	if err := m.QueueBind(source, source, eof); err != nil {
 		return "", err
 	}
-	m.SetExpectedEofCount(source, v.GetInt("workers"))
-
-	status, err := m.QueueDeclare(v.GetString("status"))
+	m.SetEofProducers(source, v.GetStringSlice("source.producers")...)
 
 	log.Info("output boundary up")
-	return source, m.Ready(ctx, status, source)
+	return source, m.Ready(ctx, source)
 }
 
 func main() {
@@ -57,7 +56,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	middleware, err := mid.Dial(v.GetString("server.url"))
+	middleware, err := mid.Dial(v.GetString("server.url"), v.GetString("server.compression"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -83,7 +82,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	resultsChs := make(map[string]chan (<-chan mid.Delivery))
+	resultsChs := make(map[string]chan mid.Client)
 	var mtx sync.Mutex
 
 	go func() {
@@ -92,13 +91,14 @@ func main() {
 			mtx.Lock()
 			ch, ok := resultsChs[id]
 			if !ok {
-				ch = make(chan (<-chan mid.Delivery), 1)
+				ch = make(chan mid.Client, 1)
 				resultsChs[id] = ch
 			}
 			mtx.Unlock()
-			ch <- queue.Ch
+			ch <- queue
 		}
 	}()
+	go mid.NewGC(middleware, v.GetDuration("gc.ttl"), "clients").Run(signalCtx, v.GetDuration("gc.interval"))
 	beaterClient := beater.StartBeaterClient(v)
 	beaterClient.Run()
 	for conn := range clients {
@@ -121,20 +121,24 @@ func main() {
 			mtx.Lock()
 			resultsCh, ok := resultsChs[id]
 			if !ok {
-				resultsCh = make(chan (<-chan mid.Delivery))
+				resultsCh = make(chan mid.Client)
 				resultsChs[id] = resultsCh
 			}
 			mtx.Unlock()
-			var ch <-chan mid.Delivery
+			var client mid.Client
 			select {
 			case <-ctx.Done():
 				return
-			case ch = <-resultsCh:
+			case client = <-resultsCh:
 				mtx.Lock()
 				delete(resultsChs, id)
 				mtx.Unlock()
 			}
-			if err := gateway.Run(ctx, conn, ch, progress); err != nil {
+			ctx, cancel = client.Context(ctx)
+			defer cancel()
+			if err := gateway.Run(ctx, conn, client, progress); errors.Is(err, mid.ErrAborted) {
+				log.Infof("action: send_results | result: aborted | client: %x", id)
+			} else if err != nil {
 				log.Error(err)
 			}
 		}(conn)
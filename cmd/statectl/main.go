@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/utils"
+)
+
+const usage = `usage:
+	statectl list <workdir>
+	statectl show <workdir> <client>
+	statectl check <workdir> [client]
+	statectl [-apply] repair <workdir> [client]
+
+<workdir> is the directory a worker keeps its clients' state in, like
+/clients/1 or clients. <client> is the hex encoded client id, all clients are
+considered if omitted. Repairs are only printed unless -apply is given.`
+
+var (
+	ErrUsage    = errors.New("invalid arguments")
+	ErrProblems = errors.New("invariants violated")
+)
+
+// Size of every fare stored by the average filter.
+const fareSize = 4
+
+// Violated invariant, along with the way to fix it if there's one.
+type problem struct {
+	clientDir string
+	msg       string
+	fix       string
+	repair    func() error
+}
+
+func (p problem) String() string {
+	return fmt.Sprintf("%s: %s", filepath.Base(p.clientDir), p.msg)
+}
+
+// Every client directory in the workdir, or the given client's one.
+func clientDirs(workdir string, args []string) ([]string, error) {
+	if len(args) > 0 {
+		if _, err := hex.DecodeString(args[0]); err != nil {
+			return nil, fmt.Errorf("%w: client id %q", ErrUsage, args[0])
+		}
+		dir := filepath.Join(workdir, args[0])
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		return []string{dir}, nil
+	}
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if _, err := hex.DecodeString(entry.Name()); err == nil && entry.IsDir() {
+			dirs = append(dirs, filepath.Join(workdir, entry.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+func backend(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, state.LogFileName)); err == nil {
+		return "log"
+	}
+	return "json"
+}
+
+func list(workdir string, args []string) error {
+	dirs, err := clientDirs(workdir, nil)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		sm, err := state.Inspect(dir)
+		if err != nil {
+			fmt.Printf("%s\terror: %s\n", filepath.Base(dir), err)
+			continue
+		}
+		schema, _ := state.Get[string](sm, state.SchemaKey)
+		version, _ := state.Get[int](sm, state.SchemaVersionKey)
+		info, _ := os.Stat(dir)
+		fmt.Printf("%s\tschema: %s/%d\tbackend: %s\tkeys: %d\tmodified: %s\n", filepath.Base(dir), schema, version, backend(dir), len(sm.State), info.ModTime().Format("2006-01-02 15:04:05"))
+	}
+	quarantined, _ := clientDirs(filepath.Join(workdir, state.QuarantineDir), nil)
+	for _, dir := range quarantined {
+		fmt.Printf("%s\tquarantined\n", filepath.Base(dir))
+	}
+	return nil
+}
+
+func show(workdir string, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	dirs, err := clientDirs(workdir, args)
+	if err != nil {
+		return err
+	}
+	dir := dirs[0]
+	sm, err := state.Inspect(dir)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(sm.State, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backend: %s\n%s\n", backend(dir), buf)
+
+	if err := showFares(dir, sm); err != nil {
+		return err
+	}
+	return showFastest(dir)
+}
+
+// Files the average and fastest filters keep their stores in.
+const (
+	faresFile   = "fares.kv"
+	fastestFile = "fastest.kv"
+)
+
+// Key of the fastest store holding the batches received rather than a route.
+const receivedKey = "\x00received"
+
+// Opens the store in the client directory as it is, nil if there's none.
+func inspectStore(dir, name string) (*state.SegmentStore, error) {
+	filename := filepath.Join(dir, name)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return state.InspectSegmentStore(filename)
+}
+
+// Applies the change to the store and commits it.
+func repairStore(filename string, change func(state.Store)) error {
+	s, err := state.OpenSegmentStore(filename)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	change(s)
+	return s.Commit()
+}
+
+func readFares(s state.Store, route string) ([]float32, error) {
+	buf, err := s.Get(route)
+	if err != nil {
+		return nil, err
+	}
+	fares := make([]float32, len(buf)/fareSize)
+	for i := range fares {
+		fares[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*fareSize:]))
+	}
+	return fares, nil
+}
+
+func showFares(dir string, sm *state.StateManager) error {
+	s, err := inspectStore(dir, faresFile)
+	if s == nil {
+		return err
+	}
+	defer s.Close()
+	committed, _ := sm.GetMapStringInt64("fares")
+	fmt.Println("fares:")
+	for _, route := range s.Keys() {
+		fares, err := readFares(s, route)
+		if err != nil {
+			fmt.Printf("  %s\terror: %s\n", route, err)
+			continue
+		}
+		n := min(int64(len(fares)), committed[route])
+		var sum float64
+		for _, fare := range fares[:n] {
+			sum += float64(fare)
+		}
+		avg := 0.0
+		if n > 0 {
+			avg = sum / float64(n)
+		}
+		fmt.Printf("  %s\tcommitted: %d\tstored: %d\tsum: %.2f\tavg: %.2f\n", route, committed[route], len(fares), sum, avg)
+	}
+	return nil
+}
+
+func readFastest(s state.Store, route string) ([]typing.FastestFilter, error) {
+	buf, err := s.Get(route)
+	if err != nil {
+		return nil, err
+	}
+	var ret []typing.FastestFilter
+	for r := bytes.NewReader(buf); r.Len() > 0; {
+		data, err := typing.FastestFilterUnmarshal(r)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, data)
+	}
+	return ret, nil
+}
+
+func showFastest(dir string) error {
+	s, err := inspectStore(dir, fastestFile)
+	if s == nil {
+		return err
+	}
+	defer s.Close()
+	fmt.Println("fastest:")
+	for _, route := range s.Keys() {
+		if route == receivedKey {
+			continue
+		}
+		fastest, err := readFastest(s, route)
+		if err != nil {
+			fmt.Printf("  %s\terror: %s\n", route, err)
+			continue
+		}
+		for _, f := range fastest {
+			fmt.Printf("  %s\tid: %x\tduration: %d\tstops: %s\n", route, f.ID, f.Duration, f.Stops)
+		}
+	}
+	return nil
+}
+
+// Checks the invariants of every file kept for the client.
+func checkClient(dir string) []problem {
+	sm, err := state.Inspect(dir)
+	if err != nil {
+		return []problem{{clientDir: dir, msg: fmt.Sprintf("unrecoverable state: %s", err)}}
+	}
+	var problems []problem
+	problems = append(problems, checkTx(dir)...)
+	problems = append(problems, checkFares(dir, sm)...)
+	problems = append(problems, checkFastest(dir)...)
+	problems = append(problems, checkCoordinates(dir)...)
+	return problems
+}
+
+// A transaction left by a crash is finished by the worker when recovering,
+// the state shown is the one before it meanwhile.
+func checkTx(dir string) []problem {
+	pending, committed, err := state.PendingTx(dir)
+	recoverTx := func() error {
+		_, err := state.RecoverTx(dir)
+		return err
+	}
+	switch {
+	case err != nil:
+		return []problem{{clientDir: dir, msg: fmt.Sprintf("%s: %s", state.TxDir, err)}}
+	case !pending:
+		return nil
+	case committed:
+		return []problem{{
+			clientDir: dir,
+			msg:       fmt.Sprintf("%s: committed, not applied", state.TxDir),
+			fix:       fmt.Sprintf("apply the transaction in %s", filepath.Join(dir, state.TxDir)),
+			repair:    recoverTx,
+		}}
+	default:
+		return []problem{{
+			clientDir: dir,
+			msg:       fmt.Sprintf("%s: not committed", state.TxDir),
+			fix:       fmt.Sprintf("roll back the transaction in %s", filepath.Join(dir, state.TxDir)),
+			repair:    recoverTx,
+		}}
+	}
+}
+
+// The fares of every route hold at least as many as committed to the state,
+// the rest were stored after the last commit and are to be truncated.
+func checkFares(dir string, sm *state.StateManager) []problem {
+	s, err := inspectStore(dir, faresFile)
+	if s == nil {
+		if err != nil {
+			return []problem{{clientDir: dir, msg: err.Error()}}
+		}
+		return nil
+	}
+	defer s.Close()
+	committed, err := sm.GetMapStringInt64("fares")
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		return []problem{{clientDir: dir, msg: err.Error()}}
+	}
+
+	var problems []problem
+	filename := filepath.Join(dir, faresFile)
+	for _, route := range s.Keys() {
+		route := route
+		stored, _ := s.Size(route)
+		n, ok := committed[route]
+		size := n * fareSize
+		switch {
+		case !ok:
+			problems = append(problems, problem{
+				clientDir: dir,
+				msg:       fmt.Sprintf("fares/%s: not in state", route),
+				fix:       fmt.Sprintf("delete %s from %s", route, filename),
+				repair:    func() error { return repairStore(filename, func(s state.Store) { s.Delete(route) }) },
+			})
+		case stored < size:
+			problems = append(problems, problem{
+				clientDir: dir,
+				msg:       fmt.Sprintf("fares/%s: %d bytes, %d fares committed (%d bytes)", route, stored, n, size),
+			})
+		case stored > size:
+			problems = append(problems, problem{
+				clientDir: dir,
+				msg:       fmt.Sprintf("fares/%s: %d bytes, %d fares committed (%d bytes)", route, stored, n, size),
+				fix:       fmt.Sprintf("truncate %s in %s to %d bytes", route, filename, size),
+				repair:    func() error { return repairStore(filename, func(s state.Store) { s.Truncate(route, size) }) },
+			})
+		}
+	}
+	for route := range committed {
+		if _, ok := s.Size(route); !ok {
+			problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("fares/%s: missing", route)})
+		}
+	}
+	return problems
+}
+
+// The fastest flights of every route decode into the (at most) two fastest
+// flights of the route.
+func checkFastest(dir string) []problem {
+	s, err := inspectStore(dir, fastestFile)
+	if s == nil {
+		if err != nil {
+			return []problem{{clientDir: dir, msg: err.Error()}}
+		}
+		return nil
+	}
+	defer s.Close()
+	var problems []problem
+	for _, route := range s.Keys() {
+		if route == receivedKey {
+			continue
+		}
+		fastest, err := readFastest(s, route)
+		if err != nil {
+			problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("fastest/%s: %s", route, err)})
+			continue
+		}
+		if len(fastest) == 0 || len(fastest) > 2 {
+			problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("fastest/%s: %d flights", route, len(fastest))})
+		}
+		for _, f := range fastest {
+			if key := mid.RouteKey(f.Origin, f.Destination); key != route {
+				problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("fastest/%s: flight %x of route %s", route, f.ID, key)})
+			}
+		}
+		if !slices.IsSortedFunc(fastest, func(a, b typing.FastestFilter) int { return int(a.Duration) - int(b.Duration) }) {
+			problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("fastest/%s: flights out of order", route)})
+		}
+	}
+	return problems
+}
+
+func checkCoordinates(dir string) []problem {
+	entries, err := os.ReadDir(filepath.Join(dir, "coordinates"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return []problem{{clientDir: dir, msg: err.Error()}}
+	}
+	var problems []problem
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, err := state.ReadFile(filepath.Join(dir, "coordinates", entry.Name())); err != nil {
+			problems = append(problems, problem{clientDir: dir, msg: fmt.Sprintf("coordinates/%s: %s", entry.Name(), err)})
+		}
+	}
+	return problems
+}
+
+func check(workdir string, args []string) ([]problem, error) {
+	dirs, err := clientDirs(workdir, args)
+	if err != nil {
+		return nil, err
+	}
+	var problems []problem
+	for _, dir := range dirs {
+		problems = append(problems, checkClient(dir)...)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	return problems, nil
+}
+
+func repair(workdir string, args []string, apply bool) error {
+	problems, err := check(workdir, args)
+	if err != nil {
+		return err
+	}
+	var unfixed []string
+	for _, p := range problems {
+		switch {
+		case p.repair == nil:
+			unfixed = append(unfixed, p.String())
+		case !apply:
+			fmt.Printf("would %s\n", p.fix)
+		default:
+			if err := p.repair(); err != nil {
+				return fmt.Errorf("%s: %w", p.fix, err)
+			}
+			fmt.Printf("did %s\n", p.fix)
+		}
+	}
+	if len(unfixed) > 0 {
+		return fmt.Errorf("%w: %d can't be repaired:\n%s", ErrProblems, len(unfixed), strings.Join(unfixed, "\n"))
+	}
+	return nil
+}
+
+func main() {
+	apply := flag.Bool("apply", false, "apply the repairs instead of printing them")
+	flag.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	flag.Parse()
+	if err := utils.InitLogger("warn"); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	cmd, workdir, args := flag.Arg(0), flag.Arg(1), flag.Args()[2:]
+	switch cmd {
+	case "list":
+		err = list(workdir, args)
+	case "show":
+		err = show(workdir, args)
+	case "check":
+		var problems []problem
+		if problems, err = check(workdir, args); err == nil && len(problems) > 0 {
+			err = fmt.Errorf("%w: %d found", ErrProblems, len(problems))
+		}
+	case "repair":
+		err = repair(workdir, args, *apply)
+	default:
+		err = fmt.Errorf("%w: unknown command %q", ErrUsage, cmd)
+	}
+	if errors.Is(err, ErrUsage) {
+		flag.Usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
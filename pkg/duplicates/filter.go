@@ -2,50 +2,256 @@ package duplicates
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
 	log "github.com/sirupsen/logrus"
 )
 
+// Number of the latest ids received from every worker that are told apart.
+// It's counted in batches received, not in ids: ids count the batches a
+// worker publishes to every queue, so the ones it publishes to a queue are
+// not consecutive. A batch is redelivered behind at most the prefetch of its
+// consumer, along with the batches its worker publishes before republishing
+// a lost one, so it falls within the Window unless it's older: see
+// ErrOutOfWindow.
+const Window = 256
+
+// Returned for batches older than the Window, which can't be told apart from
+// redeliveries. They're meant to be dead-lettered rather than dropped.
+var ErrOutOfWindow = errors.New("batch older than the duplicates window")
+
+const (
+	stateKey = "last-received"
+	countKey = "received"
+)
+
+// Ids received from a worker, the latest Window of them in ascending order,
+// along with the amount of distinct ids recorded.
+type window struct {
+	ids   []int64
+	count int64
+}
+
+// Records the id unless it's older than every id in a full window, returns
+// whether it was recorded before.
+func (w *window) update(id int64) (bool, error) {
+	i := sort.Search(len(w.ids), func(i int) bool { return w.ids[i] >= id })
+	if i < len(w.ids) && w.ids[i] == id {
+		return true, nil
+	}
+	if i == 0 && len(w.ids) == Window {
+		return false, ErrOutOfWindow
+	}
+	w.ids = slices.Insert(w.ids, i, id)
+	if len(w.ids) > Window {
+		w.ids = append(w.ids[:0], w.ids[1:]...)
+	}
+	w.count++
+	return false, nil
+}
+
+func (w *window) high() int64 {
+	return w.ids[len(w.ids)-1]
+}
+
 type DuplicateFilter struct {
-	lastMessages map[string]int64
+	windows map[string]*window
 }
 
 func NewDuplicateFilter() *DuplicateFilter {
 
 	return &DuplicateFilter{
-		lastMessages: make(map[string]int64),
+		windows: make(map[string]*window),
 	}
 }
 
+// A copy of the filter, to keep recording batches apart from it.
+func (df DuplicateFilter) Clone() *DuplicateFilter {
+	clone := NewDuplicateFilter()
+	for workerId, w := range df.windows {
+		clone.windows[workerId] = &window{slices.Clone(w.ids), w.count}
+	}
+	return clone
+}
+
+// Amount of distinct batches recorded from the worker.
+func (df DuplicateFilter) Received(workerId string) int64 {
+	if w, ok := df.windows[workerId]; ok {
+		return w.count
+	}
+	return 0
+}
+
 func (df DuplicateFilter) RemoveFromState(stateMan *state.StateManager) {
-	stateMan.Remove("last-received")
+	stateMan.Remove(stateKey)
+	stateMan.Remove(countKey)
 }
 
+// Stores the window of every worker as its highest id followed by how far
+// behind it each of the rest is, from the latest, and the amount of batches
+// recorded from each of them apart.
 func (df DuplicateFilter) AddToState(stateMan *state.StateManager) {
-	stateMan.State["last-received"] = df.lastMessages
+	m := make(map[string][]uint64, len(df.windows))
+	counts := make(map[string]int64, len(df.windows))
+	for workerId, w := range df.windows {
+		high := w.high()
+		v := make([]uint64, 0, len(w.ids))
+		v = append(v, uint64(high))
+		for i := len(w.ids) - 2; i >= 0; i-- {
+			v = append(v, uint64(high-w.ids[i]))
+		}
+		m[workerId] = v
+		counts[workerId] = w.count
+	}
+	stateMan.State[stateKey] = m
+	stateMan.State[countKey] = counts
 }
 
 func (df *DuplicateFilter) RecoverFromState(stateMan *state.StateManager) error {
-	m, err := stateMan.GetMapStringInt64("last-received")
+	m, err := state.Get[map[string][]uint64](stateMan, stateKey)
 	if err != nil && errors.Is(err, state.ErrNotFound) {
 		log.Infof("No state to recover duplicate filter from")
 		return nil
+	} else if err != nil {
+		return err
+	}
+	for workerId, v := range m {
+		if len(v) == 0 || len(v) > Window {
+			return fmt.Errorf("%w: state[%s.%s]=%v", state.ErrSchema, stateKey, workerId, v)
+		}
+		high := int64(v[0])
+		w := &window{ids: make([]int64, len(v))}
+		w.ids[len(v)-1] = high
+		for i := 1; i < len(v); i++ {
+			if v[i] == 0 || (i > 1 && v[i] <= v[i-1]) {
+				return fmt.Errorf("%w: state[%s.%s]=%v", state.ErrSchema, stateKey, workerId, v)
+			}
+			w.ids[len(v)-1-i] = high - int64(v[i])
+		}
+		df.windows[workerId] = w
+	}
+	counts, err := stateMan.GetMapStringInt64(countKey)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		return err
 	}
-	log.Infof("recovered duplicate filter: %v", m)
-	df.lastMessages = m
-	return err
+	for workerId, count := range counts {
+		if w, ok := df.windows[workerId]; ok {
+			w.count = count
+		}
+	}
+	latest := make(map[string]int64, len(df.windows))
+	for workerId, w := range df.windows {
+		latest[workerId] = w.high()
+	}
+	log.Infof("recovered duplicate filter: %v", latest)
+	return nil
 }
 
-func (df *DuplicateFilter) Update(r *bytes.Reader) (dup bool, err error) {
-	var h typing.BatchHeader
-	if err = h.Unmarshal(r); err == nil {
-		if lastId, ok := df.lastMessages[h.WorkerId]; ok {
-			dup = lastId == h.MessageId
+// Encodes the window of every worker, for filters storing it along with data
+// not kept in their state:
+//
+//	count | (worker id | ids | highest id | ids - 1 * behind | batches recorded) ...
+//
+// where the amount of ids is an uint16, and how far behind the highest id the
+// rest are an uvarint each, from the latest.
+func (df DuplicateFilter) Marshal(b *bytes.Buffer) error {
+	workerIds := make([]string, 0, len(df.windows))
+	for workerId := range df.windows {
+		workerIds = append(workerIds, workerId)
+	}
+	sort.Strings(workerIds)
+	binary.Write(b, binary.LittleEndian, uint32(len(workerIds)))
+	var buf [binary.MaxVarintLen64]byte
+	for _, workerId := range workerIds {
+		if err := typing.WriteString(b, workerId); err != nil {
+			return err
+		}
+		w := df.windows[workerId]
+		high := w.high()
+		binary.Write(b, binary.LittleEndian, uint16(len(w.ids)))
+		binary.Write(b, binary.LittleEndian, high)
+		for i := len(w.ids) - 2; i >= 0; i-- {
+			b.Write(buf[:binary.PutUvarint(buf[:], uint64(high-w.ids[i]))])
+		}
+		binary.Write(b, binary.LittleEndian, w.count)
+	}
+	return nil
+}
+
+func (df *DuplicateFilter) Unmarshal(r *bytes.Reader) error {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		workerId, err := typing.ReadString(r)
+		if err != nil {
+			return err
+		}
+		var ids uint16
+		if err := binary.Read(r, binary.LittleEndian, &ids); err != nil {
+			return err
+		}
+		if ids == 0 || ids > Window {
+			return fmt.Errorf("%w: window of %s with %d ids", state.ErrSchema, workerId, ids)
+		}
+		w := &window{ids: make([]int64, ids)}
+		var high int64
+		if err := binary.Read(r, binary.LittleEndian, &high); err != nil {
+			return err
+		}
+		w.ids[ids-1] = high
+		for j := int(ids) - 2; j >= 0; j-- {
+			behind, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			w.ids[j] = high - int64(behind)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &w.count); err != nil {
+			return err
+		}
+		df.windows[workerId] = w
+	}
+	return nil
+}
+
+// Records the batch, returning whether it was received before, i.e. a
+// redelivery. Batches older than the Window are not recorded, and return
+// ErrOutOfWindow.
+func (df *DuplicateFilter) Update(h typing.BatchHeader) (dup bool, err error) {
+	w, ok := df.windows[h.WorkerId]
+	if !ok {
+		w = new(window)
+		df.windows[h.WorkerId] = w
+	}
+	if dup, err = w.update(h.MessageId); err != nil {
+		return false, fmt.Errorf("%w: worker %s, message %d, latest %d", err, h.WorkerId, h.MessageId, w.high())
+	}
+	return dup, nil
+}
+
+// Migrates the state stored when only the last id received from every worker
+// was kept, to be registered in the schemas of the workers with a
+// DuplicateFilter.
+func MigrateLastReceived(s map[string]any) error {
+	m, ok := s[stateKey].(map[string]any)
+	if !ok {
+		return nil
+	}
+	for workerId, v := range m {
+		id, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: state[%s.%s]=%v", state.ErrSchema, stateKey, workerId, v)
 		}
-		df.lastMessages[h.WorkerId] = h.MessageId
+		m[workerId] = []uint64{uint64(id)}
 	}
-	return dup, err
+	return nil
 }
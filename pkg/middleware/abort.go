@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Aborting a client's job publishes its id to the AbortExchange, which every
+// queue consumed with Consume() subscribes to through an AbortQueue, so that
+// the abort reaches every filter at once. Consumers then close the client's
+// channel, cancelling the contexts made with Client.Context() with
+// ErrAborted, and acknowledge and drop whatever message is still to arrive for
+// it. Its stream is removed once the worker is done with the client.
+const AbortExchange = "abort"
+
+var ErrAborted = errors.New("client job aborted")
+
+func AbortQueue(queue string) string {
+	return queue + ".abort"
+}
+
+// Aborts the client's job in every filter. The abort is recorded in this
+// process as well, even if it doesn't consume any queue.
+func Abort(ctx context.Context, b Broker, clientId string) error {
+	if _, err := b.ExchangeDeclare(AbortExchange); err != nil {
+		return err
+	}
+	var bc BasicConfirmer
+	log.Infof("action: abort | client: %x", clientId)
+	if err := bc.Publish(ctx, b, AbortExchange, "", []byte(clientId)); err != nil {
+		return err
+	}
+	return recordAbort(clientId)
+}
+
+// Context for processing the client's messages, cancelled with ErrAborted if
+// its job is aborted. Its cancel is to be called once done with the client:
+// if aborted, it removes the client's stream, which acknowledges the abort to
+// the GC.
+func (c Client) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	go func() {
+		select {
+		case <-c.aborted:
+			cancel(ErrAborted)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel(context.Canceled)
+		if c.Aborted() && c.dir != "" {
+			if err := os.RemoveAll(c.dir); err != nil {
+				log.Errorf("action: release_aborted | result: failure | client: %x | error: %s", c.Id, err)
+			}
+		}
+	}
+}
+
+// Whether the client's channel was closed because its job was aborted rather
+// than because every EOF was received. Always accurate once the channel is
+// closed.
+func (c Client) Aborted() bool {
+	select {
+	case <-c.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Whether the client's job was aborted, as seen by any queue consumed by this
+// process. Workers check it before restarting a client recovered from their
+// state.
+func IsAborted(clientId string) bool {
+	_, err := os.Stat(abortFile(clientId))
+	return err == nil
+}
+
+func abortFile(clientId string) string {
+	return filepath.Join(Workdir, "aborted", hex.EncodeToString([]byte(clientId)))
+}
+
+func recordAbort(clientId string) error {
+	if err := os.MkdirAll(filepath.Dir(abortFile(clientId)), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(abortFile(clientId))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Declares the AbortQueue of queue `name' and subscribes to it.
+func subscribeAborts(ctx context.Context, b Broker, name string) (<-chan []byte, error) {
+	if _, err := b.ExchangeDeclare(AbortExchange); err != nil {
+		return nil, err
+	}
+	q, err := b.QueueDeclare(AbortQueue(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := b.QueueBind(q, AbortExchange); err != nil {
+		return nil, err
+	}
+	return b.Subscribe(ctx, q)
+}
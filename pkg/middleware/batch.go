@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+)
+
+var ErrRecord = errors.New("could not marshal record")
+
+// Route returns the exchange and routing key the next batch is published
+// with.
+type Route func() (exchange, key string)
+
+// Every batch is published with the same exchange and key.
+func To(exchange, key string) Route {
+	return func() (string, string) {
+		return exchange, key
+	}
+}
+
+// BatchPublisher fills batches with a client's records, each one starting
+// with an Envelope of the given type, and publishes them as soon as the next
+// record would make them exceed the broker's BatchSize().
+//
+// Every batch published moves the header past it and is counted as sent. By
+// default each batch is confirmed before the next one is started, see
+// WithState() and WithConfirmer() for the alternatives.
+type BatchPublisher struct {
+	b        Broker
+	clientId string
+	t        PayloadType
+	h        *typing.BatchHeader
+	sent     MessageCounter
+	route    Route
+	size     int
+
+	c        Confirmer
+	stateMan *state.StateManager
+	prepare  func() error
+
+	env Envelope
+	buf *bytes.Buffer
+}
+
+func NewBatchPublisher(b Broker, clientId string, t PayloadType, h *typing.BatchHeader, sent MessageCounter, route Route) *BatchPublisher {
+	return &BatchPublisher{
+		b:        b,
+		clientId: clientId,
+		t:        t,
+		h:        h,
+		sent:     sent,
+		route:    route,
+		size:     b.BatchSize(),
+	}
+}
+
+// Publishes each batch in between preparing and committing the state, along
+// with the header and the batches sent. `prepare', if not nil, is called
+// right before preparing it so as to store anything else with it, the batch
+// is not published if it fails.
+//
+// Records whose batch was not yet committed are to be added again after a
+// crash, they are published in the same batches with the same headers.
+func (p *BatchPublisher) WithState(stateMan *state.StateManager, prepare func() error) *BatchPublisher {
+	p.stateMan, p.prepare = stateMan, prepare
+	return p
+}
+
+// Publishes the batches through `c', confirming them is up to the caller, as
+// well as storing the header and the batches sent.
+func (p *BatchPublisher) WithConfirmer(c Confirmer) *BatchPublisher {
+	p.c = c
+	return p
+}
+
+// Appends the record marshalled by `marshal' to the current batch, publishing
+// the batch first if the record doesn't fit. A record that doesn't fit in an
+// empty batch is published on its own.
+//
+// The record is discarded if `marshal' fails, and its error returned wrapped
+// in ErrRecord.
+func (p *BatchPublisher) Add(ctx context.Context, marshal func(*bytes.Buffer) error) error {
+	if p.buf == nil {
+		env, err := NewEnvelope(p.clientId, *p.h, p.t)
+		if err != nil {
+			return err
+		}
+		p.env, p.buf = env, env.Buffer()
+	}
+	n := p.buf.Len()
+	if err := marshal(p.buf); err != nil {
+		p.buf.Truncate(n)
+		return fmt.Errorf("%w: %w", ErrRecord, err)
+	}
+	if p.buf.Len() <= p.size || n == p.env.Len() {
+		return nil
+	}
+	record := bytes.Clone(p.buf.Bytes()[n:])
+	p.buf.Truncate(n)
+	if err := p.Flush(ctx); err != nil {
+		return err
+	}
+	return p.Add(ctx, func(b *bytes.Buffer) error {
+		_, err := b.Write(record)
+		return err
+	})
+}
+
+// Whether there are records not yet published.
+func (p *BatchPublisher) Pending() bool {
+	return p.buf != nil && p.buf.Len() > p.env.Len()
+}
+
+// Publishes the current batch, if it has any record.
+func (p *BatchPublisher) Flush(ctx context.Context) error {
+	if !p.Pending() {
+		return nil
+	}
+	exchange, key := p.route()
+	p.h.MessageId++
+	p.sent.Add(exchange, key)
+	if p.stateMan != nil {
+		p.h.AddToState(p.stateMan.State)
+		p.sent.AddToState(p.stateMan)
+		if p.prepare != nil {
+			if err := p.prepare(); err != nil {
+				return err
+			}
+		}
+		if err := p.stateMan.Prepare(); err != nil {
+			return err
+		}
+	}
+	msg := Seal(p.buf)
+	p.buf = nil
+	if p.c != nil {
+		if err := p.b.Publish(ctx, p.c, exchange, key, msg); err != nil {
+			return err
+		}
+	} else {
+		var bc BasicConfirmer
+		if err := bc.Publish(ctx, p.b, exchange, key, msg); err != nil {
+			return err
+		}
+	}
+	if p.stateMan != nil {
+		return p.stateMan.Commit()
+	}
+	return nil
+}
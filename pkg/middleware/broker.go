@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/duplicates"
+	log "github.com/sirupsen/logrus"
+)
+
+// Broker describes the messaging operations the workers rely on. It is
+// implemented by Middleware, which talks to RabbitMQ, and by MemoryBroker,
+// which keeps every exchange and queue in-process.
+type Broker interface {
+	ExchangeDeclare(name string) (string, error)
+	QueueDeclare(name string) (string, error)
+	QueueBind(queue string, exchanges ...string) error
+	StreamDeclare(name string) (string, error)
+	SetEofProducers(queue string, roles ...string)
+
+	NewDeferredConfirmer(ctx context.Context) DeferredConfirmer
+	Publish(ctx context.Context, c Confirmer, exchange, key string, body []byte) error
+	BatchSize() int
+	Consume(ctx context.Context, name string) (<-chan Client, error)
+	Subscribe(ctx context.Context, name string) (<-chan []byte, error)
+	ReadStream(ctx context.Context, name string, offset int64) (<-chan []byte, error)
+	Ack(tag uint64) error
+	Reject(ctx context.Context, d Delivery, reason string) error
+
+	Membership() (*Membership, error)
+	Ready(ctx context.Context, workerId string) error
+	WaitReady(ctx context.Context, workers int) error
+	EOF(ctx context.Context, exchange, workerId, clientId string, sent MessageCounter, peers ...string) error
+
+	Close()
+}
+
+// delivery is the broker agnostic view of a consumed message.
+type delivery struct {
+	body []byte
+	key  string
+	tag  uint64
+
+	headers     map[string]any
+	deliveries  int
+	redelivered bool
+}
+
+// Splits the messages consumed from queue `name' by the ClientId of their
+// Envelope, tracking the EOFs and batches received for each client in the
+// queue's working directory. A client's channel is closed once an EOF was
+// received from every worker `required' at the client's epoch, along with
+// every batch their workers counted as sent, and a HandoffEOF from every peer
+// announced by Handoff messages, or once its job is aborted through `aborts'.
+// `bindings' returns the exchanges bound to the queue. Messages without a
+// valid Envelope are rejected.
+func demuxClients(ctx context.Context, b Broker, name string, required func(int64) ([]string, error), bindings func() []string, msgs <-chan delivery, aborts <-chan []byte) <-chan Client {
+	ret := make(chan Client)
+	go func() {
+		removeAbortedStreams(name)
+		streams := make(map[string]*clientStream)
+		defer func() {
+			close(ret)
+			for _, s := range streams {
+				s.Close()
+				close(s.ch)
+			}
+		}()
+
+		for {
+			select {
+			case d, ok := <-msgs:
+				if !ok {
+					log.Error(ErrMiddleware)
+					return
+				}
+				if !demuxDelivery(ctx, b, name, required, bindings, streams, ret, d) {
+					return
+				}
+			case clientId, ok := <-aborts:
+				if !ok {
+					aborts = nil
+					continue
+				}
+				if err := abortClient(name, streams, string(clientId)); err != nil {
+					log.Errorf("action: abort | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+					return
+				}
+			}
+		}
+	}()
+
+	return ret
+}
+
+// Hands the delivery to its client, returns false if the queue can no longer
+// be consumed.
+func demuxDelivery(ctx context.Context, b Broker, name string, required func(int64) ([]string, error), bindings func() []string, streams map[string]*clientStream, ret chan<- Client, d delivery) bool {
+	env, msg, err := Open(d.body)
+	if err != nil {
+		rejected := Delivery{Envelope: env, Tag: d.tag, queue: name, key: d.key, body: d.body}
+		if err := b.Reject(ctx, rejected, err.Error()); err != nil {
+			log.Errorf("action: reject | result: failure | queue: %q | error: %s", name, err)
+			return false
+		}
+		return true
+	}
+	clientId := env.ClientId
+	dir := streamDir(name, clientId)
+	stream, ok := streams[clientId]
+	if !ok && IsAborted(clientId) {
+		if err := b.Ack(d.tag); err != nil {
+			log.Errorf("action: drop_aborted | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+		return true
+	} else if !ok {
+		ch := make(chan Delivery)
+		resume := make(chan *duplicates.DuplicateFilter, 1)
+		if stream, err = newClientStream(dir, ch, resume); err != nil {
+			log.Errorf("action: new_client | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+		log.Infof("action: new_client | result: success | queue: %q | client: %x", name, clientId)
+		streams[clientId] = stream
+		ret <- Client{Id: clientId, Ch: ch, aborted: stream.aborted, resume: resume, dir: dir}
+		if err := stream.wait(ctx); err != nil {
+			log.Errorf("action: resume_client | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+	}
+	delivery := Delivery{Envelope: env, Msg: msg, Tag: d.tag, queue: name, key: d.key, body: d.body, counted: true}
+	isEOF := env.Type == EofPayload || env.Type == HandoffEofPayload
+	switch env.Type {
+	case EofPayload, HandoffEofPayload:
+		if err := stream.receiveEOF(name, bindings(), env, msg); err != nil {
+			log.Errorf("action: store_eof | result: failure | queue: %q | worker: %s | error: %s", name, env.Header.WorkerId, err)
+			return false
+		}
+		if err := b.Ack(d.tag); err != nil {
+			log.Errorf("action: ack_eof | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+	case HandoffPayload:
+		if err := stream.receiveHandoff(env.Header, d.redelivered, msg); err != nil {
+			log.Errorf("action: store_handoff | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+		stream.ch <- delivery
+	default:
+		if err := stream.receive(env.Header, d.redelivered); err != nil {
+			log.Errorf("action: store_received | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+		stream.ch <- delivery
+	}
+
+	// The last batches may arrive after the EOF
+	if stream.done(name, required) {
+		log.Infof("action: EOF | result: success | queue: %q | client: %x", name, clientId)
+		if err := recordEpoch(clientId, stream.epoch); err != nil {
+			log.Errorf("action: record_epoch | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			return false
+		}
+		stream.Close()
+		os.RemoveAll(dir)
+		close(stream.ch)
+		delete(streams, clientId)
+	} else if isEOF {
+		log.Infof("action: EOF | result: in_progress | queue: %q | client: %x | received: %s", name, clientId, stream)
+	}
+	return true
+}
+
+// Records the abort before tearing down the client's stream, so that its
+// messages are dropped even if this process restarts.
+// The directory of a client handed to the consumer is left for it to remove
+// once done with the client, see Client.Context().
+func abortClient(name string, streams map[string]*clientStream, clientId string) error {
+	if err := recordAbort(clientId); err != nil {
+		return err
+	}
+	os.Remove(epochFile(clientId))
+	log.Infof("action: abort | result: success | queue: %q | client: %x", name, clientId)
+	if stream, ok := streams[clientId]; ok {
+		stream.Close()
+		close(stream.aborted)
+		close(stream.ch)
+		delete(streams, clientId)
+		return nil
+	}
+	return os.RemoveAll(streamDir(name, clientId))
+}
+
+// Removes the directories left in queue `name' by clients aborted before the
+// process restarted, which are no longer handed to any consumer.
+func removeAbortedStreams(name string) {
+	entries, _ := os.ReadDir(filepath.Join(Workdir, name))
+	for _, entry := range entries {
+		clientId, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() || !IsAborted(string(clientId)) {
+			continue
+		}
+		if err := os.RemoveAll(streamDir(name, string(clientId))); err != nil {
+			log.Errorf("action: remove_aborted | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+		}
+	}
+}
+
+// Working directory of the client's stream in queue `name'.
+func streamDir(name, clientId string) string {
+	return filepath.Join(Workdir, name, hex.EncodeToString([]byte(clientId)))
+}
+
+func subscribe(b Broker, msgs <-chan delivery) <-chan []byte {
+	ret := make(chan []byte)
+	go func() {
+		defer close(ret)
+		for d := range msgs {
+			ret <- d.body
+			if err := b.Ack(d.tag); err != nil {
+				log.Errorf("action: ack_control | result: failure | error: %s", err)
+			}
+		}
+	}()
+	return ret
+}
+
+// The EOF carries the amount of batches the worker sent for the client, see
+// MessageCounter, and the client's epoch, see eofEpoch(). `peers' are the
+// workers that consumers have to wait an EOF for as well, as they were handed
+// off batches by this one.
+func publishEOF(ctx context.Context, b Broker, exchange, workerId, clientId string, sent MessageCounter, peers []string) error {
+	var bc BasicConfirmer
+	epoch, err := eofEpoch(b, clientId)
+	if err != nil {
+		return err
+	}
+	log.Infof("sending EOF into exchange %q | epoch: %d", exchange, epoch)
+	eof := eofMessage{epoch: epoch, sent: sent, peers: peers}
+	msg, err := marshalEOF(clientId, workerId, EofPayload, eof)
+	if err != nil {
+		return err
+	}
+	return bc.Publish(ctx, b, exchange, EofRoutingKey, msg)
+}
+
+var (
+	_ Broker = (*Middleware)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
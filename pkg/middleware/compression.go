@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encodings a publishing's body may be compressed with, set as its
+// ContentEncoding. Consumers decompress every body according to it, whatever
+// encoding they publish with.
+const (
+	NoCompression = ""
+	Deflate       = "deflate"
+)
+
+// Size batches are made up to when publishing compressed. Their records are
+// highly repetitive (airport codes, stops), so they shrink to a fraction of it.
+const CompressedBatchSize = 4 * MaxMessageSize
+
+// Bodies smaller than this are published as they are, it's not worth it.
+const minCompressedSize = 512
+
+var (
+	ErrEncoding = errors.New("unsupported content encoding")
+	ErrTooLarge = errors.New("decompressed body too large")
+)
+
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case NoCompression, Deflate:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrEncoding, encoding)
+	}
+}
+
+// Size batches are made up to when publishing with the encoding.
+func batchSize(encoding string) int {
+	if encoding == NoCompression {
+		return MaxMessageSize
+	}
+	return CompressedBatchSize
+}
+
+// Returns the body to publish along with its ContentEncoding.
+func compress(encoding string, body []byte) ([]byte, string, error) {
+	if encoding == NoCompression || len(body) < minCompressedSize {
+		return body, NoCompression, nil
+	}
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), encoding, nil
+}
+
+// Compressed bodies are read up to CompressedBatchSize, a bigger one is not
+// a batch but most likely a compression bomb.
+func decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case NoCompression:
+		return body, nil
+	case Deflate:
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		buf, err := io.ReadAll(io.LimitReader(r, CompressedBatchSize+1))
+		if err != nil {
+			return nil, err
+		} else if len(buf) > CompressedBatchSize {
+			return nil, fmt.Errorf("%w: over %d bytes", ErrTooLarge, CompressedBatchSize)
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrEncoding, encoding)
+	}
+}
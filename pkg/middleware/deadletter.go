@@ -0,0 +1,329 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deliveries of a message after which it is dead-lettered instead of being
+// requeued, so that a message that kills its consumer is not redelivered
+// forever. The server counts every requeue, including those of the unacked
+// messages of a consumer whose connection was lost, see reconnect(), so it
+// leaves room for a few reconnections on top of the consumer's crashes.
+const DeliveryLimit = 20
+
+const (
+	DeadLetterExchange = "dead-letters"
+	ReasonHeader       = "x-reject-reason"
+	RoutingKeyHeader   = "x-original-routing-key"
+)
+
+func DeadLetterQueue(queue string) string {
+	return queue + ".dlq"
+}
+
+// Arguments for a queue whose rejected messages are routed to its
+// DeadLetterQueue.
+func deadLetterArgs(queue string) amqp.Table {
+	return amqp.Table{
+		amqp.QueueTypeArg:           amqp.QueueTypeQuorum,
+		"x-delivery-limit":          DeliveryLimit,
+		"x-dead-letter-exchange":    DeadLetterExchange,
+		"x-dead-letter-routing-key": queue,
+	}
+}
+
+// Suffix of the queue holding the messages of a queue while it's migrated,
+// see MigrateQueue().
+const migratingSuffix = ".migrating"
+
+// Exclusive queue held by the connection migrating queues, so that a single
+// MigrateQueue() runs at a time.
+const migrateLock = "migrate.lock"
+
+var (
+	ErrClassicQueue = errors.New("queue declared as a classic queue by a previous version")
+	ErrMigrating    = errors.New("queue migration in progress")
+)
+
+// Whether the server refused to declare a queue because it was declared before
+// with another x-queue-type.
+func isQueueTypeMismatch(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed &&
+		strings.Contains(amqpErr.Reason, "'"+amqp.QueueTypeArg+"'")
+}
+
+// Redeclares the queue as a quorum queue if a previous version declared it as
+// a classic one, which the server refuses to redeclare with other arguments.
+// Its messages are moved to a temporary queue in the meantime and back once
+// it's redeclared, its bindings are left to its consumers to redeclare.
+//
+// It's a one-off step, run with every worker of the queue stopped: a concurrent
+// MigrateQueue() fails with ErrMigrating, as does one finding the temporary
+// queue left by an interrupted migration, which is left to be inspected.
+func (m *Middleware) MigrateQueue(name string) error {
+	m.mtx.RLock()
+	conn := m.conn
+	m.mtx.RUnlock()
+
+	lock, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	var amqpErr *amqp.Error
+	_, err = lock.QueueDeclare(migrateLock, false, false, true, false, nil)
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.ResourceLocked {
+		return fmt.Errorf("%w: %s", ErrMigrating, amqpErr.Reason)
+	} else if err != nil {
+		return err
+	}
+	defer lock.QueueDelete(migrateLock, false, false, false)
+
+	// the server closes the channel on errors, it's opened again after each
+	// expected one
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	tmp := name + migratingSuffix
+	if _, err := ch.QueueDeclarePassive(tmp, true, false, false, false, nil); err == nil {
+		ch.Close()
+		return fmt.Errorf("%w: %q exists, a previous migration of %q was interrupted", ErrMigrating, tmp, name)
+	} else if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		return err
+	}
+	if ch, err = confirmChannel(conn); err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if _, err = queueDeclare(ch, name); !isQueueTypeMismatch(err) {
+		return err
+	}
+	log.Infof("action: migrate_queue | queue: %q | type: %s", name, amqp.QueueTypeQuorum)
+	if ch, err = confirmChannel(conn); err != nil {
+		return err
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare(tmp, true, false, false, false, amqp.Table{amqp.QueueTypeArg: amqp.QueueTypeQuorum}); err != nil {
+		return err
+	}
+	if err := moveMessages(ch, name, tmp); err != nil {
+		return err
+	}
+	// fails if a message was published in the meantime
+	if _, err := ch.QueueDelete(name, false, true, false); err != nil {
+		return err
+	}
+	if _, err := queueDeclare(ch, name); err != nil {
+		return err
+	}
+	if err := moveMessages(ch, tmp, name); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDelete(tmp, false, true, false); err != nil {
+		return err
+	}
+	log.Infof("action: migrate_queue | queue: %q | result: success", name)
+	return nil
+}
+
+func confirmChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, ch.Confirm(false)
+}
+
+// Moves every message in queue `from' to queue `to', acknowledging each one
+// once the server confirmed its copy.
+func moveMessages(ch *amqp.Channel, from, to string) error {
+	for {
+		d, ok, err := ch.Get(from, false)
+		if err != nil || !ok {
+			return err
+		}
+		dc, err := ch.PublishWithDeferredConfirm("", to, false, false, amqp.Publishing{
+			DeliveryMode:    amqp.Persistent,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			Headers:         d.Headers,
+			Body:            d.Body,
+		})
+		if err != nil {
+			return err
+		}
+		if !dc.Wait() {
+			return fmt.Errorf("%w: moving a message from %q to %q", ErrNack, from, to)
+		}
+		if err := d.Ack(false); err != nil {
+			return err
+		}
+	}
+}
+
+// Declares the dead letter exchange along with the queue's dead letter queue.
+func deadLetterDeclare(ch *amqp.Channel, queue string) error {
+	err := ch.ExchangeDeclare(
+		DeadLetterExchange, // name
+		"direct",           // type
+		true,               // durable
+		false,              // delete when unused
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return err
+	}
+	dlq, err := ch.QueueDeclare(
+		DeadLetterQueue(queue), // name
+		true,                   // durable
+		false,                  // delete when unused
+		false,                  // exclusive
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(
+		dlq.Name,           // queue
+		queue,              // routing key
+		DeadLetterExchange, // exchange
+		false,
+		nil,
+	)
+}
+
+// Sends the delivery to the dead letter queue of the queue it was consumed
+// from, with `reason' in its ReasonHeader, and acknowledges it.
+func (m *Middleware) Reject(ctx context.Context, d Delivery, reason string) error {
+	log.Errorf("action: reject | queue: %q | client: %x | reason: %s", d.queue, d.ClientId, reason)
+	if err := recordRejected(d); err != nil {
+		return err
+	}
+	var bc BasicConfirmer
+	err := bc.publishWith(ctx, m, DeadLetterExchange, d.queue, d.body, amqp.Table{
+		ReasonHeader:     reason,
+		RoutingKeyHeader: d.key,
+	})
+	if err != nil {
+		return err
+	}
+	return m.Ack(d.Tag)
+}
+
+func (bc *BasicConfirmer) publishWith(ctx context.Context, m *Middleware, exchange, key string, body []byte, headers amqp.Table) error {
+	pc, err := m.newConfirmation(exchange, key, body, headers)
+	if err != nil {
+		return err
+	}
+	bc.pc = pc
+	if err := bc.pc.publish(ctx); err != nil {
+		return err
+	}
+	return bc.Confirm(ctx)
+}
+
+type DeadLetter struct {
+	// As much of it as could be read, it may be the reason it was rejected
+	Envelope
+	Reason     string
+	RoutingKey string
+	Headers    amqp.Table
+	// Payload, without the Envelope
+	Msg []byte
+	// The whole message, decompressed if it could be
+	Body []byte
+}
+
+func newDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{Headers: d.Headers, RoutingKey: d.RoutingKey, Body: d.Body}
+	if body, err := decompress(d.ContentEncoding, d.Body); err == nil {
+		dl.Body = body
+	}
+	dl.Envelope, dl.Msg, _ = PeekEnvelope(dl.Body)
+	dl.Reason, _ = d.Headers[ReasonHeader].(string)
+	if key, ok := d.Headers[RoutingKeyHeader].(string); ok {
+		dl.RoutingKey = key
+	}
+	if dl.Reason == "" {
+		// dead-lettered by the server, e.g. delivery_limit
+		dl.Reason, _ = d.Headers["x-first-death-reason"].(string)
+	}
+	return dl
+}
+
+// Calls `fn' with every message in the queue's dead letter queue belonging to
+// `clientId' (or every message if it's empty). Messages for which `fn' returns
+// true are acknowledged, the rest are left in the dead letter queue.
+func (m *Middleware) walkDeadLetters(queue, clientId string, fn func(DeadLetter) (bool, error)) error {
+	conn, ch, err := connect(m.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var requeue []uint64
+	defer func() {
+		for _, tag := range requeue {
+			ch.Nack(tag, false, true)
+		}
+	}()
+	for {
+		d, ok, err := ch.Get(DeadLetterQueue(queue), false)
+		if err != nil || !ok {
+			return err
+		}
+		dl := newDeadLetter(d)
+		if clientId != "" && dl.ClientId != clientId {
+			requeue = append(requeue, d.DeliveryTag)
+			continue
+		}
+		done, err := fn(dl)
+		if err != nil {
+			requeue = append(requeue, d.DeliveryTag)
+			return err
+		}
+		if !done {
+			requeue = append(requeue, d.DeliveryTag)
+		} else if err := d.Ack(false); err != nil {
+			return err
+		}
+	}
+}
+
+// Lists the messages in the queue's dead letter queue for the given client,
+// leaving them in place.
+func (m *Middleware) ListDeadLetters(queue, clientId string) ([]DeadLetter, error) {
+	var dls []DeadLetter
+	err := m.walkDeadLetters(queue, clientId, func(dl DeadLetter) (bool, error) {
+		dls = append(dls, dl)
+		return false, nil
+	})
+	return dls, err
+}
+
+// Publishes the dead-lettered messages of the given client back into `queue',
+// as they were. Returns how many messages were replayed.
+func (m *Middleware) ReplayDeadLetters(ctx context.Context, queue, clientId string) (int, error) {
+	var bc BasicConfirmer
+	n := 0
+	err := m.walkDeadLetters(queue, clientId, func(dl DeadLetter) (bool, error) {
+		if err := bc.Publish(ctx, m, "", queue, dl.Body); err != nil {
+			return false, err
+		}
+		n++
+		return true, nil
+	})
+	return n, err
+}
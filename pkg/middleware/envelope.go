@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/middleware/id"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+)
+
+// Version of the Envelope layout, messages with any other are rejected. The
+// 2nd one prefixes strings with their length as a uvarint, see
+// typing.WriteString().
+const EnvelopeVersion = 2
+
+// Offsets of the fixed fields of an Envelope.
+const (
+	versionOffset  = 0
+	clientIdOffset = versionOffset + 1
+	typeOffset     = clientIdOffset + id.Len
+	schemaOffset   = typeOffset + 1
+	checksumOffset = schemaOffset + 1
+	fixedLen       = checksumOffset + 4
+)
+
+type PayloadType uint8
+
+const (
+	_ PayloadType = iota
+	CoordsPayload
+	FlightsPayload
+	DistancePayload
+	FastestPayload
+	AveragePayload
+	ResultsPayload
+	HandoffPayload
+	EofPayload
+	HandoffEofPayload
+)
+
+// Current schema version of each payload type. Bumping one makes consumers
+// reject the messages of the previous version, see Open().
+var schemas = map[PayloadType]uint8{
+	CoordsPayload:     1,
+	FlightsPayload:    2,
+	DistancePayload:   1,
+	FastestPayload:    1,
+	AveragePayload:    1,
+	ResultsPayload:    1,
+	HandoffPayload:    1,
+	EofPayload:        1,
+	HandoffEofPayload: 1,
+}
+
+var (
+	ErrEnvelope    = errors.New("malformed envelope")
+	ErrVersion     = errors.New("unsupported envelope version")
+	ErrSchema      = errors.New("unsupported payload schema")
+	ErrChecksum    = errors.New("checksum mismatch")
+	ErrPayloadType = errors.New("unexpected payload type")
+)
+
+func (t PayloadType) String() string {
+	switch t {
+	case CoordsPayload:
+		return "coords"
+	case FlightsPayload:
+		return "flights"
+	case DistancePayload:
+		return "distance"
+	case FastestPayload:
+		return "fastest"
+	case AveragePayload:
+		return "average"
+	case ResultsPayload:
+		return "results"
+	case HandoffPayload:
+		return "handoff"
+	case EofPayload:
+		return "eof"
+	case HandoffEofPayload:
+		return "handoff-eof"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Envelope precedes the payload of every message published for a client:
+//
+//	version | clientId | type | schema | checksum | producer | messageId | payload
+//
+// The checksum is the CRC-32 of everything after it. The producer and
+// message id are the typing.BatchHeader of the batch.
+type Envelope struct {
+	ClientId string
+	Header   typing.BatchHeader
+	Type     PayloadType
+	Schema   uint8
+}
+
+// Fails with typing.ErrLength if the worker id is longer than
+// typing.MaxStringLen, it's not checked again by Buffer().
+func NewEnvelope(clientId string, h typing.BatchHeader, t PayloadType) (Envelope, error) {
+	if len(h.WorkerId) > typing.MaxStringLen {
+		return Envelope{}, fmt.Errorf("%w: worker id %.32q...", typing.ErrLength, h.WorkerId)
+	}
+	return Envelope{
+		ClientId: clientId,
+		Header:   h,
+		Type:     t,
+		Schema:   schemas[t],
+	}, nil
+}
+
+// Length of the marshalled Envelope, a buffer returned by Buffer() holding no
+// more than this has no payload.
+func (e Envelope) Len() int {
+	return fixedLen + typing.StringSize(e.Header.WorkerId) + 8
+}
+
+// Buffer starting with the Envelope, the payload is to be written after it.
+// The message has to be sealed with Seal() before publishing it.
+func (e Envelope) Buffer() *bytes.Buffer {
+	b := bytes.NewBuffer(make([]byte, 0, MaxMessageSize))
+	b.WriteByte(EnvelopeVersion)
+	b.WriteString(e.ClientId)
+	b.WriteByte(byte(e.Type))
+	b.WriteByte(e.Schema)
+	b.Write([]byte{0, 0, 0, 0})
+	// validated by NewEnvelope()
+	e.Header.Marshal(b)
+	return b
+}
+
+// Envelope along with the payload, sealed.
+func (e Envelope) Marshal(payload []byte) []byte {
+	b := e.Buffer()
+	b.Write(payload)
+	return Seal(b)
+}
+
+// Fills in the checksum of a message started with Envelope.Buffer().
+func Seal(b *bytes.Buffer) []byte {
+	msg := b.Bytes()
+	binary.LittleEndian.PutUint32(msg[checksumOffset:], crc32.ChecksumIEEE(msg[fixedLen:]))
+	return msg
+}
+
+// Splits the message into its Envelope and payload, without checking its
+// version, schema nor checksum.
+func PeekEnvelope(msg []byte) (Envelope, []byte, error) {
+	var e Envelope
+	if len(msg) < fixedLen {
+		return e, nil, fmt.Errorf("%w: %d bytes", ErrEnvelope, len(msg))
+	}
+	e.ClientId = string(msg[clientIdOffset:typeOffset])
+	e.Type = PayloadType(msg[typeOffset])
+	e.Schema = msg[schemaOffset]
+	r := bytes.NewReader(msg[fixedLen:])
+	if err := e.Header.Unmarshal(r); err != nil {
+		return e, nil, fmt.Errorf("%w: %s", ErrEnvelope, err)
+	}
+	return e, msg[len(msg)-r.Len():], nil
+}
+
+// Splits the message into its Envelope and payload. The Envelope is returned
+// along with the error if at least the client id could be read.
+func Open(msg []byte) (Envelope, []byte, error) {
+	e, payload, err := PeekEnvelope(msg)
+	if err != nil {
+		return e, nil, err
+	}
+	if v := msg[versionOffset]; v != EnvelopeVersion {
+		return e, nil, fmt.Errorf("%w: %d", ErrVersion, v)
+	}
+	if schema, ok := schemas[e.Type]; !ok || schema != e.Schema {
+		return e, nil, fmt.Errorf("%w: %s version %d", ErrSchema, e.Type, e.Schema)
+	}
+	if sum := binary.LittleEndian.Uint32(msg[checksumOffset:]); sum != crc32.ChecksumIEEE(msg[fixedLen:]) {
+		return e, nil, ErrChecksum
+	}
+	return e, payload, nil
+}
+
+// Checks that the delivery's payload is of any of the given types.
+func (d Delivery) Expect(types ...PayloadType) error {
+	for _, t := range types {
+		if d.Type == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPayloadType, d.Type)
+}
@@ -0,0 +1,429 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/duplicates"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+	log "github.com/sirupsen/logrus"
+)
+
+const ReceivedFileName = "received"
+
+// Batches published by a worker for a client, by destination. The destination
+// of a batch is the exchange it was published to, or its routing key (i.e. the
+// queue) for the default exchange.
+//
+// It is sent along with the worker's EOF so that consumers can tell whether
+// they already received every batch.
+type MessageCounter map[string]int64
+
+func NewMessageCounter() MessageCounter {
+	return make(MessageCounter)
+}
+
+func (mc MessageCounter) Add(exchange, key string) {
+	if exchange == "" {
+		mc[key]++
+	} else {
+		mc[exchange]++
+	}
+}
+
+func (mc MessageCounter) RemoveFromState(stateMan *state.StateManager) {
+	stateMan.Remove("published")
+}
+
+func (mc MessageCounter) AddToState(stateMan *state.StateManager) {
+	stateMan.State["published"] = map[string]int64(mc)
+}
+
+func MessageCounterFromState(stateMan *state.StateManager) (MessageCounter, error) {
+	m, err := stateMan.GetMapStringInt64("published")
+	if err != nil && errors.Is(err, state.ErrNotFound) {
+		return NewMessageCounter(), nil
+	}
+	return MessageCounter(m), err
+}
+
+// An EOF carries the membership epoch of the client, whose members are
+// waited for, and the peers the worker handed off batches to, which are
+// waited for as well. The worker is the producer in its Envelope.
+type eofMessage struct {
+	epoch int64
+	sent  MessageCounter
+	peers []string
+}
+
+// Marshals an EOF message, of type EofPayload or HandoffEofPayload:
+//
+//	epoch | n | n * (destination | count) | m | m * peer
+func marshalEOF(clientId, workerId string, t PayloadType, eof eofMessage) ([]byte, error) {
+	env, err := NewEnvelope(clientId, typing.BatchHeader{WorkerId: workerId}, t)
+	if err != nil {
+		return nil, err
+	}
+	b := env.Buffer()
+	binary.Write(b, binary.LittleEndian, eof.epoch)
+	binary.Write(b, binary.LittleEndian, uint32(len(eof.sent)))
+	for destination, count := range eof.sent {
+		if err := typing.WriteString(b, destination); err != nil {
+			return nil, err
+		}
+		binary.Write(b, binary.LittleEndian, count)
+	}
+	binary.Write(b, binary.LittleEndian, uint32(len(eof.peers)))
+	for _, peer := range eof.peers {
+		if err := typing.WriteString(b, peer); err != nil {
+			return nil, err
+		}
+	}
+	return Seal(b), nil
+}
+
+// Unmarshals the payload of an EOF message.
+func unmarshalEOF(msg []byte) (eof eofMessage, err error) {
+	r := bytes.NewReader(msg)
+	err = binary.Read(r, binary.LittleEndian, &eof.epoch)
+	var n uint32
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &n)
+	}
+	eof.sent = NewMessageCounter()
+	for ; err == nil && n > 0; n-- {
+		var (
+			destination string
+			count       int64
+		)
+		destination, err = typing.ReadString(r)
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &count)
+		}
+		eof.sent[destination] = count
+	}
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &n)
+	}
+	for ; err == nil && n > 0; n-- {
+		var peer string
+		if peer, err = typing.ReadString(r); err == nil {
+			eof.peers = append(eof.peers, peer)
+		}
+	}
+	return eof, err
+}
+
+// The state of a client's stream in a queue: the EOFs received, with the
+// amount of batches expected from each worker, and the distinct batches
+// received from each of them. Also the peers announced by Handoff messages,
+// whose HandoffEOF is waited for as well, and the greatest epoch and the
+// peers announced by the EOFs, whose EOF is waited for.
+//
+// EOFs are kept in a state file. Batches are counted along with their ids in
+// a window for each worker, resumed from the ones the consumer committed, see
+// Client.Resume(). Those rejected or redelivered, which it may not have
+// committed, are appended to a separate file so as to count them again.
+type clientStream struct {
+	ch chan<- Delivery
+	// closed if the client's job is aborted
+	aborted  chan struct{}
+	eofs     *state.StateManager
+	expected map[string]int64
+	// by peer, from HandoffEOFs
+	handedOff map[string]int64
+	peers     []string
+	epoch     int64
+	announced []string
+	resume    <-chan *duplicates.DuplicateFilter
+	received  *duplicates.DuplicateFilter
+	// appended to the file, counted once resumed
+	recorded []typing.BatchHeader
+	// older than the window, they're dead-lettered by the consumer
+	late map[string]int64
+	log  *os.File
+}
+
+func newClientStream(dir string, ch chan<- Delivery, resume <-chan *duplicates.DuplicateFilter) (*clientStream, error) {
+	s := &clientStream{
+		ch:      ch,
+		aborted: make(chan struct{}),
+		eofs:    state.NewStateManager(dir),
+		resume:  resume,
+		late:    make(map[string]int64),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s.eofs.RecoverState()
+	var err error
+	if s.expected, err = recoverCounts(s.eofs, "expected"); err != nil {
+		return nil, err
+	}
+	if s.handedOff, err = recoverCounts(s.eofs, "handed-off"); err != nil {
+		return nil, err
+	}
+	if s.peers, err = recoverStrings(s.eofs, "peers"); err != nil {
+		return nil, err
+	}
+	if s.announced, err = recoverStrings(s.eofs, "announced"); err != nil {
+		return nil, err
+	}
+	if s.epoch, err = s.eofs.GetInt64("epoch"); err != nil && !errors.Is(err, state.ErrNotFound) {
+		return nil, err
+	}
+
+	filename := filepath.Join(dir, ReceivedFileName)
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	if err := s.recoverReceived(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func recoverCounts(stateMan *state.StateManager, key string) (map[string]int64, error) {
+	counts, err := stateMan.GetMapStringInt64(key)
+	if err != nil && errors.Is(err, state.ErrNotFound) {
+		return make(map[string]int64), nil
+	}
+	return counts, err
+}
+
+func recoverStrings(stateMan *state.StateManager, key string) ([]string, error) {
+	values, err := state.Get[[]string](stateMan, key)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil, nil
+	}
+	return values, err
+}
+
+// A trailing incomplete record, from a crash while appending it, is discarded.
+func (s *clientStream) recoverReceived() error {
+	r := bufio.NewReader(s.log)
+	var offset int64
+	for {
+		var h typing.BatchHeader
+		workerId, err := typing.ReadString(r)
+		if err == nil {
+			h.WorkerId = workerId
+			err = binary.Read(r, binary.LittleEndian, &h.MessageId)
+		}
+		if err == io.EOF && r.Buffered() == 0 {
+			return nil
+		} else if err != nil {
+			log.Warnf("action: recover_received | file: %q | error: %s", s.log.Name(), err)
+			return s.log.Truncate(offset)
+		}
+		s.recorded = append(s.recorded, h)
+		offset += int64(typing.StringSize(h.WorkerId) + 8)
+	}
+}
+
+// Hands the batches the consumer committed to the stream, see
+// Client.Resume(). Nothing is counted until then.
+func (s *clientStream) wait(ctx context.Context) error {
+	if s.received != nil {
+		return nil
+	}
+	select {
+	case df := <-s.resume:
+		s.received = df
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	for _, h := range s.recorded {
+		s.count(h)
+	}
+	s.recorded = nil
+	return nil
+}
+
+func (s *clientStream) count(h typing.BatchHeader) {
+	if _, err := s.received.Update(h); err != nil {
+		log.Warnf("action: count_batch | worker: %s | error: %s", h.WorkerId, err)
+		s.late[h.WorkerId]++
+	}
+}
+
+// Distinct batches received from the worker.
+func (s *clientStream) countOf(workerId string) int64 {
+	return s.received.Received(workerId) + s.late[workerId]
+}
+
+// Counts the batch as received, a redelivered one is recorded first so as to
+// not lose count of it if the consumer doesn't commit it. It has to be done
+// before handing the batch to the consumer.
+func (s *clientStream) receive(h typing.BatchHeader, redelivered bool) error {
+	if redelivered {
+		if err := appendReceived(s.log, h); err != nil {
+			return err
+		}
+	}
+	s.count(h)
+	return nil
+}
+
+func appendReceived(f *os.File, h typing.BatchHeader) error {
+	var b bytes.Buffer
+	h.Marshal(&b)
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Records a batch rejected by the consumer in its client's stream, so that
+// it's still counted after a crash.
+func recordRejected(d Delivery) error {
+	if !d.counted {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(streamDir(d.queue, d.ClientId), ReceivedFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		// done with the client
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return appendReceived(f, d.Header)
+}
+
+// Resumes counting the batches received for the client from the ones the
+// consumer committed, given by its duplicates filter as recovered. It has to
+// be called once before consuming Ch, none of the client's messages are
+// handled until then.
+func (c Client) Resume(df *duplicates.DuplicateFilter) {
+	c.resume <- df.Clone()
+}
+
+// Stores the amount of batches the worker sent to queue `name', which is
+// bound to the given exchanges. HandoffEOFs are kept apart, they don't count
+// towards the EOFs expected for the queue.
+func (s *clientStream) receiveEOF(name string, exchanges []string, env Envelope, msg []byte) error {
+	eof, err := unmarshalEOF(msg)
+	if err != nil {
+		return err
+	}
+	workerId := env.Header.WorkerId
+	// an exchange may be named after the queue, its batches are counted
+	// together
+	expected := eof.sent[name]
+	for _, exchange := range exchanges {
+		if exchange != name {
+			expected += eof.sent[exchange]
+		}
+	}
+	if env.Type == HandoffEofPayload {
+		s.handedOff[workerId] = expected
+		s.eofs.State["handed-off"] = s.handedOff
+		return s.eofs.DumpState()
+	}
+	s.expected[workerId] = expected
+	s.eofs.State["expected"] = s.expected
+	s.epoch = max(s.epoch, eof.epoch)
+	s.eofs.State["epoch"] = s.epoch
+	for _, peer := range eof.peers {
+		if !slices.Contains(s.announced, peer) {
+			s.announced = append(s.announced, peer)
+		}
+	}
+	s.eofs.State["announced"] = s.announced
+	return s.eofs.DumpState()
+}
+
+// Stores the peers announced by the Handoff, which is also counted as a batch.
+func (s *clientStream) receiveHandoff(h typing.BatchHeader, redelivered bool, msg []byte) error {
+	var handoff Handoff
+	if err := handoff.Unmarshal(bytes.NewReader(msg)); err != nil {
+		return s.receive(h, redelivered)
+	}
+	added := false
+	for _, peer := range handoff.Peers {
+		if !slices.Contains(s.peers, peer) {
+			s.peers = append(s.peers, peer)
+			added = true
+		}
+	}
+	if added {
+		s.eofs.State["peers"] = s.peers
+		if err := s.eofs.DumpState(); err != nil {
+			return err
+		}
+	}
+	return s.receive(h, redelivered)
+}
+
+// Whether an EOF was received from every member `required' at the client's
+// epoch (at least one) and every peer announced by them, and a HandoffEOF
+// from every peer, along with every batch their workers sent.
+func (s *clientStream) done(name string, required func(int64) ([]string, error)) bool {
+	if len(s.expected) == 0 {
+		return false
+	}
+	members, err := required(s.epoch)
+	if err != nil {
+		log.Errorf("action: membership | result: failure | queue: %q | epoch: %d | error: %s", name, s.epoch, err)
+		return false
+	}
+	for _, workerId := range append(members, s.announced...) {
+		if _, ok := s.expected[workerId]; !ok {
+			return false
+		}
+	}
+	for _, peer := range s.peers {
+		if _, ok := s.handedOff[peer]; !ok {
+			return false
+		}
+	}
+	for _, counts := range []map[string]int64{s.expected, s.handedOff} {
+		for workerId, expected := range counts {
+			if received := s.countOf(workerId); received < expected {
+				return false
+			} else if received > expected {
+				log.Errorf("action: count_batches | result: failure | queue: %q | worker: %s | expected: %d | received: %d", name, workerId, expected, received)
+			}
+		}
+	}
+	return true
+}
+
+func (s *clientStream) Close() error {
+	return s.log.Close()
+}
+
+func (s *clientStream) String() string {
+	var b strings.Builder
+	for workerId, expected := range s.expected {
+		fmt.Fprintf(&b, "%s=%d/%d ", workerId, s.countOf(workerId), expected)
+	}
+	for _, peer := range s.announced {
+		if _, ok := s.expected[peer]; !ok {
+			fmt.Fprintf(&b, "%s=%d/? ", peer, s.countOf(peer))
+		}
+	}
+	for _, peer := range s.peers {
+		if expected, ok := s.handedOff[peer]; ok {
+			fmt.Fprintf(&b, "%s=%d/%d ", peer, s.countOf(peer), expected)
+		} else {
+			fmt.Fprintf(&b, "%s=%d/? ", peer, s.countOf(peer))
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
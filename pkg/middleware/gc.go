@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+)
+
+// GC removes the state of clients with no activity in this process for
+// longer than its TTL, like those that crashed and never reconnected.
+//
+// Their jobs are aborted first, and the abort is per-process: it's published
+// only to the queues consumed by this process and recorded only in its
+// Workdir, so that its consumers drop them and their messages while other
+// filters are left alone, to be collected by their own GC. Their directories
+// are removed on a later collection, once the consumer of every queue is done
+// with the aborted client and removed its stream, see Client.Context(). The
+// records of aborts and epochs are removed after the TTL as well, once the
+// client has no state left.
+type GC struct {
+	b        Broker
+	ttl      time.Duration
+	workdirs []string
+}
+
+// `workdirs' hold the state of the worker, a directory for each client named
+// after its hex encoded id, besides the state of the queues it consumes.
+func NewGC(b Broker, ttl time.Duration, workdirs ...string) *GC {
+	return &GC{b, ttl, workdirs}
+}
+
+// Collects garbage every interval until the context is cancelled, it's
+// disabled if the TTL is not positive. The counters of state files found
+// corrupted are logged every interval all the same.
+func (gc *GC) Run(ctx context.Context, interval time.Duration) {
+	if gc.ttl <= 0 || interval <= 0 {
+		log.Info("action: gc | result: disabled")
+	}
+	if interval <= 0 {
+		return
+	}
+	var counters stateCounters
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			counters.log()
+			if gc.ttl <= 0 {
+				continue
+			}
+			if err := gc.Collect(ctx); err != nil {
+				log.Errorf("action: gc | result: failure | error: %s", err)
+			}
+		}
+	}
+}
+
+// Last values logged of state.CorruptedFiles and state.Quarantined.
+type stateCounters struct {
+	corrupted   int64
+	quarantined int64
+}
+
+func (c *stateCounters) log() {
+	corrupted, quarantined := state.CorruptedFiles.Value(), state.Quarantined.Value()
+	if corrupted == c.corrupted && quarantined == c.quarantined {
+		return
+	}
+	c.corrupted, c.quarantined = corrupted, quarantined
+	log.Warnf("action: state_files | corrupted: %d | quarantined: %d", corrupted, quarantined)
+}
+
+type clientDirs struct {
+	dirs         []string
+	lastActivity time.Time
+	// in the queues consumed
+	streams int
+}
+
+func (gc *GC) Collect(ctx context.Context) error {
+	clients := make(map[string]*clientDirs)
+	for _, workdir := range gc.workdirs {
+		collectClientDirs(workdir, clients, false)
+	}
+	queues, err := os.ReadDir(Workdir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var consumed []string
+	for _, queue := range queues {
+		if !queue.IsDir() || slices.Contains(records, queue.Name()) {
+			continue
+		}
+		consumed = append(consumed, queue.Name())
+		collectClientDirs(filepath.Join(Workdir, queue.Name()), clients, true)
+	}
+
+	now := time.Now()
+	for clientId, c := range clients {
+		if now.Sub(c.lastActivity) < gc.ttl {
+			continue
+		}
+		if !IsAborted(clientId) {
+			log.Infof("action: gc | client: %x | last_activity: %s | aborting", clientId, c.lastActivity)
+			if err := abortLocally(ctx, gc.b, clientId, consumed); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.streams > 0 {
+			log.Debugf("action: gc | client: %x | streams: %d | waiting for the consumers", clientId, c.streams)
+			continue
+		}
+		for _, dir := range c.dirs {
+			if err := state.RemoveWorkdir(dir); err != nil {
+				log.Errorf("action: gc | result: failure | client: %x | dir: %s | error: %s", clientId, dir, err)
+				continue
+			}
+			log.Infof("action: gc | result: success | client: %x | dir: %s", clientId, dir)
+		}
+	}
+
+	for _, dir := range records {
+		gc.collectRecords(filepath.Join(Workdir, dir), clients, now)
+	}
+	return nil
+}
+
+// Directories in Workdir holding records rather than the state of a queue.
+var records = []string{"aborted", "epochs"}
+
+// Aborts the client's job in the given queues only, through their
+// AbortQueue, and records it in this process.
+func abortLocally(ctx context.Context, b Broker, clientId string, queues []string) error {
+	var bc BasicConfirmer
+	for _, queue := range queues {
+		if err := bc.Publish(ctx, b, "", AbortQueue(queue), []byte(clientId)); err != nil {
+			return err
+		}
+	}
+	return recordAbort(clientId)
+}
+
+// Adds the client directories in `workdir' to `clients', skipping anything
+// not named after a client id. `stream' tells whether they're the streams of
+// a queue.
+func collectClientDirs(workdir string, clients map[string]*clientDirs, stream bool) {
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(workdir, entry.Name())
+		c, ok := clients[string(id)]
+		if !ok {
+			c = new(clientDirs)
+			clients[string(id)] = c
+		}
+		c.dirs = append(c.dirs, dir)
+		if stream {
+			c.streams++
+		}
+		if last := lastModified(dir); last.After(c.lastActivity) {
+			c.lastActivity = last
+		}
+	}
+}
+
+// Latest modification time of the directory or any file in it.
+func lastModified(dir string) time.Time {
+	var last time.Time
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last
+}
+
+// Removes the records in `dir' of clients without state left, once older than
+// the TTL.
+func (gc *GC) collectRecords(dir string, clients map[string]*clientDirs, now time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, err := hex.DecodeString(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		if _, ok := clients[string(id)]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < gc.ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Errorf("action: gc | result: failure | file: %s | error: %s", filepath.Join(dir, entry.Name()), err)
+		}
+	}
+}
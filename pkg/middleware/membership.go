@@ -0,0 +1,332 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Workers register in the MembershipStream once they are ready to consume,
+// named after the queue they consume from (see QueueName()), so that their
+// role is the queue's prefix and their shard its number.
+//
+// The stream keeps every registration and each broker replays it from the
+// start, so they all agree on the members at every epoch, i.e. after each
+// offset of the stream.
+const MembershipStream = "membership"
+
+const (
+	memberJoined byte = iota
+	memberLeft
+)
+
+var ErrEpoch = errors.New("membership epoch not reached")
+
+type membershipEvent struct {
+	workerId string
+	joined   bool
+}
+
+type Membership struct {
+	mtx    sync.Mutex
+	events []membershipEvent
+	// closed and replaced on every event
+	updated chan struct{}
+	// closed once the stream is no longer read
+	closed chan struct{}
+}
+
+// Registers the worker as a member, `workerId' should be the name of the
+// queue it consumes from.
+func Register(ctx context.Context, b Broker, workerId string) error {
+	return publishMembership(ctx, b, memberJoined, workerId)
+}
+
+// Deregisters the worker. Only meant for workers that drained their queue and
+// whose shard is not taken into account by any KeyGenerator.
+func Deregister(ctx context.Context, b Broker, workerId string) error {
+	return publishMembership(ctx, b, memberLeft, workerId)
+}
+
+// Deregisters the worker on a clean shutdown if it's done with every client,
+// none being left in `workdir' nor tracked for the queues it consumes from,
+// so that the clients starting from then on are not dealt to it. It's
+// registered again once started, see Broker.Ready().
+func DeregisterIdle(ctx context.Context, b Broker, workerId, workdir string, queues ...string) error {
+	dirs := []string{workdir}
+	for _, queue := range queues {
+		dirs = append(dirs, filepath.Join(Workdir, queue))
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if _, err := hex.DecodeString(entry.Name()); err == nil && entry.IsDir() {
+				log.Infof("action: deregister | result: skipped | worker: %s | client: %s", workerId, entry.Name())
+				return nil
+			}
+		}
+	}
+	log.Infof("action: deregister | worker: %s", workerId)
+	return Deregister(ctx, b, workerId)
+}
+
+func publishMembership(ctx context.Context, b Broker, flag byte, workerId string) error {
+	var bc BasicConfirmer
+	msg := bytes.NewBuffer(nil)
+	msg.WriteByte(flag)
+	if err := typing.WriteString(msg, workerId); err != nil {
+		return err
+	}
+	return bc.Publish(ctx, b, "", MembershipStream, msg.Bytes())
+}
+
+func unmarshalMembership(msg []byte) (membershipEvent, error) {
+	r := bytes.NewReader(msg)
+	flag, err := r.ReadByte()
+	if err != nil {
+		return membershipEvent{}, err
+	}
+	if flag != memberJoined && flag != memberLeft {
+		return membershipEvent{}, fmt.Errorf("Unknown format specifier: %d", flag)
+	}
+	workerId, err := typing.ReadString(r)
+	return membershipEvent{workerId, flag == memberJoined}, err
+}
+
+// Reads the MembershipStream from the start until `ctx' is done or the
+// broker is closed.
+func WatchMembership(ctx context.Context, b Broker) (*Membership, error) {
+	if _, err := b.StreamDeclare(MembershipStream); err != nil {
+		return nil, err
+	}
+	msgs, err := b.ReadStream(ctx, MembershipStream, 0)
+	if err != nil {
+		return nil, err
+	}
+	ms := &Membership{
+		updated: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go ms.run(msgs)
+	return ms, nil
+}
+
+func (ms *Membership) run(msgs <-chan []byte) {
+	defer close(ms.closed)
+	for msg := range msgs {
+		ev, err := unmarshalMembership(msg)
+		ms.mtx.Lock()
+		// malformed events still count towards the epoch, so that it matches
+		// the stream's offset
+		ms.events = append(ms.events, ev)
+		epoch := len(ms.events)
+		close(ms.updated)
+		ms.updated = make(chan struct{})
+		ms.mtx.Unlock()
+		if err != nil {
+			log.Errorf("action: membership | result: failure | epoch: %d | error: %s", epoch, err)
+		} else {
+			log.Infof("action: membership | result: success | epoch: %d | worker: %s | joined: %t", epoch, ev.workerId, ev.joined)
+		}
+	}
+}
+
+// Role of a worker, the prefix of its name if it has a shard.
+func Role(workerId string) string {
+	if role, _, err := ParseQueueName(workerId); err == nil {
+		return role
+	}
+	return workerId
+}
+
+// Amount of events read so far.
+func (ms *Membership) Epoch() int64 {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return int64(len(ms.events))
+}
+
+// Blocks until `epoch' is reached.
+func (ms *Membership) wait(ctx context.Context, epoch int64) error {
+	for {
+		ms.mtx.Lock()
+		reached, updated := int64(len(ms.events)) >= epoch, ms.updated
+		ms.mtx.Unlock()
+		if reached {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-ms.closed:
+			return fmt.Errorf("%w: %d", ErrEpoch, epoch)
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// Members with any of the given roles at `epoch', sorted. Every member if no
+// role is given. Blocks until the epoch is reached.
+func (ms *Membership) MembersAt(ctx context.Context, epoch int64, roles ...string) ([]string, error) {
+	if err := ms.wait(ctx, epoch); err != nil {
+		return nil, err
+	}
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	members := make(map[string]bool)
+	for _, ev := range ms.events[:epoch] {
+		if ev.workerId == "" {
+			continue
+		}
+		if len(roles) > 0 && !slices.Contains(roles, Role(ev.workerId)) {
+			continue
+		}
+		if ev.joined {
+			members[ev.workerId] = true
+		} else {
+			delete(members, ev.workerId)
+		}
+	}
+	ret := make([]string, 0, len(members))
+	for workerId := range members {
+		ret = append(ret, workerId)
+	}
+	slices.Sort(ret)
+	return ret, nil
+}
+
+// Current members with any of the given roles.
+func (ms *Membership) Members(roles ...string) []string {
+	members, _ := ms.MembersAt(context.Background(), ms.Epoch(), roles...)
+	return members
+}
+
+// Shards of the current members with the given role, sorted.
+func (ms *Membership) Shards(role string) []int {
+	var shards []int
+	for _, workerId := range ms.Members(role) {
+		if _, shard, err := ParseQueueName(workerId); err == nil {
+			shards = append(shards, shard)
+		}
+	}
+	slices.Sort(shards)
+	return shards
+}
+
+// Blocks until there are at least `n' members.
+func (ms *Membership) WaitMembers(ctx context.Context, n int) error {
+	for {
+		ms.mtx.Lock()
+		updated := ms.updated
+		ms.mtx.Unlock()
+		if len(ms.Members()) >= n {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-ms.closed:
+			return ErrMiddleware
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// Starts watching the membership the first time it's needed, for as long as
+// the broker is open.
+type membershipWatch struct {
+	once sync.Once
+	ms   *Membership
+	err  error
+}
+
+func (w *membershipWatch) get(b Broker) (*Membership, error) {
+	w.once.Do(func() {
+		w.ms, w.err = WatchMembership(context.Background(), b)
+	})
+	return w.ms, w.err
+}
+
+// Members whose EOF a queue waits for, by the roles of its producers.
+type producers struct {
+	mtx   sync.Mutex
+	roles map[string][]string
+}
+
+func (p *producers) set(queue string, roles []string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.roles == nil {
+		p.roles = make(map[string][]string)
+	}
+	p.roles[queue] = roles
+}
+
+func (p *producers) required(ctx context.Context, ms *Membership, queue string) func(int64) ([]string, error) {
+	p.mtx.Lock()
+	roles := p.roles[queue]
+	p.mtx.Unlock()
+	return func(epoch int64) ([]string, error) {
+		if len(roles) == 0 {
+			return nil, nil
+		}
+		return ms.MembersAt(ctx, epoch, roles...)
+	}
+}
+
+// The epoch a client's EOFs are sent with, it's the one the worker received
+// along with the EOFs for the client. Workers that didn't receive any, like
+// the input boundary, use the current epoch.
+//
+// Every member at the epoch registered before the EOF was sent, so it's bound
+// to receive it and send its own.
+func eofEpoch(b Broker, clientId string) (int64, error) {
+	buf, err := state.ReadFile(epochFile(clientId))
+	if err == nil {
+		return strconv.ParseInt(string(buf), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	ms, err := b.Membership()
+	if err != nil {
+		return 0, err
+	}
+	return ms.Epoch(), nil
+}
+
+// Queues are consumed concurrently, but each client's epoch is kept in a
+// single file.
+var epochsMtx sync.Mutex
+
+// Keeps the greatest epoch received for the client.
+func recordEpoch(clientId string, epoch int64) error {
+	epochsMtx.Lock()
+	defer epochsMtx.Unlock()
+	if buf, err := state.ReadFile(epochFile(clientId)); err == nil {
+		if recorded, err := strconv.ParseInt(string(buf), 10, 64); err == nil && recorded >= epoch {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(epochFile(clientId)), 0755); err != nil {
+		return err
+	}
+	return state.WriteFile(epochFile(clientId), []byte(strconv.FormatInt(epoch, 10)))
+}
+
+func epochFile(clientId string) string {
+	return filepath.Join(Workdir, "epochs", hex.EncodeToString([]byte(clientId)))
+}
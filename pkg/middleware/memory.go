@@ -0,0 +1,394 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrNotDeclared = errors.New("not declared")
+	ErrUnknownTag  = errors.New("unknown delivery tag")
+)
+
+// MemoryBroker is an in-process Broker. It mimics the semantics of the
+// RabbitMQ topology used by the workers:
+//
+//   - Exchanges are of type `fanout', every bound queue gets a copy.
+//   - The default exchange ("") routes to the queue named by the routing key,
+//     messages for undeclared queues are dropped.
+//   - At most Prefetch deliveries per consumer are left unacknowledged, those
+//     still unacknowledged when the consumer is cancelled are requeued at the
+//     front of the queue to be redelivered in order.
+//   - Messages delivered DeliveryLimit times, or rejected, are moved to the
+//     queue's DeadLetterQueue.
+//   - Streams are published to through the default exchange and keep every
+//     message, each reader gets a copy from the offset of its choice.
+//
+// Publishing is synchronous, so there are no pending confirmations.
+type MemoryBroker struct {
+	mtx       sync.Mutex
+	exchanges map[string][]string
+	queues    map[string]*memoryQueue
+	streams   map[string]*memoryQueue
+	unacked   map[uint64]*memoryConsumer
+	lastTag   uint64
+
+	producers  producers
+	membership membershipWatch
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryQueue struct {
+	msgs []delivery
+	// closed and replaced every time the queue changes
+	changed chan struct{}
+}
+
+type memoryConsumer struct {
+	queue   *memoryQueue
+	unacked map[uint64]delivery
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: make(map[string][]string),
+		queues:    make(map[string]*memoryQueue),
+		streams:   make(map[string]*memoryQueue),
+		unacked:   make(map[uint64]*memoryConsumer),
+		closed:    make(chan struct{}),
+	}
+}
+
+// must be called with the lock held
+func (q *memoryQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (m *MemoryBroker) NewDeferredConfirmer(ctx context.Context) DeferredConfirmer {
+	return newDeferredConfirmer(ctx)
+}
+
+func (m *MemoryBroker) SetEofProducers(queue string, roles ...string) {
+	m.producers.set(queue, roles)
+}
+
+func (m *MemoryBroker) Membership() (*Membership, error) {
+	return m.membership.get(m)
+}
+
+func (m *MemoryBroker) ExchangeDeclare(name string) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.exchanges[name]; !ok {
+		m.exchanges[name] = nil
+	}
+	return name, nil
+}
+
+func (m *MemoryBroker) QueueDeclare(name string) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if name == "" {
+		name = fmt.Sprintf("amq.gen-%d", len(m.queues))
+	}
+	for _, q := range []string{name, DeadLetterQueue(name)} {
+		if _, ok := m.queues[q]; !ok {
+			m.queues[q] = &memoryQueue{changed: make(chan struct{})}
+		}
+	}
+	return name, nil
+}
+
+func (m *MemoryBroker) QueueBind(queue string, exchanges ...string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.queues[queue]; !ok {
+		return fmt.Errorf("queue %q %w", queue, ErrNotDeclared)
+	}
+	for _, exchange := range exchanges {
+		bound, ok := m.exchanges[exchange]
+		if !ok {
+			return fmt.Errorf("Failed to bind %q exchange to %q queue: %w", exchange, queue, ErrNotDeclared)
+		}
+		if !slices.Contains(bound, queue) {
+			m.exchanges[exchange] = append(bound, queue)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) StreamDeclare(name string) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.streams[name]; !ok {
+		m.streams[name] = &memoryQueue{changed: make(chan struct{})}
+	}
+	return name, nil
+}
+
+// Exchanges bound to the queue.
+func (m *MemoryBroker) boundTo(queue string) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var exchanges []string
+	for exchange, bound := range m.exchanges {
+		if slices.Contains(bound, queue) {
+			exchanges = append(exchanges, exchange)
+		}
+	}
+	return exchanges
+}
+
+func (m *MemoryBroker) Publish(ctx context.Context, c Confirmer, exchange, key string, body []byte) error {
+	select {
+	case <-m.closed:
+		return ErrMiddleware
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	default:
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	targets := []string{key}
+	if s, ok := m.streams[key]; ok && exchange == "" {
+		s.msgs = append(s.msgs, delivery{body: slices.Clone(body), key: key})
+		s.notify()
+		return nil
+	} else if exchange != "" {
+		bound, ok := m.exchanges[exchange]
+		if !ok {
+			return fmt.Errorf("exchange %q %w", exchange, ErrNotDeclared)
+		}
+		targets = bound
+	}
+	for _, name := range targets {
+		q, ok := m.queues[name]
+		if !ok {
+			continue
+		}
+		q.msgs = append(q.msgs, delivery{body: slices.Clone(body), key: key})
+		q.notify()
+	}
+	return nil
+}
+
+// Bodies are kept in-process as they are, never compressed.
+func (m *MemoryBroker) BatchSize() int {
+	return MaxMessageSize
+}
+
+func (m *MemoryBroker) Ack(tag uint64) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	c, ok := m.unacked[tag]
+	if !ok {
+		return fmt.Errorf("%w: tag=%d", ErrUnknownTag, tag)
+	}
+	delete(m.unacked, tag)
+	delete(c.unacked, tag)
+	c.queue.notify()
+	return nil
+}
+
+// Sends the delivery to the queue's dead letter queue, if there is one.
+// Must be called with the lock held.
+func (m *MemoryBroker) deadLetter(queue string, d delivery, reason string) {
+	dlq, ok := m.queues[DeadLetterQueue(queue)]
+	if !ok {
+		return
+	}
+	d.headers = map[string]any{
+		ReasonHeader:     reason,
+		RoutingKeyHeader: d.key,
+	}
+	d.key, d.tag, d.deliveries = queue, 0, 0
+	dlq.msgs = append(dlq.msgs, d)
+	dlq.notify()
+}
+
+// Sends the delivery to the dead letter queue of the queue it was consumed
+// from, with `reason' in its ReasonHeader, and acknowledges it.
+func (m *MemoryBroker) Reject(ctx context.Context, d Delivery, reason string) error {
+	if err := recordRejected(d); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	m.deadLetter(d.queue, delivery{body: d.body, key: d.key}, reason)
+	m.mtx.Unlock()
+	return m.Ack(d.Tag)
+}
+
+func (m *MemoryBroker) consume(ctx context.Context, name string) (<-chan delivery, error) {
+	m.mtx.Lock()
+	q, ok := m.queues[name]
+	m.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("queue %q %w", name, ErrNotDeclared)
+	}
+
+	c := &memoryConsumer{q, make(map[uint64]delivery)}
+	ch := make(chan delivery)
+	go func() {
+		defer close(ch)
+		defer m.cancel(c)
+		for {
+			m.mtx.Lock()
+			if len(q.msgs) > 0 && len(c.unacked) < Prefetch {
+				d := q.msgs[0]
+				q.msgs = q.msgs[1:]
+				if d.deliveries >= DeliveryLimit {
+					m.deadLetter(name, d, "delivery_limit")
+					m.mtx.Unlock()
+					continue
+				}
+				d.deliveries++
+				d.redelivered = d.deliveries > 1
+				m.lastTag++
+				d.tag = m.lastTag
+				c.unacked[d.tag] = d
+				m.unacked[d.tag] = c
+				m.mtx.Unlock()
+				select {
+				case ch <- d:
+					continue
+				case <-ctx.Done():
+					return
+				case <-m.closed:
+					return
+				}
+			}
+			changed := q.changed
+			m.mtx.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			case <-m.closed:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// requeues the consumer's unacknowledged deliveries
+func (m *MemoryBroker) cancel(c *memoryConsumer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	tags := make([]uint64, 0, len(c.unacked))
+	for tag := range c.unacked {
+		tags = append(tags, tag)
+		delete(m.unacked, tag)
+	}
+	slices.Sort(tags)
+	redelivered := make([]delivery, 0, len(tags)+len(c.queue.msgs))
+	for _, tag := range tags {
+		d := c.unacked[tag]
+		d.tag = 0
+		redelivered = append(redelivered, d)
+	}
+	c.queue.msgs = append(redelivered, c.queue.msgs...)
+	c.unacked = nil
+	c.queue.notify()
+}
+
+func (m *MemoryBroker) Consume(ctx context.Context, name string) (<-chan Client, error) {
+	aborts, err := subscribeAborts(ctx, m, name)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := m.consume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := m.Membership()
+	if err != nil {
+		return nil, err
+	}
+	required := m.producers.required(ctx, ms, name)
+	return demuxClients(ctx, m, name, required, func() []string { return m.boundTo(name) }, msgs, aborts), nil
+}
+
+func (m *MemoryBroker) Subscribe(ctx context.Context, name string) (<-chan []byte, error) {
+	msgs, err := m.consume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return subscribe(m, msgs), nil
+}
+
+func (m *MemoryBroker) ReadStream(ctx context.Context, name string, offset int64) (<-chan []byte, error) {
+	m.mtx.Lock()
+	s, ok := m.streams[name]
+	m.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("stream %q %w", name, ErrNotDeclared)
+	}
+
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		for {
+			m.mtx.Lock()
+			if offset < int64(len(s.msgs)) {
+				body := s.msgs[offset].body
+				m.mtx.Unlock()
+				select {
+				case ch <- body:
+					offset++
+					continue
+				case <-ctx.Done():
+					return
+				case <-m.closed:
+					return
+				}
+			}
+			changed := s.changed
+			m.mtx.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			case <-m.closed:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (m *MemoryBroker) WaitReady(ctx context.Context, workers int) error {
+	ms, err := m.Membership()
+	if err != nil {
+		return err
+	}
+	return ms.WaitMembers(ctx, workers)
+}
+
+func (m *MemoryBroker) Ready(ctx context.Context, workerId string) error {
+	if _, err := m.StreamDeclare(MembershipStream); err != nil {
+		return err
+	}
+	return Register(ctx, m, workerId)
+}
+
+// `workerId' should be a unique identifier for the worker, like the queue from
+// which it consumes messages.
+func (m *MemoryBroker) EOF(ctx context.Context, exchange, workerId, clientId string, sent MessageCounter, peers ...string) error {
+	return publishEOF(ctx, m, exchange, workerId, clientId, sent, peers)
+}
+
+func (m *MemoryBroker) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+}
@@ -2,14 +2,12 @@ package middleware
 
 import (
 	"context"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sync"
 
-	"github.com/franciscopereira987/tp1-distribuidos/pkg/middleware/id"
-	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/duplicates"
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/utils"
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -28,80 +26,130 @@ var (
 type Client struct {
 	Id string
 	Ch <-chan Delivery
+	// see Context()
+	aborted <-chan struct{}
+	// see Resume()
+	resume chan<- *duplicates.DuplicateFilter
+	// of its stream, removed by Context()'s cancel if aborted
+	dir string
 }
 
 type Delivery struct {
+	Envelope
+	// Payload, without the Envelope
 	Msg []byte
 	Tag uint64
+
+	queue string
+	key   string
+	// the whole message, dead-lettered as is
+	body []byte
+	// by its client's stream, see recordRejected()
+	counted bool
 }
 
 type Middleware struct {
+	url string
+	// ContentEncoding to publish with, see compress()
+	encoding string
+
+	// conn, ch and gen are replaced on every reconnection
+	mtx  sync.RWMutex
 	conn *amqp.Connection
 	ch   *amqp.Channel
-
-	eofCount map[string]int
+	gen  uint64
+	// closed and replaced after each reconnection
+	reconnected chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+
+	topology   topology
+	producers  producers
+	membership membershipWatch
 }
 
 type Confirmer interface {
 	Confirm(context.Context) error
-	AddWithContext(context.Context, *amqp.DeferredConfirmation) error
+	AddWithContext(context.Context, *Confirmation) error
 }
 
 type DeferredConfirmer struct {
-	newConfirms  chan<- *amqp.DeferredConfirmation
+	newConfirms  chan<- *Confirmation
 	waitConfirms chan<- struct{}
 	errs         <-chan error
 }
 
-func Dial(url string) (*Middleware, error) {
+// Connects to the server at `url', publishing bodies compressed with
+// `encoding' (NoCompression or Deflate).
+func Dial(url, encoding string) (*Middleware, error) {
+	if err := checkEncoding(encoding); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(Workdir, 0755); err != nil {
 		return nil, err
 	}
-	conn, err := amqp.Dial(url)
+	conn, ch, err := connect(url)
 	if err != nil {
 		return nil, err
 	}
 
+	m := &Middleware{
+		url:         url,
+		encoding:    encoding,
+		conn:        conn,
+		ch:          ch,
+		reconnected: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go m.watch(conn, ch)
+
+	return m, nil
+}
+
+// Opens a connection along with a channel in confirm mode.
+func connect(url string) (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ch, err := conn.Channel()
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	if err := ch.Confirm(false); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	if err := ch.Qos(Prefetch, 0, false); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &Middleware{
-		conn:     conn,
-		ch:       ch,
-		eofCount: make(map[string]int),
-	}, nil
+	return conn, ch, nil
 }
 
 func (m *Middleware) NewDeferredConfirmer(ctx context.Context) DeferredConfirmer {
-	newConfirms := make(chan *amqp.DeferredConfirmation)
+	return newDeferredConfirmer(ctx)
+}
+
+func newDeferredConfirmer(ctx context.Context) DeferredConfirmer {
+	newConfirms := make(chan *Confirmation)
 	waitConfirms := make(chan struct{})
 	errs := make(chan error)
 
 	go func() {
-		var confirmations []*amqp.DeferredConfirmation
+		var confirmations []*Confirmation
 		for {
 			select {
-			case dc := <-newConfirms:
-				confirmations = append(confirmations, dc)
+			case c := <-newConfirms:
+				confirmations = append(confirmations, c)
 			case <-waitConfirms:
-				for i, dc := range confirmations {
-					if ack, err := dc.WaitContext(ctx); err != nil {
+				for i, c := range confirmations {
+					if err := c.Wait(ctx); err != nil {
 						errs <- err
 						return
-					} else if !ack {
-						errs <- fmt.Errorf("%w: tag=%d", ErrNack, dc.DeliveryTag)
-						return
 					}
 					confirmations[i] = nil
 				}
@@ -132,24 +180,40 @@ func (c DeferredConfirmer) Confirm(ctx context.Context) error {
 	}
 }
 
-func (c DeferredConfirmer) AddWithContext(ctx context.Context, dc *amqp.DeferredConfirmation) error {
+func (c DeferredConfirmer) AddWithContext(ctx context.Context, pc *Confirmation) error {
 	select {
-	case c.newConfirms <- dc:
+	case c.newConfirms <- pc:
 		return nil
 	case <-ctx.Done():
 		return context.Cause(ctx)
 	}
 }
 
-func (m *Middleware) SetExpectedEofCount(queue string, count int) {
-	m.eofCount[queue] = count
+// Consumers of `queue' wait for an EOF from every member with any of the
+// given roles at the client's epoch, see Membership.
+func (m *Middleware) SetEofProducers(queue string, roles ...string) {
+	m.producers.set(queue, roles)
+}
+
+// Registry of the workers, read from the MembershipStream.
+func (m *Middleware) Membership() (*Membership, error) {
+	return m.membership.get(m)
 }
 
 // Declares a `fanout' exchange. These are meant for EOF or `fanout' messages.
 // If you need to send a message directly to a queue use the default exchange
 // with the desired queue's name as routing key.
 func (m *Middleware) ExchangeDeclare(name string) (string, error) {
-	return name, m.ch.ExchangeDeclare(
+	ch, _, _ := m.channel()
+	err := exchangeDeclare(ch, name)
+	if err == nil {
+		m.topology.addExchange(name)
+	}
+	return name, err
+}
+
+func exchangeDeclare(ch *amqp.Channel, name string) error {
+	return ch.ExchangeDeclare(
 		name,     // name
 		"fanout", // type
 		true,     // durable
@@ -170,229 +234,307 @@ func QueueName(worker, id string) (string, error) {
 }
 
 func (m *Middleware) QueueDeclare(name string) (string, error) {
-	q, err := m.ch.QueueDeclare(
+	ch, _, _ := m.channel()
+	q, err := queueDeclare(ch, name)
+	if isQueueTypeMismatch(err) {
+		return "", fmt.Errorf("%w: %q, see MigrateQueue(): %s", ErrClassicQueue, name, err)
+	} else if err != nil {
+		return "", err
+	}
+	m.topology.addQueue(q)
+
+	return q, err
+}
+
+func queueDeclare(ch *amqp.Channel, name string) (string, error) {
+	if err := deadLetterDeclare(ch, name); err != nil {
+		return "", err
+	}
+	q, err := ch.QueueDeclare(
+		name,                 // name
+		true,                 // durable
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		deadLetterArgs(name), // arguments
+	)
+	return q.Name, err
+}
+
+// Declares an append-only stream, published to through the default exchange.
+// Every consumer reads it from the offset of its choice.
+func (m *Middleware) StreamDeclare(name string) (string, error) {
+	ch, _, _ := m.channel()
+	if err := streamDeclare(ch, name); err != nil {
+		return "", err
+	}
+	m.topology.addStream(name)
+	return name, nil
+}
+
+func streamDeclare(ch *amqp.Channel, name string) error {
+	_, err := ch.QueueDeclare(
 		name,  // name
 		true,  // durable
 		false, // delete when unused
 		false, // exclusive
 		false, // no-wait
-		nil,   // arguments
+		amqp.Table{amqp.QueueTypeArg: amqp.QueueTypeStream}, // arguments
 	)
-	if err != nil {
-		return "", err
-	}
-
-	return q.Name, err
+	return err
 }
 
 // Bind the specified `fanout' exchanges to the given queue.
 func (m *Middleware) QueueBind(queue string, exchanges ...string) error {
+	ch, _, _ := m.channel()
 	for _, exchange := range exchanges {
-		err := m.ch.QueueBind(
-			queue,    // queue
-			"",       // routing key
-			exchange, // exchange
-			false,
-			nil,
-		)
-		if err != nil {
+		if err := queueBind(ch, queue, exchange); err != nil {
 			return fmt.Errorf("Failed to bind %q exchange to %q queue: %w", exchange, queue, err)
 		}
+		m.topology.addBinding(queue, exchange)
 	}
 	return nil
 }
 
+func queueBind(ch *amqp.Channel, queue, exchange string) error {
+	return ch.QueueBind(
+		queue,    // queue
+		"",       // routing key
+		exchange, // exchange
+		false,
+		nil,
+	)
+}
+
+// Deliveries from a channel that was lost to a reconnection were already
+// requeued by the server, acknowledging them is a no-op.
 func (m *Middleware) Ack(tag uint64) error {
-	return m.ch.Ack(tag, false)
+	ch, gen, _ := m.channel()
+	if tagGeneration(tag) != gen {
+		log.Warnf("action: ack | result: skipped | reason: delivery from a closed channel | tag: %d", tag)
+		return nil
+	}
+	return ch.Ack(tagDelivery(tag), false)
 }
 
-func (m *Middleware) Consume(ctx context.Context, name string) (<-chan Client, error) {
-	msgs, err := m.ch.ConsumeWithContext(
+func (m *Middleware) consume(ctx context.Context, ch *amqp.Channel, name, consumer string) (<-chan amqp.Delivery, error) {
+	return ch.ConsumeWithContext(
 		ctx,
-		name,  // queue
-		"",    // consumer
-		false, // auto-ack
-		false, // exclusive
-		false, // no-local
-		false, // no-wait
-		nil,   // args
+		name,     // queue
+		consumer, // consumer
+		false,    // auto-ack
+		false,    // exclusive
+		false,    // no-local
+		false,    // no-wait
+		nil,      // args
 	)
+}
+
+// Consumes from the queue `name' across reconnections. The returned channel
+// is only closed once `ctx' is done or the Middleware is closed.
+func (m *Middleware) Consume(ctx context.Context, name string) (<-chan Client, error) {
+	ms, err := m.Membership()
+	if err != nil {
+		return nil, err
+	}
+	aborts, err := subscribeAborts(ctx, m, name)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := m.deliveries(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	required := m.producers.required(ctx, ms, name)
+	return demuxClients(ctx, m, name, required, func() []string { return m.topology.boundTo(name) }, deliveries, aborts), nil
+}
 
-	ret := make(chan Client)
-	go func(cc int) {
-		pairs := make(map[string]struct {
-			sm *state.StateManager
-			ch chan<- Delivery
-		})
-		defer func() {
-			close(ret)
-			for _, p := range pairs {
-				close(p.ch)
+// Consumes control messages from the queue `name' across reconnections, they
+// are acknowledged once received.
+func (m *Middleware) Subscribe(ctx context.Context, name string) (<-chan []byte, error) {
+	deliveries, err := m.deliveries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return subscribe(m, deliveries), nil
+}
+
+func (m *Middleware) deliveries(ctx context.Context, name string) (<-chan delivery, error) {
+	ch, gen, reconnected := m.channel()
+	msgs, err := m.consume(ctx, ch, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			for d := range msgs {
+				body, err := decompress(d.ContentEncoding, d.Body)
+				if err != nil {
+					// dead-lettered by the server
+					log.Errorf("action: decompress | result: failure | queue: %q | error: %s", name, err)
+					if err := d.Nack(false, false); err != nil {
+						log.Errorf("action: nack | result: failure | queue: %q | error: %s", name, err)
+					}
+					continue
+				}
+				deliveries <- delivery{body: body, key: d.RoutingKey, tag: packTag(gen, d.DeliveryTag), redelivered: d.Redelivered}
 			}
-		}()
-
-		for d := range msgs {
-			clientId, msg := string(d.Body[:id.Len]), d.Body[id.Len:]
-			pair, ok := pairs[clientId]
-			if !ok {
-				ch := make(chan Delivery)
-				dir := filepath.Join(Workdir, name, hex.EncodeToString(d.Body[:id.Len]))
-				pair.sm = state.NewStateManager(dir)
-				pair.ch = ch
-				pairs[clientId] = pair
-				if err := os.MkdirAll(dir, 0755); err != nil {
-					log.Errorf("action: new_client | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			for {
+				if !m.waitReconnection(ctx, reconnected) {
 					return
-				} else {
-					log.Infof("action: new_client | result: success | queue: %q | client: %x", name, clientId)
-					pair.sm.RecoverState()
 				}
-				ret <- Client{clientId, ch}
+				ch, gen, reconnected = m.channel()
+				if msgs, err = m.consume(ctx, ch, name, ""); err == nil {
+					log.Infof("action: resume_consumer | result: success | queue: %q", name)
+					break
+				}
+				log.Errorf("action: resume_consumer | result: failure | queue: %q | error: %s", name, err)
 			}
-			if d.RoutingKey == EofRoutingKey {
-				pair.sm.State[string(msg)] = true
-				if err := pair.sm.DumpState(); err != nil {
-					log.Errorf("action: store_eof | result: failure | queue: %q | worker: %s | error: %s", name, clientId, err)
-					return
+		}
+	}()
+
+	return deliveries, nil
+}
+
+func (m *Middleware) consumeStream(ctx context.Context, ch *amqp.Channel, name string, offset int64) (<-chan amqp.Delivery, error) {
+	return ch.ConsumeWithContext(
+		ctx,
+		name,                                  // queue
+		"",                                    // consumer
+		false,                                 // auto-ack
+		false,                                 // exclusive
+		false,                                 // no-local
+		false,                                 // no-wait
+		amqp.Table{"x-stream-offset": offset}, // args
+	)
+}
+
+// Reads the stream `name' from `offset' across reconnections, resuming after
+// the last message read. The returned channel is only closed once `ctx' is
+// done or the Middleware is closed.
+func (m *Middleware) ReadStream(ctx context.Context, name string, offset int64) (<-chan []byte, error) {
+	ch, _, reconnected := m.channel()
+	msgs, err := m.consumeStream(ctx, ch, name, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(chan []byte)
+	go func() {
+		defer close(ret)
+		for {
+			for d := range msgs {
+				// reading starts from the beginning of the chunk holding the
+				// offset
+				if o, ok := d.Headers["x-stream-offset"].(int64); ok && o >= offset {
+					body, err := decompress(d.ContentEncoding, d.Body)
+					if err != nil {
+						// still read, so that offsets keep matching
+						log.Errorf("action: decompress | result: failure | stream: %q | offset: %d | error: %s", name, o, err)
+						body = d.Body
+					}
+					select {
+					case ret <- body:
+					case <-ctx.Done():
+						return
+					}
+					offset = o + 1
+				}
+				if err := d.Ack(false); err != nil {
+					log.Errorf("action: ack_stream | result: failure | stream: %q | error: %s", name, err)
 				}
-				if err := m.Ack(d.DeliveryTag); err != nil {
-					log.Errorf("action: ack_eof | result: failure | queue: %q | client: %x | error: %s", name, clientId, err)
+			}
+			for {
+				if !m.waitReconnection(ctx, reconnected) {
 					return
 				}
-				if len(pair.sm.State) >= cc {
-					log.Infof("action: EOF | result: success | queue: %q | client: %x", name, clientId)
-					os.RemoveAll(filepath.Join(Workdir, name, hex.EncodeToString([]byte(clientId))))
-					close(pair.ch)
-					delete(pairs, clientId)
-				} else {
-					log.Infof("action: EOF | result: in_progress | queue: %q | client: %x", name, clientId)
+				ch, _, reconnected = m.channel()
+				if msgs, err = m.consumeStream(ctx, ch, name, offset); err == nil {
+					log.Infof("action: resume_stream | result: success | stream: %q | offset: %d", name, offset)
+					break
 				}
-			} else {
-				pair.ch <- Delivery{msg, d.DeliveryTag}
+				log.Errorf("action: resume_stream | result: failure | stream: %q | error: %s", name, err)
 			}
 		}
-		log.Error(ErrMiddleware)
-	}(m.eofCount[name])
+	}()
 
 	return ret, nil
 }
 
 func (m *Middleware) Publish(ctx context.Context, c Confirmer, exchange, key string, body []byte) error {
-	dc, err := m.ch.PublishWithDeferredConfirmWithContext(
-		ctx,
-		exchange, // exchange
-		key,      // routing key
-		false,    // mandatory
-		false,    // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "application/octet-stream",
-			Body:         body,
-		},
-	)
+	pc, err := m.newConfirmation(exchange, key, body, nil)
 	if err != nil {
 		return err
 	}
+	if err := pc.publish(ctx); err != nil {
+		return err
+	}
 
-	return c.AddWithContext(ctx, dc)
+	return c.AddWithContext(ctx, pc)
 }
 
-func (m *Middleware) WaitReady(ctx context.Context, name string, workers int) error {
-	msgs, err := m.ch.ConsumeWithContext(
-		ctx,
-		name,    // queue
-		"ready", // consumer
-		false,   // auto-ack
-		false,   // exclusive
-		false,   // no-local
-		false,   // no-wait
-		nil,     // args
-	)
+// Size batches are to be made up to, greater if they are compressed.
+func (m *Middleware) BatchSize() int {
+	return batchSize(m.encoding)
+}
+
+// Waits until there are at least `workers' members.
+func (m *Middleware) WaitReady(ctx context.Context, workers int) error {
+	ms, err := m.Membership()
 	if err != nil {
 		return err
 	}
-
-	if _, err := os.Stat(filepath.Join(Workdir, "ready")); err == nil {
-		return nil
-	}
-	workersReady := make(map[string]bool)
-	for d := range msgs {
-		if workersReady != nil {
-			workersReady[string(d.Body)] = true
-		}
-		if len(workersReady) == workers {
-			if err := m.ch.Cancel("ready", false); err != nil {
-				return err
-			}
-			workersReady = nil
-		}
-		if workersReady == nil {
-			if err := os.WriteFile(filepath.Join(Workdir, "ready"), nil, 0640); err != nil {
-				return err
-			}
-			if err := d.Ack(true); err != nil {
-				return err
-			}
-		}
-	}
-
-	if workersReady != nil {
-		return ErrMiddleware
-	} else {
-		return nil
-	}
+	return ms.WaitMembers(ctx, workers)
 }
 
 type BasicConfirmer struct {
-	dc *amqp.DeferredConfirmation
+	pc *Confirmation
 }
 
 func (bc BasicConfirmer) Confirm(ctx context.Context) error {
-	ack, err := bc.dc.WaitContext(ctx)
-	if err == nil && !ack {
-		err = fmt.Errorf("%w: tag=%d", ErrNack, bc.dc.DeliveryTag)
+	if bc.pc == nil {
+		return nil
 	}
-	return err
+	return bc.pc.Wait(ctx)
 }
 
-func (bc *BasicConfirmer) AddWithContext(ctx context.Context, dc *amqp.DeferredConfirmation) error {
-	bc.dc = dc
+func (bc *BasicConfirmer) AddWithContext(ctx context.Context, pc *Confirmation) error {
+	bc.pc = pc
 	return nil
 }
 
-func (bc *BasicConfirmer) Publish(ctx context.Context, m *Middleware, exchange, key string, body []byte) error {
+func (bc *BasicConfirmer) Publish(ctx context.Context, m Broker, exchange, key string, body []byte) error {
+	bc.pc = nil
 	if err := m.Publish(ctx, bc, exchange, key, body); err != nil {
 		return err
 	}
 	return bc.Confirm(ctx)
 }
 
-// `workerId' should be a unique identifier for the worker, like the queue from
-// which it consumes messages.
-func (m *Middleware) Ready(ctx context.Context, key, workerId string) error {
-	var bc BasicConfirmer
-	if _, err := os.Stat(filepath.Join(Workdir, "ready")); err == nil {
-		return nil
-	}
-	if err := bc.Publish(ctx, m, "", key, []byte(workerId)); err != nil {
+// Registers the worker as a member, see Register(). Registering again after a
+// restart is harmless.
+func (m *Middleware) Ready(ctx context.Context, workerId string) error {
+	if _, err := m.StreamDeclare(MembershipStream); err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(Workdir, "ready"), nil, 0640)
+	return Register(ctx, m, workerId)
 }
 
 // `workerId' should be a unique identifier for the worker, like the queue from
 // which it consumes messages.
-func (m *Middleware) EOF(ctx context.Context, exchange, workerId, clientId string) error {
-	var bc BasicConfirmer
-	log.Infof("sending EOF into exchange %q", exchange)
-	msg := append([]byte(clientId), workerId...)
-	return bc.Publish(ctx, m, exchange, EofRoutingKey, msg)
+func (m *Middleware) EOF(ctx context.Context, exchange, workerId, clientId string, sent MessageCounter, peers ...string) error {
+	return publishEOF(ctx, m, exchange, workerId, clientId, sent, peers)
 }
 
 func (m *Middleware) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 	// the corresponding Channel is closed along with the Connection
 	m.conn.Close()
 	log.Info("closed rabbitMQ Connection")
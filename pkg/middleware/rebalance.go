@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebalancing of the routes sharded by a KeyGenerator when a node joins a
+// sink:
+//
+//  1. The node declares an exchange named after its queue, bound to it, and
+//     announces itself with Join().
+//  2. Producers grow their rings to include it. The first time a client's
+//     routes are sharded with a bigger ring, a Handoff is sent to every node
+//     of the sink before the batches.
+//  3. Nodes hand off the routes they no longer own, both the ones stored for
+//     the client and the ones still arriving, to their new owners.
+//  4. Routes only ever move to nodes with a greater number, each node waits
+//     for a HandoffEOF from every node before it that may hand off routes to
+//     it, and sends its own once it is done with the client.
+const (
+	RebalanceExchange    = "rebalance"
+	HandoffRoutingKey    = "handoff"
+	HandoffEofRoutingKey = "handoff-eof"
+)
+
+var ErrNotSharded = errors.New("queue name is not <sink>.<node>")
+
+// Announces that `node' is up to take its share of the routes of `sink'.
+func Join(ctx context.Context, b Broker, sink string, node int) error {
+	var bc BasicConfirmer
+	msg := bytes.NewBuffer(nil)
+	if err := typing.WriteString(msg, sink); err != nil {
+		return err
+	}
+	binary.Write(msg, binary.LittleEndian, uint32(node))
+	log.Infof("action: join | sink: %q | node: %d", sink, node)
+	return bc.Publish(ctx, b, RebalanceExchange, "", msg.Bytes())
+}
+
+func UnmarshalJoin(msg []byte) (sink string, node int, err error) {
+	r := bytes.NewReader(msg)
+	sink, err = typing.ReadString(r)
+	var v uint32
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &v)
+	}
+	return sink, int(v), err
+}
+
+// Splits a queue name made by QueueName() into its sink and node.
+func ParseQueueName(queue string) (string, int, error) {
+	i := strings.LastIndexByte(queue, '.')
+	if i < 0 {
+		return "", 0, fmt.Errorf("%w: %q", ErrNotSharded, queue)
+	}
+	node, err := strconv.Atoi(queue[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %q", ErrNotSharded, queue)
+	}
+	return queue[:i], node, nil
+}
+
+// Handoff tells a node that a producer now shards the client's routes among
+// `To' nodes instead of `From'.
+type Handoff struct {
+	From, To int
+	// Nodes whose HandoffEOF the receiver has to wait for
+	Peers []string
+}
+
+// A producer switching the client from `from' to `to' nodes sends this to
+// `node'.
+func NewHandoff(sink string, node, from, to int) Handoff {
+	h := Handoff{From: from, To: to}
+	if node > from {
+		for peer := 1; peer < node; peer++ {
+			h.Peers = append(h.Peers, fmt.Sprintf("%s.%d", sink, peer))
+		}
+	}
+	return h
+}
+
+func (h Handoff) Marshal(b *bytes.Buffer) error {
+	binary.Write(b, binary.LittleEndian, uint32(h.From))
+	binary.Write(b, binary.LittleEndian, uint32(h.To))
+	binary.Write(b, binary.LittleEndian, uint32(len(h.Peers)))
+	for _, peer := range h.Peers {
+		if err := typing.WriteString(b, peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handoff) Unmarshal(r *bytes.Reader) error {
+	var from, to, n uint32
+	err := binary.Read(r, binary.LittleEndian, &from)
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &to)
+	}
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &n)
+	}
+	h.From, h.To, h.Peers = int(from), int(to), nil
+	for ; err == nil && n > 0; n-- {
+		var peer string
+		if peer, err = typing.ReadString(r); err == nil {
+			h.Peers = append(h.Peers, peer)
+		}
+	}
+	return err
+}
+
+// Whether the delivery is a Handoff rather than a batch.
+func (d Delivery) IsHandoff() bool {
+	return d.Type == HandoffPayload
+}
+
+// Handoffs keeps track of the Handoff messages received by a node for a
+// client.
+type Handoffs struct {
+	sink string
+	node int
+	kg   KeyGenerator
+	// nodes the HandoffEOF has to be sent to
+	to []int
+}
+
+// `workerId' is the node's queue name.
+func NewHandoffs(workerId string) (*Handoffs, error) {
+	sink, node, err := ParseQueueName(workerId)
+	return &Handoffs{sink: sink, node: node, to: []int{}}, err
+}
+
+func (hs *Handoffs) RemoveFromState(stateMan *state.StateManager) {
+	stateMan.Remove("ring")
+	stateMan.Remove("handoff-to")
+}
+
+func (hs *Handoffs) AddToState(stateMan *state.StateManager) {
+	if !hs.Rebalanced() {
+		return
+	}
+	stateMan.State["ring"] = hs.kg.Nodes()
+	stateMan.State["handoff-to"] = hs.to
+}
+
+func HandoffsFromState(stateMan *state.StateManager, workerId string) (*Handoffs, error) {
+	hs, err := NewHandoffs(workerId)
+	if err != nil {
+		return hs, err
+	}
+	nodes, err := stateMan.GetInt("ring")
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			err = nil
+		}
+		return hs, err
+	}
+	hs.kg = NewKeyGenerator(nodes)
+	hs.to, err = stateMan.GetIntSlice("handoff-to")
+	return hs, err
+}
+
+// Whether a Handoff was received for the client.
+func (hs *Handoffs) Rebalanced() bool {
+	return hs.kg.Ring != nil
+}
+
+// Returns whether the ring grew, so that the routes no longer owned have to
+// be handed off.
+func (hs *Handoffs) Update(h Handoff) bool {
+	for k := max(h.From, hs.node) + 1; k <= h.To; k++ {
+		if !slices.Contains(hs.to, k) {
+			hs.to = append(hs.to, k)
+		}
+	}
+	if hs.Rebalanced() && hs.kg.Nodes() >= h.To {
+		return false
+	}
+	hs.kg = NewKeyGenerator(h.To)
+	return true
+}
+
+// Node owning the route, 0 if it's this one or the client's routes were
+// never rebalanced.
+func (hs *Handoffs) Owner(route string) int {
+	if !hs.Rebalanced() {
+		return 0
+	}
+	if node := hs.kg.Node(route); node != hs.node {
+		return node
+	}
+	return 0
+}
+
+// Exchange through which batches are handed off to `node'.
+func (hs *Handoffs) Exchange(node int) string {
+	return fmt.Sprintf("%s.%d", hs.sink, node)
+}
+
+// Nodes that wait for a HandoffEOF from this one.
+func (hs *Handoffs) Peers() []string {
+	peers := make([]string, 0, len(hs.to))
+	for _, node := range hs.to {
+		peers = append(peers, hs.Exchange(node))
+	}
+	return peers
+}
+
+// Sends a HandoffEOF to every node that waits for this one.
+func (hs *Handoffs) EOF(ctx context.Context, b Broker, workerId, clientId string, sent MessageCounter) error {
+	var bc BasicConfirmer
+	epoch, err := eofEpoch(b, clientId)
+	if err != nil {
+		return err
+	}
+	msg, err := marshalEOF(clientId, workerId, HandoffEofPayload, eofMessage{epoch: epoch, sent: sent})
+	if err != nil {
+		return err
+	}
+	for _, peer := range hs.Peers() {
+		if err := bc.Publish(ctx, b, peer, HandoffEofRoutingKey, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandoffBatches publishes the records handed off to each node, through a
+// BatchPublisher per node sharing the same header, so that each node gets
+// batches of up to the broker's BatchSize() with the given payload type.
+//
+// Full batches are published as records are added, the rest by Flush(). The
+// header and the batches sent are then to be stored along with the state
+// before confirming them, a crash in between results in the same batches
+// being published again, with the same headers.
+type HandoffBatches struct {
+	hs       *Handoffs
+	b        Broker
+	c        Confirmer
+	clientId string
+	t        PayloadType
+	// moved past every batch published
+	h          *typing.BatchHeader
+	sent       MessageCounter
+	publishers map[int]*BatchPublisher
+	published  map[int]int
+}
+
+func (hs *Handoffs) NewBatches(b Broker, c Confirmer, clientId string, t PayloadType, h *typing.BatchHeader, sent MessageCounter) *HandoffBatches {
+	return &HandoffBatches{
+		hs:         hs,
+		b:          b,
+		c:          c,
+		clientId:   clientId,
+		t:          t,
+		h:          h,
+		sent:       sent,
+		publishers: make(map[int]*BatchPublisher),
+		published:  make(map[int]int),
+	}
+}
+
+// Appends the record marshalled by `marshal' to the batch of `node', as
+// BatchPublisher.Add() does.
+func (hb *HandoffBatches) Add(ctx context.Context, node int, marshal func(*bytes.Buffer) error) error {
+	p, ok := hb.publishers[node]
+	if !ok {
+		exchange := hb.hs.Exchange(node)
+		p = NewBatchPublisher(hb.b, hb.clientId, hb.t, hb.h, hb.sent, func() (string, string) {
+			hb.published[node]++
+			return exchange, exchange
+		}).WithConfirmer(hb.c)
+		hb.publishers[node] = p
+	}
+	return p.Add(ctx, marshal)
+}
+
+// Publishes the batches not yet full.
+func (hb *HandoffBatches) Flush(ctx context.Context) error {
+	for node, p := range hb.publishers {
+		if err := p.Flush(ctx); err != nil {
+			return err
+		}
+		log.Infof("action: handoff | client: %x | node: %d | batches: %d", hb.clientId, node, hb.published[node])
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/connection"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery tags handed to the workers carry the generation of the channel
+// they were received from in their upper bits.
+const tagGenerationShift = 48
+
+func packTag(gen, tag uint64) uint64 {
+	return gen<<tagGenerationShift | tag
+}
+
+func tagGeneration(tag uint64) uint64 {
+	return tag >> tagGenerationShift
+}
+
+func tagDelivery(tag uint64) uint64 {
+	return tag & (1<<tagGenerationShift - 1)
+}
+
+// Every exchange, queue and binding declared through the Middleware, so as to
+// redeclare them after reconnecting.
+type topology struct {
+	mtx       sync.Mutex
+	exchanges []string
+	queues    []string
+	streams   []string
+	bindings  [][2]string
+}
+
+func (t *topology) addExchange(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !slices.Contains(t.exchanges, name) {
+		t.exchanges = append(t.exchanges, name)
+	}
+}
+
+func (t *topology) addQueue(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !slices.Contains(t.queues, name) {
+		t.queues = append(t.queues, name)
+	}
+}
+
+func (t *topology) addStream(name string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !slices.Contains(t.streams, name) {
+		t.streams = append(t.streams, name)
+	}
+}
+
+func (t *topology) addBinding(queue, exchange string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	binding := [2]string{queue, exchange}
+	if !slices.Contains(t.bindings, binding) {
+		t.bindings = append(t.bindings, binding)
+	}
+}
+
+// Exchanges bound to the queue.
+func (t *topology) boundTo(queue string) []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	var exchanges []string
+	for _, b := range t.bindings {
+		if b[0] == queue {
+			exchanges = append(exchanges, b[1])
+		}
+	}
+	return exchanges
+}
+
+func (t *topology) declare(ch *amqp.Channel) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, name := range t.exchanges {
+		if err := exchangeDeclare(ch, name); err != nil {
+			return err
+		}
+	}
+	for _, name := range t.queues {
+		if _, err := queueDeclare(ch, name); err != nil {
+			return err
+		}
+	}
+	for _, name := range t.streams {
+		if err := streamDeclare(ch, name); err != nil {
+			return err
+		}
+	}
+	for _, b := range t.bindings {
+		if err := queueBind(ch, b[0], b[1]); err != nil {
+			return fmt.Errorf("Failed to bind %q exchange to %q queue: %w", b[1], b[0], err)
+		}
+	}
+	return nil
+}
+
+// Returns the current channel, its generation and a channel that is closed
+// once it gets replaced.
+func (m *Middleware) channel() (*amqp.Channel, uint64, <-chan struct{}) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.ch, m.gen, m.reconnected
+}
+
+// Blocks until the channel of the generation associated with `reconnected' is
+// replaced. Returns false if `ctx' is done or the Middleware was closed first.
+func (m *Middleware) waitReconnection(ctx context.Context, reconnected <-chan struct{}) bool {
+	select {
+	case <-reconnected:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-m.closed:
+		return false
+	}
+}
+
+// Watches the connection and its channel, reconnecting with backoff when
+// either of them is closed by anything other than Close().
+func (m *Middleware) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		}
+		select {
+		case <-m.closed:
+			return
+		default:
+		}
+		log.Errorf("action: connection_lost | result: reconnecting | reason: %s", reason)
+		conn.Close()
+
+		for timer := connection.NewBackoff(); ; timer.Backoff() {
+			select {
+			case <-m.closed:
+				return
+			case <-timer.Wait():
+			}
+			var err error
+			if conn, ch, err = m.reconnect(); err == nil {
+				break
+			}
+			log.Errorf("action: reconnect | result: failure | error: %s", err)
+		}
+		log.Info("action: reconnect | result: success")
+	}
+}
+
+func (m *Middleware) reconnect() (*amqp.Connection, *amqp.Channel, error) {
+	conn, ch, err := connect(m.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.topology.declare(ch); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	select {
+	case <-m.closed:
+		conn.Close()
+		return nil, nil, ErrMiddleware
+	default:
+	}
+	m.conn, m.ch = conn, ch
+	m.gen++
+	close(m.reconnected)
+	m.reconnected = make(chan struct{})
+
+	return conn, ch, nil
+}
+
+// Confirmation tracks a publishing until the server confirms it. Publishings
+// lost along with their channel are published again once reconnected, which
+// may result in duplicated messages.
+type Confirmation struct {
+	m        *Middleware
+	exchange string
+	key      string
+	body     []byte
+	encoding string
+	headers  amqp.Table
+
+	dc  *amqp.DeferredConfirmation
+	gen uint64
+}
+
+// The body is compressed once, it's published as is on every retry.
+func (m *Middleware) newConfirmation(exchange, key string, body []byte, headers amqp.Table) (*Confirmation, error) {
+	body, encoding, err := compress(m.encoding, body)
+	if err != nil {
+		return nil, err
+	}
+	return &Confirmation{m: m, exchange: exchange, key: key, body: body, encoding: encoding, headers: headers}, nil
+}
+
+func (pc *Confirmation) publish(ctx context.Context) error {
+	for {
+		ch, gen, reconnected := pc.m.channel()
+		dc, err := ch.PublishWithDeferredConfirmWithContext(
+			ctx,
+			pc.exchange, // exchange
+			pc.key,      // routing key
+			false,       // mandatory
+			false,       // immediate
+			amqp.Publishing{
+				DeliveryMode:    amqp.Persistent,
+				ContentType:     "application/octet-stream",
+				ContentEncoding: pc.encoding,
+				Headers:         pc.headers,
+				Body:            pc.body,
+			},
+		)
+		if err == nil {
+			pc.dc, pc.gen = dc, gen
+			return nil
+		} else if !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		if !pc.m.waitReconnection(ctx, reconnected) {
+			return ErrMiddleware
+		}
+	}
+}
+
+// Waits for the server to confirm the publishing.
+func (pc *Confirmation) Wait(ctx context.Context) error {
+	if pc == nil || pc.dc == nil {
+		return nil
+	}
+	for {
+		ack, err := pc.dc.WaitContext(ctx)
+		if err != nil || ack {
+			return err
+		}
+		if ch, gen, _ := pc.m.channel(); gen == pc.gen && !ch.IsClosed() {
+			return fmt.Errorf("%w: tag=%d", ErrNack, pc.dc.DeliveryTag)
+		}
+		log.Warnf("action: publish | result: retrying | reason: channel closed | exchange: %q | key: %q", pc.exchange, pc.key)
+		if err := pc.publish(ctx); err != nil {
+			return err
+		}
+	}
+}
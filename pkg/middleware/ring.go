@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// Points each node takes in the Ring.
+const VirtualNodes = 64
+
+// Ring is a consistent hash ring of nodes numbered from 1. Each node takes
+// VirtualNodes points in it so that adding a node only moves to it about
+// 1/nodes of the keys, leaving the rest with their previous owner.
+type Ring struct {
+	nodes  int
+	points []uint32
+	owners map[uint32]int
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func NewRing(nodes int) *Ring {
+	r := &Ring{
+		nodes:  nodes,
+		points: make([]uint32, 0, nodes*VirtualNodes),
+		owners: make(map[uint32]int, nodes*VirtualNodes),
+	}
+	for node := 1; node <= nodes; node++ {
+		for v := 0; v < VirtualNodes; v++ {
+			p := hashKey(strconv.Itoa(node) + "#" + strconv.Itoa(v))
+			// on collision, the point stays with the lowest node
+			if _, ok := r.owners[p]; !ok {
+				r.owners[p] = node
+				r.points = append(r.points, p)
+			}
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+func (r *Ring) Nodes() int {
+	return r.nodes
+}
+
+// Node owning the key, the first one clockwise from it.
+func (r *Ring) Node(key string) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	i, _ := slices.BinarySearch(r.points, hashKey(key))
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -3,66 +3,103 @@ package middleware
 import (
 	"errors"
 	"fmt"
-	"hash/fnv"
 
 	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
 )
 
-type KeyGenerator int
+var ErrNoShards = errors.New("no shards to deal keys to")
 
-func NewKeyGenerator(mod int) KeyGenerator {
-	return KeyGenerator(mod)
+// KeyGenerator shards routes among the nodes of a sink through a consistent
+// hash Ring.
+type KeyGenerator struct {
+	*Ring
+}
+
+func NewKeyGenerator(nodes int) KeyGenerator {
+	return KeyGenerator{NewRing(nodes)}
 }
 
 func ShardKey(id string) string {
 	return id
 }
 
-func (kg KeyGenerator) KeyFrom(sink, origin, destination string) string {
-	h := fnv.New32()
-
-	h.Write([]byte(origin))
-	h.Write([]byte("."))
-	h.Write([]byte(destination))
+// Key identifying a route, also used to name its files.
+func RouteKey(origin, destination string) string {
+	return origin + "." + destination
+}
 
-	v := h.Sum32()%uint32(kg) + 1
+func (kg KeyGenerator) KeyFrom(sink, origin, destination string) string {
+	return fmt.Sprintf("%s.%d", sink, kg.Node(RouteKey(origin, destination)))
+}
 
-	return fmt.Sprintf("%s.%d", sink, v)
+// Every node of the KeyGenerator.
+func (kg KeyGenerator) shards() []int {
+	shards := make([]int, kg.Nodes())
+	for i := range shards {
+		shards[i] = i + 1
+	}
+	return shards
 }
 
 func (kg KeyGenerator) NewRoundRobinKeysGenerator() RoundRobinKeysGenerator {
-	return RoundRobinKeysGenerator{
-		mod:   int(kg),
-		index: 0,
-	}
+	return NewRoundRobin(kg.shards())
 }
 
+// RoundRobinKeysGenerator deals keys to the given shards in turns, they don't
+// have to be every node of the sink, see Membership.Shards().
 type RoundRobinKeysGenerator struct {
-	mod   int
-	index int
+	shards []int
+	index  int
+}
+
+func NewRoundRobin(shards []int) RoundRobinKeysGenerator {
+	return RoundRobinKeysGenerator{
+		shards: shards,
+		index:  0,
+	}
 }
 
 func (rr *RoundRobinKeysGenerator) NextKey(sink string) string {
-	v := rr.index + 1
-	rr.index = v % rr.mod
+	v := rr.shards[rr.index]
+	rr.index = (rr.index + 1) % len(rr.shards)
 	return fmt.Sprintf("%s.%d", sink, v)
 }
 
 func (rr RoundRobinKeysGenerator) RemoveFromState(stateMan *state.StateManager) {
 	stateMan.Remove("rr-index")
+	stateMan.Remove("rr-shards")
 }
 
 func (rr RoundRobinKeysGenerator) AddToState(stateMan *state.StateManager) {
 	stateMan.State["rr-index"] = rr.index
+	stateMan.State["rr-shards"] = rr.shards
 }
 
 func RoundRobinFromState(stateMan *state.StateManager, kg KeyGenerator) (RoundRobinKeysGenerator, error) {
+	return RoundRobinFromShards(stateMan, kg.shards())
+}
+
+// The shards stored take precedence over the given ones, so that a client
+// keeps being dealt to the same shards.
+func RoundRobinFromShards(stateMan *state.StateManager, shards []int) (RoundRobinKeysGenerator, error) {
 	index, err := stateMan.GetInt("rr-index")
 	if err != nil && errors.Is(err, state.ErrNotFound) {
 		err = nil
 	}
+	if err != nil {
+		return RoundRobinKeysGenerator{}, err
+	}
+	stored, err := stateMan.GetIntSlice("rr-shards")
+	if err == nil {
+		shards = stored
+	} else if !errors.Is(err, state.ErrNotFound) {
+		return RoundRobinKeysGenerator{}, err
+	}
+	if len(shards) == 0 {
+		return RoundRobinKeysGenerator{}, ErrNoShards
+	}
 	return RoundRobinKeysGenerator{
-		mod:   int(kg),
-		index: index,
-	}, err
+		shards: shards,
+		index:  index % len(shards),
+	}, nil
 }
@@ -20,8 +20,10 @@ func SplitRecord(record []byte) (int, []byte, error) {
 		return 0, nil, fmt.Errorf("%w: tag=%q", ErrNotQueryResult, head)
 	}
 
+	// results of the 4 queries, followed by the rejects summary and the
+	// flights rejected
 	tag := int(head[0] - '0')
-	if tag > 0 && tag < 5 {
+	if tag > 0 && tag < 7 {
 		return tag, tail, nil
 	}
 
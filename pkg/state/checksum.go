@@ -0,0 +1,126 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the header written by WriteTmp(), files with any other can't be
+// read.
+const FileFormatVersion = 1
+
+// Every file written by WriteTmp() starts with a header:
+//
+//	version | checksum
+//
+// where the checksum is the CRC-32C of the rest of the file.
+const fileHeaderLen = 5
+
+// Suffix of the previous generation of a state file, kept by Commit() to
+// recover from if the current one is lost.
+const PrevSuffix = ".prev"
+
+// Directory under the workdir given to RecoverStateFiles() where clients whose
+// state couldn't be recovered are moved to.
+const QuarantineDir = "quarantine"
+
+var (
+	ErrFormat    = errors.New("unsupported state file format")
+	ErrCorrupted = errors.New("corrupted state file")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Number of state files found corrupted, and of client directories moved to
+// quarantine, published along with the rest of the process' expvars. No
+// listener serves them, they're logged by the workers' GC whenever they
+// change.
+var (
+	CorruptedFiles = expvar.NewInt("state_corrupted_files")
+	Quarantined    = expvar.NewInt("state_quarantined_clients")
+)
+
+func fileHeader(p []byte) []byte {
+	header := make([]byte, fileHeaderLen)
+	header[0] = FileFormatVersion
+	binary.LittleEndian.PutUint32(header[1:], crc32.Checksum(p, castagnoli))
+	return header
+}
+
+// Reads a file written by WriteTmp(), checking its header.
+func ReadFile(filename string) ([]byte, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < fileHeaderLen {
+		CorruptedFiles.Add(1)
+		return nil, fmt.Errorf("%w: %s: %d bytes", ErrCorrupted, filename, len(buf))
+	}
+	if buf[0] != FileFormatVersion {
+		return nil, fmt.Errorf("%w: %s: version %d", ErrFormat, filename, buf[0])
+	}
+	p := buf[fileHeaderLen:]
+	if binary.LittleEndian.Uint32(buf[1:]) != crc32.Checksum(p, castagnoli) {
+		CorruptedFiles.Add(1)
+		return nil, fmt.Errorf("%w: %s: checksum mismatch", ErrCorrupted, filename)
+	}
+	return p, nil
+}
+
+// Moves the current generation of `filename' to its PrevSuffix before linking
+// the temporary file in its place. A crash in between leaves the previous
+// generation alone, which is the one committed.
+func linkGeneration(tmp, filename string) error {
+	if err := os.Rename(filename, filename+PrevSuffix); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return err
+	}
+	return LinkTmp(tmp, filename)
+}
+
+// Reads the current generation of `filename', or the previous one if it's
+// missing. If `fallback' the previous one is read as well if the current one
+// is corrupted.
+func readGeneration(filename string, fallback bool) ([]byte, error) {
+	buf, err := ReadFile(filename)
+	switch {
+	case err == nil:
+		return buf, nil
+	case os.IsNotExist(err):
+		buf, errPrev := ReadFile(filename + PrevSuffix)
+		if os.IsNotExist(errPrev) {
+			return nil, err
+		}
+		return buf, errPrev
+	case errors.Is(err, ErrCorrupted) && fallback:
+		log.Errorf("action: read_state | result: failure | file: %s | error: %s | falling back to the previous generation", filename, err)
+		buf, errPrev := ReadFile(filename + PrevSuffix)
+		if errPrev != nil {
+			return nil, errors.Join(err, errPrev)
+		}
+		return buf, nil
+	default:
+		return nil, err
+	}
+}
+
+// Moves the client's directory out of the way, so that its state is kept for
+// inspection rather than overwritten by the next run.
+func quarantine(workdir, dir string, cause error) {
+	Quarantined.Add(1)
+	dst := filepath.Join(workdir, QuarantineDir, filepath.Base(dir))
+	log.Errorf("action: recover_state | result: failure | dir: %s | error: %s | moving it to %s", dir, cause, dst)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		log.Errorf("action: quarantine | result: failure | dir: %s | error: %s", dir, err)
+	} else if err := os.Rename(dir, dst); err != nil {
+		log.Errorf("action: quarantine | result: failure | dir: %s | error: %s", dir, err)
+	}
+}
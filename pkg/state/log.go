@@ -0,0 +1,348 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const LogFileName = "state.log"
+
+// Size the log may grow up to before it's compacted into a snapshot of the
+// whole state, stored in the manager's Filename.
+const CompactSize = 1 << 20
+
+// Length and checksum preceding every frame of the log.
+const frameHeaderLen = 8
+
+var ErrLog = errors.New("corrupted state log")
+
+// Change to a value of the state, a nil Value removes it.
+type logOp struct {
+	Keys  []string        `json:"k"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+// The log holds a frame for every commit, with the changes made to the state
+// since the previous one:
+//
+//	length | checksum | ops
+//
+// where the checksum is the CRC-32C of the ops, marshalled as JSON. Top level
+// values are compared against their last committed encoding to tell whether
+// they changed, except for the maps made with NewMap(), whose entries are only
+// logged when changed through Add() and Remove().
+type stateLog struct {
+	filename  string
+	size      int64
+	committed map[string][]byte
+	maps      map[string]uintptr
+	dirty     [][]string
+	// whether to snapshot the state on the next commit
+	compact bool
+	// whether to leave a torn frame in place when recovering
+	readOnly bool
+
+	// changes to apply once committed
+	frame     []byte
+	snapshot  bool
+	nextEnc   map[string][]byte
+	nextMaps  map[string]uintptr
+	nextDirty int
+}
+
+func newStateLog(workdir string) *stateLog {
+	return &stateLog{
+		filename:  filepath.Join(workdir, LogFileName),
+		committed: make(map[string][]byte),
+		maps:      make(map[string]uintptr),
+	}
+}
+
+// Same as NewStateManager(), but Prepare() and Commit() append the changes to
+// a log rather than dumping the whole state. Nested maps have to be made with
+// NewMap() and modified through Add() and Remove() for their changes to be
+// logged.
+func NewLogStateManager(workdir string) *StateManager {
+	sw := NewStateManager(workdir)
+	sw.log = newStateLog(workdir)
+	return sw
+}
+
+func (l *stateLog) touch(keys []string) {
+	if len(keys) > 1 {
+		l.dirty = append(l.dirty, append([]string(nil), keys...))
+	}
+}
+
+func mapId(v any) (uintptr, bool) {
+	if m, ok := v.(map[string]any); ok {
+		return reflect.ValueOf(m).Pointer(), true
+	}
+	return 0, false
+}
+
+// Changes to the state since the last commit.
+func (l *stateLog) diff(state map[string]any) ([]logOp, error) {
+	var ops []logOp
+	l.nextEnc = make(map[string][]byte, len(state))
+	l.nextMaps = make(map[string]uintptr)
+	replaced := make(map[string]bool)
+	for key, value := range state {
+		if id, ok := mapId(value); ok {
+			l.nextMaps[key] = id
+			if l.maps[key] == id {
+				continue
+			}
+			replaced[key] = true
+		}
+		enc, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.nextMaps[key]; !ok {
+			l.nextEnc[key] = enc
+			if bytes.Equal(l.committed[key], enc) {
+				continue
+			}
+		}
+		ops = append(ops, logOp{Keys: []string{key}, Value: enc})
+	}
+	for key := range l.committed {
+		if _, ok := state[key]; !ok {
+			ops = append(ops, logOp{Keys: []string{key}})
+		}
+	}
+	for key := range l.maps {
+		if _, ok := state[key]; !ok {
+			ops = append(ops, logOp{Keys: []string{key}})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, keys := range l.dirty {
+		path := strings.Join(keys, "\x00")
+		if seen[path] || replaced[keys[0]] {
+			continue
+		}
+		seen[path] = true
+		if _, ok := l.nextMaps[keys[0]]; !ok {
+			// removed or replaced by a value compared as a whole
+			continue
+		}
+		op := logOp{Keys: keys}
+		if value, ok := lookup(state, keys); ok {
+			enc, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			op.Value = enc
+		}
+		ops = append(ops, op)
+	}
+	l.nextDirty = len(l.dirty)
+	return ops, nil
+}
+
+func lookup(m map[string]any, keys []string) (any, bool) {
+	for _, key := range keys[:len(keys)-1] {
+		if m, _ = m[key].(map[string]any); m == nil {
+			return nil, false
+		}
+	}
+	v, ok := m[keys[len(keys)-1]]
+	return v, ok
+}
+
+// Frames the changes to the state, and snapshots it as a whole as well if the
+// log grew too large.
+func (l *stateLog) prepare(sw *StateManager) error {
+	ops, err := l.diff(sw.State)
+	if err != nil {
+		return err
+	}
+	l.frame, l.snapshot = nil, false
+	if len(ops) == 0 && !l.compact {
+		return nil
+	}
+	if len(ops) > 0 {
+		payload, err := json.Marshal(ops)
+		if err != nil {
+			return err
+		}
+		l.frame = make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+		binary.LittleEndian.PutUint32(l.frame, uint32(len(payload)))
+		binary.LittleEndian.PutUint32(l.frame[4:], crc32.Checksum(payload, castagnoli))
+		l.frame = append(l.frame, payload...)
+		if !l.compact && l.size+int64(len(l.frame)) <= CompactSize {
+			return nil
+		}
+	}
+	buf, err := json.Marshal(sw.State)
+	if err != nil {
+		return err
+	}
+	if sw.tmp, err = WriteTmp(sw.Filename, buf); err == nil {
+		l.snapshot = true
+	}
+	return err
+}
+
+func (l *stateLog) commit(sw *StateManager) error {
+	if l.frame != nil {
+		if err := l.append(); err != nil {
+			return err
+		}
+	}
+	if l.snapshot {
+		// frames set values rather than change them, so replaying them
+		// all over the snapshot, if the truncation doesn't make it, leaves
+		// it as it is as long as the last one is among them
+		if err := linkGeneration(sw.tmp, sw.Filename); err != nil {
+			return err
+		}
+		if err := os.Truncate(l.filename, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.applied()
+	return nil
+}
+
+func (l *stateLog) append() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(l.frame); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Takes the changes prepared as committed, once written by commit() or a Tx.
+func (l *stateLog) applied() {
+	switch {
+	case l.snapshot:
+		l.size, l.compact = 0, false
+	case l.frame != nil:
+		l.size += int64(len(l.frame))
+	}
+	l.committed, l.maps = l.nextEnc, l.nextMaps
+	l.dirty = l.dirty[l.nextDirty:]
+	l.frame, l.snapshot, l.nextDirty = nil, false, 0
+}
+
+// Replays the log over the snapshot, if any. A torn frame at the end, left by
+// a crash while committing, is truncated.
+func (l *stateLog) recover(sw *StateManager) error {
+	// the log may have been truncated since the previous snapshot, it's not
+	// to be replayed over it unless the current one is missing
+	if err := sw.recoverSnapshot(false); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(l.filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		ops, n, err := readFrame(f)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warnf("action: recover_log | file: %s | offset: %d | error: %s", l.filename, offset, err)
+			if l.readOnly {
+				break
+			}
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += n
+		for _, op := range ops {
+			if err := apply(sw.State, op); err != nil {
+				return err
+			}
+		}
+	}
+	l.size = offset
+	return nil
+}
+
+// Caches the encoding of the recovered state.
+func (l *stateLog) reset(state map[string]any) error {
+	l.committed = make(map[string][]byte, len(state))
+	l.maps = make(map[string]uintptr)
+	l.dirty = nil
+	for key, value := range state {
+		if id, ok := mapId(value); ok {
+			l.maps[key] = id
+			continue
+		}
+		enc, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		l.committed[key] = enc
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) ([]logOp, int64, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrLog, err)
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrLog, err)
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", ErrLog)
+	}
+	var ops []logOp
+	if err := json.Unmarshal(payload, &ops); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrLog, err)
+	}
+	return ops, int64(len(header) + len(payload)), nil
+}
+
+func apply(state map[string]any, op logOp) error {
+	m := state
+	for _, key := range op.Keys[:len(op.Keys)-1] {
+		if m, _ = m[key].(map[string]any); m == nil {
+			// removed along with its parent later on
+			return nil
+		}
+	}
+	key := op.Keys[len(op.Keys)-1]
+	if op.Value == nil {
+		delete(m, key)
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(op.Value))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("%w: %s", ErrLog, err)
+	}
+	m[key] = value
+	return nil
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestLogCompactReplay(t *testing.T) {
+	workdir := t.TempDir()
+	sm := NewLogStateManager(workdir)
+	for i := 1; i <= 3; i++ {
+		sm.State["n"] = i
+		sm.State["m"] = i * 10
+		if err := sm.DumpState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// compacted, with a crash before truncating the log
+	sm.State["n"] = 4
+	sm.log.compact = true
+	if err := sm.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if !sm.log.snapshot {
+		t.Fatal("Prepare() didn't snapshot the state")
+	}
+	if err := sm.log.append(); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkGeneration(sm.tmp, sm.Filename); err != nil {
+		t.Fatal(err)
+	}
+
+	sm = NewLogStateManager(workdir)
+	if err := sm.RecoverState(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]int{"n": 4, "m": 30} {
+		if v, err := sm.GetInt(key); err != nil || v != want {
+			t.Errorf("%s: got %d, %v, want %d", key, v, err, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Keys the schema of the state is stored under.
+const (
+	SchemaKey        = "schema"
+	SchemaVersionKey = "schema-version"
+)
+
+var (
+	ErrSchemaName       = errors.New("state stored by another type of worker")
+	ErrSchemaVersion    = errors.New("state stored by a newer version")
+	ErrMissingMigration = errors.New("missing state migration")
+)
+
+// Migration reshapes the state stored at a version of its schema into the
+// layout of the next one.
+type Migration func(state map[string]any) error
+
+// Schema of the state stored by a type of worker. Bumping its version along
+// with a change to the layout of the state, and registering the migration
+// from the previous one, lets the new version recover the clients in flight.
+//
+// States stored before their schema was versioned are at version 1.
+type Schema struct {
+	Name       string
+	Version    int
+	migrations map[int]Migration
+}
+
+func NewSchema(name string, version int) *Schema {
+	return &Schema{
+		Name:       name,
+		Version:    version,
+		migrations: make(map[int]Migration),
+	}
+}
+
+// Registers the migration from version `from' to the next one.
+func (s *Schema) Register(from int, m Migration) *Schema {
+	s.migrations[from] = m
+	return s
+}
+
+// Stores the schema along with the state, and migrates the state recovered
+// to its version.
+func (sw *StateManager) WithSchema(s *Schema) *StateManager {
+	sw.schema = s
+	return sw
+}
+
+func (s *Schema) addToState(state map[string]any) {
+	state[SchemaKey] = s.Name
+	state[SchemaVersionKey] = s.Version
+}
+
+// Migrates the recovered state, returns whether it was changed.
+func (s *Schema) migrate(sw *StateManager) (bool, error) {
+	if name, err := Get[string](sw, SchemaKey); err == nil && name != s.Name {
+		return false, fmt.Errorf("%w: %q, expected %q", ErrSchemaName, name, s.Name)
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	version, err := Get[int](sw, SchemaVersionKey)
+	if errors.Is(err, ErrNotFound) {
+		version = 1
+	} else if err != nil {
+		return false, err
+	}
+	if version > s.Version {
+		return false, fmt.Errorf("%w: %s version %d, expected %d", ErrSchemaVersion, s.Name, version, s.Version)
+	}
+
+	for v := version; v < s.Version; v++ {
+		m, ok := s.migrations[v]
+		if !ok {
+			return false, fmt.Errorf("%w: %s version %d to %d", ErrMissingMigration, s.Name, v, v+1)
+		}
+		if err := m(sw.State); err != nil {
+			return false, fmt.Errorf("migrating %s state from version %d to %d: %w", s.Name, v, v+1, err)
+		}
+	}
+	s.addToState(sw.State)
+	return version != s.Version, nil
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -17,8 +18,6 @@ const StateFileName = "state.json"
 var (
 	ErrNotFound = errors.New("key not found")
 	ErrNotMap   = errors.New("object is not a map")
-	ErrNotSlice = errors.New("object is not a slice")
-	ErrNaN      = errors.New("object is not a number")
 )
 
 /*
@@ -31,6 +30,9 @@ type StateManager struct {
 	Filename string
 	State    map[string]any
 	tmp      string
+	// nil unless made with NewLogStateManager()
+	log    *stateLog
+	schema *Schema
 }
 
 func NewStateManager(workdir string) *StateManager {
@@ -46,6 +48,9 @@ func (sw *StateManager) NewMap(keys ...string) {
 		m = m[key].(map[string]any)
 	}
 	m[keys[len(keys)-1]] = make(map[string]any)
+	if sw.log != nil {
+		sw.log.touch(keys)
+	}
 }
 
 func (sw *StateManager) Add(value any, keys ...string) {
@@ -54,6 +59,9 @@ func (sw *StateManager) Add(value any, keys ...string) {
 		m = m[key].(map[string]any)
 	}
 	m[keys[len(keys)-1]] = value
+	if sw.log != nil {
+		sw.log.touch(keys)
+	}
 }
 
 func (sw *StateManager) Remove(keys ...string) {
@@ -62,6 +70,9 @@ func (sw *StateManager) Remove(keys ...string) {
 		m = m[key].(map[string]any)
 	}
 	delete(m, keys[len(keys)-1])
+	if sw.log != nil {
+		sw.log.touch(keys)
+	}
 }
 
 func getJsonMap(m map[string]any, keys ...string) (map[string]any, error) {
@@ -77,100 +88,33 @@ func getJsonMap(m map[string]any, keys ...string) (map[string]any, error) {
 	return m, nil
 }
 
-func (sw *StateManager) getNumber(keys ...string) (json.Number, error) {
-	m, err := getJsonMap(sw.State, keys[:len(keys)-1]...)
-	if err != nil {
-		return "", err
-	}
-
-	v, ok := m[keys[len(keys)-1]]
-	if !ok {
-		key := strings.Join(keys, ".")
-		return "", fmt.Errorf("%w: state[%s]", ErrNotFound, key)
-	}
-	num, ok := v.(json.Number)
-	if !ok {
-		key := strings.Join(keys, ".")
-		return "", fmt.Errorf("%w: state[%s]=%v", ErrNaN, key, v)
-	}
-	return num, nil
-}
-
 func (sw *StateManager) GetInt64(keys ...string) (int64, error) {
-	num, err := sw.getNumber(keys...)
-	if err != nil {
-		return 0, err
-	}
-	return num.Int64()
+	return Get[int64](sw, keys...)
 }
 
 func (sw *StateManager) GetInt(keys ...string) (int, error) {
-	n, err := sw.GetInt64(keys...)
-	return int(n), err
+	return Get[int](sw, keys...)
 }
 
 func (sw *StateManager) GetFloat(keys ...string) (float64, error) {
-	num, err := sw.getNumber(keys...)
-	if err != nil {
-		return 0, err
-	}
-	return num.Float64()
+	return Get[float64](sw, keys...)
 }
 
 func (sw *StateManager) GetMapStringInt64(keys ...string) (map[string]int64, error) {
-	m, err := getJsonMap(sw.State, keys...)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := make(map[string]int64)
-	for key, value := range m {
-		v, ok := value.(json.Number)
-		if !ok {
-			key := strings.Join(keys, ".")
-			return nil, fmt.Errorf("%w: state[%s]=%v", ErrNaN, key, v)
-		}
-		ret[key], err = v.Int64()
-		if err != nil {
-			return nil, err
-		}
-	}
-	return ret, nil
+	return Get[map[string]int64](sw, keys...)
 }
 
 func (sw *StateManager) GetIntSlice(keys ...string) ([]int, error) {
-	m, err := getJsonMap(sw.State, keys[:len(keys)-1]...)
-	if err != nil {
-		return nil, err
-	}
-
-	v, ok := m[keys[len(keys)-1]]
-	if !ok {
-		key := strings.Join(keys, ".")
-		return nil, fmt.Errorf("%w: state[%s]", ErrNotFound, key)
-	}
-	slice, ok := v.([]any)
-	if !ok {
-		key := strings.Join(keys, ".")
-		return nil, fmt.Errorf("%w: state[%s]=%v", ErrNotSlice, key, v)
-	}
-	ret := make([]int, 0, len(slice))
-	for i, value := range slice {
-		v, ok := value.(json.Number)
-		if !ok {
-			key := strings.Join(keys, ".")
-			return nil, fmt.Errorf("%w: state[%s][%d]=%v", ErrNaN, key, i, v)
-		}
-		num, err := v.Int64()
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, int(num))
-	}
-	return ret, nil
+	return Get[[]int](sw, keys...)
 }
 
 func (sw *StateManager) Prepare() error {
+	if sw.schema != nil {
+		sw.schema.addToState(sw.State)
+	}
+	if sw.log != nil {
+		return sw.log.prepare(sw)
+	}
 	buf, err := json.Marshal(sw.State)
 	if err != nil {
 		return err
@@ -182,8 +126,11 @@ func (sw *StateManager) Prepare() error {
 	return err
 }
 
-func (sw StateManager) Commit() error {
-	return LinkTmp(sw.tmp, sw.Filename)
+func (sw *StateManager) Commit() error {
+	if sw.log != nil {
+		return sw.log.commit(sw)
+	}
+	return linkGeneration(sw.tmp, sw.Filename)
 }
 
 func (sw *StateManager) DumpState() error {
@@ -195,19 +142,47 @@ func (sw *StateManager) DumpState() error {
 }
 
 func (sw *StateManager) RecoverState() error {
-	file, err := os.Open(sw.Filename)
+	var err error
+	if sw.log != nil {
+		err = sw.log.recover(sw)
+	} else {
+		err = sw.recoverSnapshot(true)
+	}
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	dec := json.NewDecoder(file)
-	dec.UseNumber()
-	if err = dec.Decode(&sw.State); err == nil {
-		log.Infof("recovered state: %v", sw.State)
+	migrated := false
+	if sw.schema != nil {
+		if migrated, err = sw.schema.migrate(sw); err != nil {
+			return err
+		}
+	}
+	if sw.log != nil {
+		if err := sw.log.reset(sw.State); err != nil {
+			return err
+		}
+		if migrated {
+			// changes made in place to nested maps are not tracked
+			sw.log.compact = true
+		}
 	}
+	log.Infof("recovered state: %v", sw.State)
+	return nil
+}
 
-	return err
+// Decodes the last state committed, see readGeneration().
+func (sw *StateManager) recoverSnapshot(fallback bool) error {
+	buf, err := readGeneration(sw.Filename, fallback)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&sw.State); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupted, sw.Filename, err)
+	}
+	return nil
 }
 
 type recovered struct {
@@ -228,7 +203,13 @@ type recovered struct {
 //	│   └── state.json
 //	└── a9e48a18
 //	    └── state.json
-func RecoverStateFiles(workdir string) []recovered {
+//
+// States kept by NewLogStateManager() are recovered along with their
+// state.log, with the same backend. Every state is migrated to the given
+// schema, which may be nil for states not versioned. Directories whose state can't be
+// recovered are moved to the QuarantineDir. A Tx left in a directory is finished
+// before recovering its state, see RecoverTx().
+func RecoverStateFiles(workdir string, schema *Schema) []recovered {
 	subdirs, _ := os.ReadDir(workdir)
 	rec := make([]recovered, 0, len(subdirs))
 
@@ -241,17 +222,42 @@ func RecoverStateFiles(workdir string) []recovered {
 			continue
 		}
 		dirName := filepath.Join(workdir, dir.Name())
-		if _, err := os.Stat(filepath.Join(dirName, StateFileName)); os.IsNotExist(err) {
+		if _, err := RecoverTx(dirName); err != nil {
+			quarantine(workdir, dirName, err)
 			continue
 		}
 		state := NewStateManager(dirName)
-		if err := state.RecoverState(); err == nil {
-			rec = append(rec, recovered{string(id), dirName, state})
+		if exists(filepath.Join(dirName, LogFileName)) {
+			state = NewLogStateManager(dirName)
+		} else if !exists(state.Filename) && !exists(state.Filename+PrevSuffix) {
+			continue
+		}
+		state.WithSchema(schema)
+		if err := state.RecoverState(); err != nil {
+			quarantine(workdir, dirName, err)
+			continue
 		}
+		rec = append(rec, recovered{string(id), dirName, state})
 	}
 	return rec
 }
 
+// Recovers the state stored in the workdir as it is, with the backend it was
+// stored with and without migrating it, so as to inspect it.
+func Inspect(workdir string) (*StateManager, error) {
+	sw := NewStateManager(workdir)
+	if exists(filepath.Join(workdir, LogFileName)) {
+		sw = NewLogStateManager(workdir)
+		sw.log.readOnly = true
+	}
+	return sw, sw.RecoverState()
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
 // given a /path/to/file, create and return a temporary file
 // in /path/to/tmp/file to be renamed later using LinkTmp()
 func CreateTmp(filename string) (*os.File, error) {
@@ -274,7 +280,8 @@ func LinkTmp(oldpath, newpath string) error {
 	return err
 }
 
-// writes a temporary file to link it later with LinkTmp()
+// writes a temporary file to link it later with LinkTmp(), preceded by a
+// header to check it with when read with ReadFile()
 func WriteTmp(filename string, p []byte) (string, error) {
 	f, err := CreateTmp(filename)
 	if err != nil {
@@ -282,6 +289,9 @@ func WriteTmp(filename string, p []byte) (string, error) {
 	}
 	defer f.Close()
 
+	if _, err = f.Write(fileHeader(p)); err != nil {
+		return "", err
+	}
 	if _, err = f.Write(p); err != nil {
 		return "", err
 	}
@@ -0,0 +1,382 @@
+package state
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Store keeps values under keys, like the data of every route, without a file
+// for each. Changes are staged and made durable together by Commit(), they
+// are not seen until then.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Size(key string) (int64, bool)
+	Keys() []string
+	Put(key string, value []byte)
+	Append(key string, value []byte)
+	// Truncate only shrinks values.
+	Truncate(key string, size int64)
+	Delete(key string)
+	Commit() error
+	Close() error
+}
+
+// Operations logged by the SegmentStore.
+const (
+	_ byte = iota
+	putOp
+	appendOp
+	truncateOp
+	deleteOp
+)
+
+// Size of the data in a SegmentStore no longer referenced, as in overwritten
+// or deleted, from which it's compacted if it's larger than the live data.
+const StoreCompactSize = 1 << 20
+
+var ErrStore = errors.New("corrupted store")
+
+// Part of a value, stored at `offset' in the file.
+type extent struct {
+	offset int64
+	size   int64
+}
+
+// A staged op holds its value, a recovered one the offset of its value in the
+// file.
+type storeOp struct {
+	op     byte
+	key    string
+	value  []byte
+	offset int64
+	size   int64
+}
+
+// SegmentStore is a Store kept in a single file, a log with a frame for every
+// commit:
+//
+//	length | checksum | ops
+//
+// where the checksum is the CRC-32C of the ops, each one being
+//
+//	op | key length | key | value length | value
+//
+// lengths being uvarints, truncations carrying the size and no value and
+// deletions neither. Values are made up of the extents of the file they were
+// put and appended in, indexed in memory. The file is rewritten with just the
+// live values once most of it is no longer referenced.
+type SegmentStore struct {
+	filename string
+	f        *os.File
+	size     int64
+	index    map[string][]extent
+	staged   []storeOp
+	// whether to leave a torn frame in place when recovering
+	readOnly bool
+}
+
+// Opens the store kept in `filename', creating it if missing. A torn frame at
+// the end, left by a crash while committing, is truncated.
+func OpenSegmentStore(filename string) (*SegmentStore, error) {
+	return openSegmentStore(filename, false)
+}
+
+// Opens the store as it is, so as to inspect it.
+func InspectSegmentStore(filename string) (*SegmentStore, error) {
+	return openSegmentStore(filename, true)
+}
+
+func openSegmentStore(filename string, readOnly bool) (*SegmentStore, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{filename: filename, f: f, readOnly: readOnly}
+	if err := s.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SegmentStore) recover() error {
+	s.index = make(map[string][]extent)
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, 1<<62))
+	var offset int64
+	for {
+		ops, n, err := readStoreFrame(r, offset)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warnf("action: recover_store | file: %s | offset: %d | error: %s", s.filename, offset, err)
+			if !s.readOnly {
+				if err := s.f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		for _, op := range ops {
+			s.apply(op)
+		}
+		offset += n
+	}
+	s.size = offset
+	return nil
+}
+
+func (s *SegmentStore) apply(op storeOp) {
+	switch op.op {
+	case putOp:
+		s.index[op.key] = []extent{{op.offset, op.size}}
+	case appendOp:
+		s.index[op.key] = append(s.index[op.key], extent{op.offset, op.size})
+	case truncateOp:
+		extents, ok := s.index[op.key]
+		if !ok {
+			return
+		}
+		var size int64
+		for i, e := range extents {
+			if size+e.size >= op.size {
+				extents[i].size = op.size - size
+				s.index[op.key] = extents[:i+1]
+				return
+			}
+			size += e.size
+		}
+	case deleteOp:
+		delete(s.index, op.key)
+	}
+}
+
+func (s *SegmentStore) Get(key string) ([]byte, error) {
+	extents, ok := s.index[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, key)
+	}
+	size, _ := s.Size(key)
+	buf := make([]byte, size)
+	p := buf
+	for _, e := range extents {
+		if _, err := s.f.ReadAt(p[:e.size], e.offset); err != nil {
+			return nil, err
+		}
+		p = p[e.size:]
+	}
+	return buf, nil
+}
+
+func (s *SegmentStore) Size(key string) (int64, bool) {
+	extents, ok := s.index[key]
+	var size int64
+	for _, e := range extents {
+		size += e.size
+	}
+	return size, ok
+}
+
+// Keys in the store, sorted.
+func (s *SegmentStore) Keys() []string {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *SegmentStore) Put(key string, value []byte) {
+	s.staged = append(s.staged, storeOp{op: putOp, key: key, value: append([]byte(nil), value...)})
+}
+
+func (s *SegmentStore) Append(key string, value []byte) {
+	s.staged = append(s.staged, storeOp{op: appendOp, key: key, value: append([]byte(nil), value...)})
+}
+
+func (s *SegmentStore) Truncate(key string, size int64) {
+	s.staged = append(s.staged, storeOp{op: truncateOp, key: key, size: size})
+}
+
+func (s *SegmentStore) Delete(key string) {
+	s.staged = append(s.staged, storeOp{op: deleteOp, key: key})
+}
+
+// Appends the staged changes in a single frame, and syncs it.
+func (s *SegmentStore) Commit() error {
+	if len(s.staged) == 0 {
+		return nil
+	}
+	frame, ops := encodeStoreFrame(s.staged, s.size)
+	if _, err := s.f.WriteAt(frame, s.size); err != nil {
+		// the torn frame is overwritten by the next commit
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	return s.applied(frame, ops, len(s.staged))
+}
+
+// Indexes the frame of the first `staged' changes, once written by Commit()
+// or a Tx.
+func (s *SegmentStore) applied(frame []byte, ops []storeOp, staged int) error {
+	for _, op := range ops {
+		s.apply(op)
+	}
+	s.size += int64(len(frame))
+	s.staged = s.staged[staged:]
+	return s.maybeCompact()
+}
+
+// Frames the ops to be written at `offset', along with the ops as they'd be
+// recovered from it.
+func encodeStoreFrame(staged []storeOp, offset int64) ([]byte, []storeOp) {
+	frame := make([]byte, frameHeaderLen)
+	ops := make([]storeOp, len(staged))
+	for i, op := range staged {
+		frame = append(frame, op.op)
+		frame = binary.AppendUvarint(frame, uint64(len(op.key)))
+		frame = append(frame, op.key...)
+		ops[i] = storeOp{op: op.op, key: op.key, size: op.size}
+		switch op.op {
+		case putOp, appendOp:
+			frame = binary.AppendUvarint(frame, uint64(len(op.value)))
+			ops[i].offset = offset + int64(len(frame))
+			ops[i].size = int64(len(op.value))
+			frame = append(frame, op.value...)
+		case truncateOp:
+			frame = binary.AppendUvarint(frame, uint64(op.size))
+		}
+	}
+	payload := frame[frameHeaderLen:]
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, castagnoli))
+	return frame, ops
+}
+
+// Parses the frame at `offset' of the file.
+func readStoreFrame(r io.Reader, offset int64) ([]storeOp, int64, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrStore, err)
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrStore, err)
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", ErrStore)
+	}
+
+	var ops []storeOp
+	p := payload
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(p)
+		if n <= 0 {
+			return 0, fmt.Errorf("%w: bad length", ErrStore)
+		}
+		p = p[n:]
+		return v, nil
+	}
+	for len(p) > 0 {
+		op := storeOp{op: p[0]}
+		p = p[1:]
+		n, err := uvarint()
+		if err != nil {
+			return nil, 0, err
+		} else if n > uint64(len(p)) {
+			return nil, 0, fmt.Errorf("%w: key length %d", ErrStore, n)
+		}
+		op.key, p = string(p[:n]), p[n:]
+
+		switch op.op {
+		case putOp, appendOp:
+			if n, err = uvarint(); err != nil {
+				return nil, 0, err
+			} else if n > uint64(len(p)) {
+				return nil, 0, fmt.Errorf("%w: value length %d", ErrStore, n)
+			}
+			op.offset = offset + frameHeaderLen + int64(len(payload)-len(p))
+			op.size, p = int64(n), p[n:]
+		case truncateOp:
+			if n, err = uvarint(); err != nil {
+				return nil, 0, err
+			}
+			op.size = int64(n)
+		case deleteOp:
+		default:
+			return nil, 0, fmt.Errorf("%w: unknown op %d", ErrStore, op.op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, int64(frameHeaderLen + len(payload)), nil
+}
+
+// Rewrites the file with just the live values, if most of it isn't. The new
+// file replaces the current one at once, a crash while writing it leaves the
+// current one as it is.
+func (s *SegmentStore) maybeCompact() error {
+	var live int64
+	for key := range s.index {
+		size, _ := s.Size(key)
+		live += size
+	}
+	if dead := s.size - live; dead < StoreCompactSize || dead < live {
+		return nil
+	}
+
+	tmp, err := CreateTmp(s.filename)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	var offset int64
+	for _, key := range s.Keys() {
+		value, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		frame, _ := encodeStoreFrame([]storeOp{{op: putOp, key: key, value: value}}, offset)
+		if _, err := tmp.Write(frame); err != nil {
+			return err
+		}
+		offset += int64(len(frame))
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := LinkTmp(tmp.Name(), s.filename); err != nil {
+		return err
+	}
+	log.Debugf("action: compact_store | file: %s | size: %d | compacted: %d", s.filename, s.size, offset)
+
+	// the store is read from the new file from now on
+	f, err := os.OpenFile(s.filename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	return s.recover()
+}
+
+// Closes the file, discarding the changes not committed.
+func (s *SegmentStore) Close() error {
+	s.staged = nil
+	return s.f.Close()
+}
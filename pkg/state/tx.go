@@ -0,0 +1,370 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Directory under the workdir where a Tx stages its files.
+const TxDir = "tx"
+
+// Manifest of a Tx, its commit point.
+const txCommitFile = "COMMIT"
+
+var (
+	ErrTxDone = errors.New("transaction already committed or rolled back")
+	ErrTxPath = errors.New("file out of the transaction's workdir")
+)
+
+// How a txOp changes its file.
+const (
+	// the staged file is renamed to the path, which is removed if there's
+	// none
+	renameOp = ""
+	// same as renameOp, keeping the current file as its previous generation
+	generationOp = "generation"
+	// the staged file is written at the offset of the path, which is
+	// truncated after it
+	writeAtOp = "write-at"
+)
+
+type txOp struct {
+	// path relative to the workdir
+	Path   string `json:"path"`
+	Kind   string `json:"kind,omitempty"`
+	Staged string `json:"staged,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// Tx changes several files of a workdir all or nothing. Files are staged in
+// its TxDir until committed, when a manifest of the changes is written and
+// the changes applied. A crash before the manifest is written leaves the
+// files as they were, and one after is recovered by applying the changes
+// again with RecoverTx(). There's at most one Tx in a workdir at a time.
+//
+// Only the last change staged for each file is applied, so that applying
+// them again leaves the files as the first time. Files written are preceded
+// by the same header as WriteTmp(), they're read with ReadFile().
+type Tx struct {
+	workdir string
+	dir     string
+	ops     []txOp
+	done    bool
+	// to update once the changes staged for them are applied
+	stores map[*SegmentStore]storeFrame
+	logs   map[*StateManager]*stateLog
+}
+
+// Frame of a store staged in a Tx, made of its first `staged' changes.
+type storeFrame struct {
+	frame  []byte
+	ops    []storeOp
+	staged int
+}
+
+func NewTx(workdir string) (*Tx, error) {
+	dir := filepath.Join(workdir, TxDir)
+	// left by a previous transaction never committed
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Tx{
+		workdir: workdir,
+		dir:     dir,
+		stores:  make(map[*SegmentStore]storeFrame),
+		logs:    make(map[*StateManager]*stateLog),
+	}, nil
+}
+
+// Path of the file relative to the workdir, `filename' being either a path
+// within the workdir, as in filepath.Join(workdir, name), or relative to it.
+func (tx *Tx) rel(filename string) (string, error) {
+	workdir, path := tx.workdir, filename
+	if filepath.IsAbs(path) != filepath.IsAbs(workdir) {
+		var err error
+		if workdir, err = filepath.Abs(workdir); err != nil {
+			return "", err
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	}
+	if path, err := filepath.Rel(workdir, path); err == nil && filepath.IsLocal(path) {
+		return path, nil
+	}
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("%w: %s", ErrTxPath, filename)
+	}
+	return filepath.Clean(filename), nil
+}
+
+// Stages the file to be changed as told by `op', writing `p' if not nil.
+func (tx *Tx) stage(filename string, op txOp, p []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	path, err := tx.rel(filename)
+	if err != nil {
+		return err
+	}
+	op.Path = path
+	if p != nil {
+		op.Staged = strconv.Itoa(len(tx.ops))
+		if err := writeStaged(filepath.Join(tx.dir, op.Staged), p); err != nil {
+			return err
+		}
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func writeStaged(filename string, p []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(fileHeader(p)); err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Stages the file, `filename' being either relative to the workdir or within
+// it.
+func (tx *Tx) WriteFile(filename string, p []byte) error {
+	if p == nil {
+		p = []byte{}
+	}
+	return tx.stage(filename, txOp{Kind: renameOp}, p)
+}
+
+// Stages the removal of the file.
+func (tx *Tx) Remove(filename string) error {
+	return tx.stage(filename, txOp{Kind: renameOp}, nil)
+}
+
+// Stages the state managed, as committed by its Commit(): a new generation
+// of its snapshot, or the frame appended to its log. The manager is updated
+// once the Tx is committed, it's not to be committed on its own until then.
+func (tx *Tx) WriteState(sw *StateManager) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if sw.log == nil {
+		if sw.schema != nil {
+			sw.schema.addToState(sw.State)
+		}
+		buf, err := json.Marshal(sw.State)
+		if err != nil {
+			return err
+		}
+		return tx.stage(sw.Filename, txOp{Kind: generationOp}, buf)
+	}
+
+	l := sw.log
+	if err := sw.Prepare(); err != nil {
+		return err
+	}
+	tx.logs[sw] = l
+	switch {
+	case l.snapshot:
+		defer os.Remove(sw.tmp)
+		buf, err := ReadFile(sw.tmp)
+		if err != nil {
+			return err
+		}
+		if err := tx.stage(sw.Filename, txOp{Kind: generationOp}, buf); err != nil {
+			return err
+		}
+		// the frame is left out, the log is truncated by RecoverTx() before
+		// it's replayed over the snapshot
+		return tx.stage(l.filename, txOp{Kind: writeAtOp}, []byte{})
+	case l.frame != nil:
+		return tx.stage(l.filename, txOp{Kind: writeAtOp, Offset: l.size}, l.frame)
+	}
+	return nil
+}
+
+// Stages the changes to the store, appended to its file in a single frame as
+// by its Commit(). They're applied to the store once the Tx is committed,
+// it's not to be committed on its own until then.
+func (tx *Tx) CommitStore(s *SegmentStore) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if len(s.staged) == 0 {
+		return nil
+	}
+	frame, ops := encodeStoreFrame(s.staged, s.size)
+	if err := tx.stage(s.filename, txOp{Kind: writeAtOp, Offset: s.size}, frame); err != nil {
+		return err
+	}
+	tx.stores[s] = storeFrame{frame, ops, len(s.staged)}
+	return nil
+}
+
+// Writes the manifest and applies the changes.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	buf, err := json.Marshal(lastOps(tx.ops))
+	if err != nil {
+		return err
+	}
+	if err := WriteFile(filepath.Join(tx.dir, txCommitFile), buf); err != nil {
+		return err
+	}
+	if err := applyTx(tx.workdir, tx.dir, tx.ops); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tx.dir); err != nil {
+		return err
+	}
+	for _, l := range tx.logs {
+		l.applied()
+	}
+	// compacted once their frames are no longer to be applied again
+	for s, f := range tx.stores {
+		if err := s.applied(f.frame, f.ops, f.staged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discards the staged changes.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return os.RemoveAll(tx.dir)
+}
+
+// The last change to each file, in the order they were staged.
+func lastOps(ops []txOp) []txOp {
+	last := make(map[string]int, len(ops))
+	for i, op := range ops {
+		last[op.Path] = i
+	}
+	applied := make([]txOp, 0, len(last))
+	for i, op := range ops {
+		if last[op.Path] == i {
+			applied = append(applied, op)
+		}
+	}
+	return applied
+}
+
+// Applies the last change to each file in order. Files already renamed are
+// no longer staged and skipped, the rest of the changes are made again.
+func applyTx(workdir, dir string, ops []txOp) error {
+	for _, op := range lastOps(ops) {
+		path := filepath.Join(workdir, op.Path)
+		staged := filepath.Join(dir, op.Staged)
+		if op.Staged == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		var err error
+		switch op.Kind {
+		case renameOp:
+			err = os.Rename(staged, path)
+		case generationOp:
+			if _, err = os.Stat(staged); err == nil {
+				err = linkGeneration(staged, path)
+			}
+		case writeAtOp:
+			err = writeAt(staged, path, op.Offset)
+		default:
+			return fmt.Errorf("%w: %s: unknown change %q", ErrCorrupted, filepath.Join(dir, txCommitFile), op.Kind)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the staged file at `offset' of the file, truncating it after it.
+func writeAt(staged, filename string, offset int64) error {
+	p, err := ReadFile(staged)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(p, offset); err != nil {
+		return err
+	}
+	if err := f.Truncate(offset + int64(len(p))); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Finishes the transaction left in the workdir by a crash, if any. It's
+// applied if it was committed and rolled back otherwise, returns whether it
+// was applied.
+func RecoverTx(workdir string) (bool, error) {
+	dir := filepath.Join(workdir, TxDir)
+	committed, ops, err := pendingTx(dir)
+	if err != nil {
+		return false, err
+	} else if !committed {
+		return false, os.RemoveAll(dir)
+	}
+	log.Infof("action: recover_tx | dir: %s | changes: %d", workdir, len(ops))
+	if err := applyTx(workdir, dir, ops); err != nil {
+		return false, err
+	}
+	return true, os.RemoveAll(dir)
+}
+
+// Whether there's a transaction left in the workdir, and whether it was
+// committed, so as to inspect it.
+func PendingTx(workdir string) (pending bool, committed bool, err error) {
+	dir := filepath.Join(workdir, TxDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return false, false, nil
+	}
+	committed, _, err = pendingTx(dir)
+	return true, committed, err
+}
+
+func pendingTx(dir string) (bool, []txOp, error) {
+	buf, err := ReadFile(filepath.Join(dir, txCommitFile))
+	if os.IsNotExist(err) {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	var ops []txOp
+	if err := json.Unmarshal(buf, &ops); err != nil {
+		return false, nil, fmt.Errorf("%w: %s: %s", ErrCorrupted, filepath.Join(dir, txCommitFile), err)
+	}
+	return true, ops, nil
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Commits the Tx up to applying it, as left by a crash before removing it.
+func crashAfterApply(t *testing.T, tx *Tx) {
+	t.Helper()
+	buf, err := json.Marshal(lastOps(tx.ops))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(filepath.Join(tx.dir, txCommitFile), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyTx(tx.workdir, tx.dir, tx.ops); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxReplay(t *testing.T) {
+	workdir := filepath.Join(t.TempDir(), "client")
+	filename := filepath.Join(workdir, "a")
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(filename, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSegmentStore(filepath.Join(workdir, "store.kv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sm := NewStateManager(workdir)
+	sm.State["n"] = 1
+
+	tx, err := NewTx(workdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Append("k", []byte("v"))
+	sm.State["n"] = 2
+	for _, err := range []error{
+		tx.Remove(filename),
+		tx.WriteFile("a", []byte("new")),
+		tx.CommitStore(s),
+		tx.WriteState(sm),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashAfterApply(t, tx)
+	if applied, err := RecoverTx(workdir); err != nil || !applied {
+		t.Fatalf("RecoverTx() = %v, %v", applied, err)
+	}
+
+	if buf, err := ReadFile(filename); err != nil || string(buf) != "new" {
+		t.Errorf("a: got %q, %v, want %q", buf, err, "new")
+	}
+	recovered, err := OpenSegmentStore(filepath.Join(workdir, "store.kv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if v, err := recovered.Get("k"); err != nil || string(v) != "v" {
+		t.Errorf("store: got %q, %v, want %q", v, err, "v")
+	}
+	sm = NewStateManager(workdir)
+	if err := sm.RecoverState(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sm.GetInt("n"); err != nil || n != 2 {
+		t.Errorf("state: got %d, %v, want 2", n, err)
+	}
+}
+
+func TestTxRel(t *testing.T) {
+	tx := &Tx{workdir: filepath.Join("clients", "a")}
+	for filename, want := range map[string]string{
+		"state.json": "state.json",
+		filepath.Join("clients", "a", "state.json"):    "state.json",
+		filepath.Join("coordinates", "ATL"):            filepath.Join("coordinates", "ATL"),
+		filepath.Join("clients", "a", "tx", "..", "b"): "b",
+	} {
+		if got, err := tx.rel(filename); err != nil || got != want {
+			t.Errorf("rel(%q) = %q, %v, want %q", filename, got, err, want)
+		}
+	}
+	if _, err := tx.rel(filepath.Join("..", "b")); err == nil {
+		t.Errorf("rel(%q) succeeded out of the workdir", filepath.Join("..", "b"))
+	}
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrSchema = errors.New("state value does not match its type")
+
+// Value is a typed handle to the value stored under its keys, so that it
+// reads back the same whether it was set in this process or recovered from
+// its JSON encoding.
+type Value[T any] struct {
+	keys []string
+}
+
+func NewValue[T any](keys ...string) Value[T] {
+	return Value[T]{keys}
+}
+
+func (v Value[T]) Get(sw *StateManager) (T, error) {
+	return Get[T](sw, v.keys...)
+}
+
+// Same as Get(), but returns `def' if the value is not stored.
+func (v Value[T]) GetOr(sw *StateManager, def T) (T, error) {
+	value, err := v.Get(sw)
+	if errors.Is(err, ErrNotFound) {
+		return def, nil
+	}
+	return value, err
+}
+
+func (v Value[T]) Set(sw *StateManager, value T) {
+	sw.Add(value, v.keys...)
+}
+
+func (v Value[T]) Remove(sw *StateManager) {
+	sw.Remove(v.keys...)
+}
+
+func (v Value[T]) Exists(sw *StateManager) bool {
+	m, err := getJsonMap(sw.State, v.keys[:len(v.keys)-1]...)
+	if err != nil {
+		return false
+	}
+	_, ok := m[v.keys[len(v.keys)-1]]
+	return ok
+}
+
+// Returns the value stored under the keys as a T. Values recovered by
+// RecoverState() are decoded from JSON into it, a value that doesn't decode
+// returns ErrSchema.
+func Get[T any](sw *StateManager, keys ...string) (T, error) {
+	var ret T
+	m, err := getJsonMap(sw.State, keys[:len(keys)-1]...)
+	if err != nil {
+		return ret, err
+	}
+	key := strings.Join(keys, ".")
+	v, ok := m[keys[len(keys)-1]]
+	if !ok {
+		return ret, fmt.Errorf("%w: state[%s]", ErrNotFound, key)
+	}
+	if v, ok := v.(T); ok {
+		return v, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ret, err
+	}
+	if err := json.Unmarshal(buf, &ret); err != nil {
+		var zero T
+		return zero, fmt.Errorf("%w: state[%s]=%v: %s", ErrSchema, key, v, err)
+	}
+	return ret, nil
+}
@@ -2,7 +2,6 @@ package typing
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 )
 
@@ -12,27 +11,44 @@ const (
 )
 
 type AverageFilterFlight struct {
-	Origin      string
-	Destination string
-	Fare        float32
+	Origin      string  `rec:"startingAirport,intern"`
+	Destination string  `rec:"destinationAirport,intern"`
+	Fare        float32 `rec:"totalFare"`
 }
 
 type AverageFare struct {
-	Sum   float64
-	Count uint64
+	Sum   float64 `rec:"fareSum"`
+	Count uint64  `rec:"fareCount"`
 }
 
-func AverageFilterMarshal(b *bytes.Buffer, data *Flight) {
+var (
+	AverageFilterRecord = NewRecord[AverageFilterFlight]()
+	AverageFareRecord   = NewRecord[AverageFare]()
+)
+
+var averageFilterProjection = NewProjection[Flight](AverageFilterRecord)
+
+func AverageFilterMarshal(b *bytes.Buffer, data *Flight) error {
+	return marshalFlagged(b, averageFilterFlag, func() error {
+		return averageFilterProjection.Marshal(b, data)
+	})
+}
+
+func AverageFilterMarshalView(b *bytes.Buffer, v *View[Flight]) {
 	b.WriteByte(averageFilterFlag)
-	WriteString(b, data.Origin)
-	WriteString(b, data.Destination)
-	binary.Write(b, binary.LittleEndian, data.Fare)
+	averageFilterProjection.MarshalView(b, v)
+}
+
+func (data *AverageFilterFlight) Marshal(b *bytes.Buffer) error {
+	return marshalFlagged(b, averageFilterFlag, func() error {
+		return AverageFilterRecord.Marshal(b, data)
+	})
 }
 
-func AverageFareMarshal(b *bytes.Buffer, fareSum float64, fareCount int) {
-	b.WriteByte(averageFareFlag)
-	binary.Write(b, binary.LittleEndian, fareSum)
-	binary.Write(b, binary.LittleEndian, uint64(fareCount))
+func AverageFareMarshal(b *bytes.Buffer, fareSum float64, fareCount int) error {
+	return marshalFlagged(b, averageFareFlag, func() error {
+		return AverageFareRecord.Marshal(b, &AverageFare{Sum: fareSum, Count: uint64(fareCount)})
+	})
 }
 
 func AverageFilterUnmarshal(r *bytes.Reader) (data any, err error) {
@@ -43,31 +59,10 @@ func AverageFilterUnmarshal(r *bytes.Reader) (data any, err error) {
 
 	switch flag {
 	case averageFareFlag:
-		return avgFareUnmarshal(r)
+		return AverageFareRecord.Unmarshal(r)
 	case averageFilterFlag:
-		return avgFilterUnmarshal(r)
+		return AverageFilterRecord.Unmarshal(r)
 	default:
 		return nil, fmt.Errorf("Unknown format specifier: %d", flag)
 	}
 }
-
-func avgFilterUnmarshal(r *bytes.Reader) (data AverageFilterFlight, err error) {
-	data.Origin, err = ReadString(r)
-	if err == nil {
-		data.Destination, err = ReadString(r)
-	}
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Fare)
-	}
-
-	return data, err
-}
-
-func avgFareUnmarshal(r *bytes.Reader) (data AverageFare, err error) {
-	err = binary.Read(r, binary.LittleEndian, &data.Sum)
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Count)
-	}
-
-	return data, err
-}
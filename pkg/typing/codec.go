@@ -0,0 +1,428 @@
+package typing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrField = errors.New("invalid field")
+
+// FieldError is returned by Record.Parse() for the first field that couldn't
+// be parsed, it matches ErrField.
+type FieldError struct {
+	// CSV column of the field
+	Column string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrField, e.Column, e.Err)
+}
+
+func (e *FieldError) Is(target error) bool {
+	return target == ErrField
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type fieldKind int
+
+const (
+	bytesKind fieldKind = iota
+	stringKind
+	uint8Kind
+	uint32Kind
+	uint64Kind
+	float32Kind
+	float64Kind
+	boolKind
+)
+
+// Bytes taken by the fixed size kinds.
+var kindSizes = map[reflect.Kind]int{
+	reflect.Bool:    1,
+	reflect.Uint8:   1,
+	reflect.Uint32:  4,
+	reflect.Uint64:  8,
+	reflect.Float32: 4,
+	reflect.Float64: 8,
+}
+
+type field struct {
+	// column of the field in CSV records
+	name   string
+	goName string
+	index  int
+	kind   fieldKind
+	size   int
+	// hex encoded bytes, or a duration in minutes written in ISO 8601
+	format string
+	// digits of floats formatted, -1 for as many as needed
+	prec int
+	// parsed as zero if empty
+	optional bool
+	// read off a View through an Interner
+	intern bool
+}
+
+// Record is the layout of the records of type T, read off the `rec' tag of
+// its fields:
+//
+//	Fare float32 `rec:"totalFare,prec=2"`
+//
+// where the first value is the column of the field in CSV records, followed
+// by the options:
+//
+//	hex       [N]byte fields, parsed and formatted as hex (the default)
+//	iso8601   uint32 fields holding minutes, as in PT2H30M
+//	prec=N    digits of floats formatted, as many as needed by default
+//	optional  parsed as zero if empty
+//	intern    string fields read off a View through an Interner
+//
+// Fields are encoded in the order they're declared, strings preceded by
+// their length as in WriteString() and the rest little endian. Fields
+// without the tag are left out.
+type Record[T any] struct {
+	fields []field
+}
+
+// Builds the layout of T, panics if any field can't be encoded.
+func NewRecord[T any]() *Record[T] {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("typing.NewRecord: %s is not a struct", t))
+	}
+	r := new(Record[T])
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("rec")
+		if !ok {
+			continue
+		}
+		f, err := newField(sf, tag)
+		if err != nil {
+			panic(fmt.Sprintf("typing.NewRecord: %s.%s: %s", t, sf.Name, err))
+		}
+		f.index = i
+		r.fields = append(r.fields, f)
+	}
+	return r
+}
+
+func newField(sf reflect.StructField, tag string) (field, error) {
+	opts := strings.Split(tag, ",")
+	f := field{name: opts[0], goName: sf.Name, prec: -1}
+	switch k := sf.Type.Kind(); {
+	case k == reflect.Array && sf.Type.Elem().Kind() == reflect.Uint8:
+		f.kind, f.size, f.format = bytesKind, sf.Type.Len(), "hex"
+	case k == reflect.String:
+		f.kind = stringKind
+	case kindSizes[k] > 0:
+		f.kind = map[reflect.Kind]fieldKind{
+			reflect.Bool:    boolKind,
+			reflect.Uint8:   uint8Kind,
+			reflect.Uint32:  uint32Kind,
+			reflect.Uint64:  uint64Kind,
+			reflect.Float32: float32Kind,
+			reflect.Float64: float64Kind,
+		}[k]
+		f.size = kindSizes[k]
+	default:
+		return f, fmt.Errorf("unsupported type %s", sf.Type)
+	}
+	for _, opt := range opts[1:] {
+		switch {
+		case opt == "hex" && f.kind == bytesKind:
+		case opt == "iso8601" && f.kind == uint32Kind:
+			f.format = opt
+		case strings.HasPrefix(opt, "prec=") && (f.kind == float32Kind || f.kind == float64Kind):
+			prec, err := strconv.Atoi(strings.TrimPrefix(opt, "prec="))
+			if err != nil {
+				return f, err
+			}
+			f.prec = prec
+		case opt == "optional":
+			f.optional = true
+		case opt == "intern" && f.kind == stringKind:
+			f.intern = true
+		default:
+			return f, fmt.Errorf("unsupported option %q", opt)
+		}
+	}
+	return f, nil
+}
+
+// CSV columns of the fields.
+func (r *Record[T]) Header() []string {
+	header := make([]string, len(r.fields))
+	for i, f := range r.fields {
+		header[i] = f.name
+	}
+	return header
+}
+
+// Bounds of the size of an encoded record, as strings take from 1 byte to
+// those of one MaxStringLen long.
+func (r *Record[T]) MinSize() int {
+	return r.size(stringSize(0))
+}
+
+func (r *Record[T]) MaxSize() int {
+	return r.size(stringSize(MaxStringLen))
+}
+
+func (r *Record[T]) size(stringSize int) (n int) {
+	for _, f := range r.fields {
+		if f.kind == stringKind {
+			n += stringSize
+		} else {
+			n += f.size
+		}
+	}
+	return n
+}
+
+// Size of the encoded record.
+func (r *Record[T]) Size(v *T) (n int) {
+	rv := reflect.ValueOf(v).Elem()
+	for _, f := range r.fields {
+		if f.kind == stringKind {
+			n += StringSize(rv.Field(f.index).String())
+		} else {
+			n += f.size
+		}
+	}
+	return n
+}
+
+func (r *Record[T]) Marshal(b *bytes.Buffer, v *T) error {
+	return marshalFields(b, reflect.ValueOf(v).Elem(), r.fields, nil)
+}
+
+// Writes the fields of `rv', those at `from' if given. The buffer is left as
+// it was if any of them can't be encoded, so that no partial record is left
+// in a batch.
+func marshalFields(b *bytes.Buffer, rv reflect.Value, fields []field, from []int) error {
+	var buf [8]byte
+	n := b.Len()
+	for i, f := range fields {
+		index := f.index
+		if from != nil {
+			index = from[i]
+		}
+		fv := rv.Field(index)
+		switch f.kind {
+		case bytesKind:
+			b.Write(fv.Slice(0, f.size).Bytes())
+		case stringKind:
+			if err := WriteString(b, fv.String()); err != nil {
+				b.Truncate(n)
+				return fmt.Errorf("%s: %w", f.name, err)
+			}
+		case boolKind:
+			if fv.Bool() {
+				b.WriteByte(1)
+			} else {
+				b.WriteByte(0)
+			}
+		case uint8Kind:
+			b.WriteByte(uint8(fv.Uint()))
+		case uint32Kind:
+			b.Write(binary.LittleEndian.AppendUint32(buf[:0], uint32(fv.Uint())))
+		case uint64Kind:
+			b.Write(binary.LittleEndian.AppendUint64(buf[:0], fv.Uint()))
+		case float32Kind:
+			b.Write(binary.LittleEndian.AppendUint32(buf[:0], math.Float32bits(float32(fv.Float()))))
+		case float64Kind:
+			b.Write(binary.LittleEndian.AppendUint64(buf[:0], math.Float64bits(fv.Float())))
+		}
+	}
+	return nil
+}
+
+// Writes the flag followed by the record written by `marshal', leaving the
+// buffer as it was if it fails.
+func marshalFlagged(b *bytes.Buffer, flag byte, marshal func() error) error {
+	n := b.Len()
+	b.WriteByte(flag)
+	if err := marshal(); err != nil {
+		b.Truncate(n)
+		return err
+	}
+	return nil
+}
+
+func (r *Record[T]) Unmarshal(rd stringReader) (v T, err error) {
+	rv := reflect.ValueOf(&v).Elem()
+	var buf [8]byte
+	for _, f := range r.fields {
+		fv := rv.Field(f.index)
+		switch f.kind {
+		case bytesKind:
+			_, err = io.ReadFull(rd, fv.Slice(0, f.size).Bytes())
+		case stringKind:
+			var s string
+			if s, err = ReadString(rd); err == nil {
+				fv.SetString(s)
+			}
+		default:
+			if _, err = io.ReadFull(rd, buf[:f.size]); err != nil {
+				break
+			}
+			switch f.kind {
+			case boolKind:
+				fv.SetBool(buf[0] != 0)
+			case uint8Kind:
+				fv.SetUint(uint64(buf[0]))
+			case uint32Kind:
+				fv.SetUint(uint64(binary.LittleEndian.Uint32(buf[:])))
+			case uint64Kind:
+				fv.SetUint(binary.LittleEndian.Uint64(buf[:]))
+			case float32Kind:
+				fv.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))))
+			case float64Kind:
+				fv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(buf[:])))
+			}
+		}
+		if err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// Column of the CSV record holding the field, as found by the indices of
+// the columns of every field. Empty if the file has no such column.
+func Column(record []string, indices []int, i FieldIndex) string {
+	if indices[i] < 0 {
+		return ""
+	}
+	return record[indices[i]]
+}
+
+// Parses the fields of a CSV record, found at the given indices in the order
+// of Header(). Columns missing from the file have a negative index, and are
+// taken as empty.
+func (r *Record[T]) Parse(record []string, indices []int) (v T, err error) {
+	rv := reflect.ValueOf(&v).Elem()
+	for i, f := range r.fields {
+		s := Column(record, indices, FieldIndex(i))
+		if s == "" && f.optional {
+			continue
+		}
+		if err := parseField(rv.Field(f.index), f, s); err != nil {
+			return v, &FieldError{Column: f.name, Err: err}
+		}
+	}
+	return v, nil
+}
+
+func parseField(fv reflect.Value, f field, s string) error {
+	switch f.kind {
+	case bytesKind:
+		buf, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		} else if len(buf) != f.size {
+			return fmt.Errorf("%d bytes, expected %d", len(buf), f.size)
+		}
+		reflect.Copy(fv, reflect.ValueOf(buf))
+	case stringKind:
+		fv.SetString(s)
+	case boolKind:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case uint32Kind:
+		if f.format == "iso8601" {
+			minutes, err := ParseDuration(s)
+			fv.SetUint(uint64(minutes))
+			return err
+		}
+		fallthrough
+	case uint8Kind, uint64Kind:
+		n, err := strconv.ParseUint(s, 10, f.size*8)
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case float32Kind, float64Kind:
+		x, err := strconv.ParseFloat(s, f.size*8)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(x)
+	}
+	return nil
+}
+
+// Formats the fields as a CSV record, in the order of Header().
+func (r *Record[T]) Format(v *T) []string {
+	rv := reflect.ValueOf(v).Elem()
+	record := make([]string, len(r.fields))
+	for i, f := range r.fields {
+		fv := rv.Field(f.index)
+		switch f.kind {
+		case bytesKind:
+			record[i] = hex.EncodeToString(fv.Slice(0, f.size).Bytes())
+		case stringKind:
+			record[i] = fv.String()
+		case boolKind:
+			record[i] = strconv.FormatBool(fv.Bool())
+		case uint32Kind:
+			if f.format == "iso8601" {
+				record[i] = StringIso8601(uint32(fv.Uint()))
+				break
+			}
+			fallthrough
+		case uint8Kind, uint64Kind:
+			record[i] = strconv.FormatUint(fv.Uint(), 10)
+		case float32Kind, float64Kind:
+			record[i] = strconv.FormatFloat(fv.Float(), 'f', f.prec, f.size*8)
+		}
+	}
+	return record
+}
+
+// Projection encodes records of type From in the layout of another Record,
+// made up of fields of From with the same name and type.
+type Projection[From any] struct {
+	fields []field
+	// of the fields in From
+	from []int
+	// of the fields in the Record of From
+	pos []int
+}
+
+// Panics if a field of `to' is missing from the Record of From.
+func NewProjection[From, To any](to *Record[To]) *Projection[From] {
+	t := reflect.TypeOf((*From)(nil)).Elem()
+	from := NewRecord[From]()
+	p := &Projection[From]{fields: to.fields}
+	for _, f := range to.fields {
+		sf, ok := t.FieldByName(f.goName)
+		toType := reflect.TypeOf((*To)(nil)).Elem().Field(f.index).Type
+		if !ok || sf.Type != toType {
+			panic(fmt.Sprintf("typing.NewProjection: %s has no field %s %s", t, f.goName, toType))
+		}
+		p.from = append(p.from, sf.Index[0])
+		p.pos = append(p.pos, int(from.Field(f.goName)))
+	}
+	return p
+}
+
+func (p *Projection[From]) Marshal(b *bytes.Buffer, v *From) error {
+	return marshalFields(b, reflect.ValueOf(v).Elem(), p.fields, p.from)
+}
@@ -2,37 +2,27 @@ package typing
 
 import (
 	"bytes"
-	"encoding/binary"
-	"io"
 )
 
 type DistanceFilter struct {
-	ID          [16]byte
-	Origin      string
-	Destination string
-	Distance    uint32
+	ID          [16]byte `rec:"legId"`
+	Origin      string   `rec:"startingAirport,intern"`
+	Destination string   `rec:"destinationAirport,intern"`
+	Distance    uint32   `rec:"totalTravelDistance"`
 }
 
-func DistanceFilterMarshal(b *bytes.Buffer, data *Flight) {
-	b.Write(data.ID[:])
-	WriteString(b, data.Origin)
-	WriteString(b, data.Destination)
-	binary.Write(b, binary.LittleEndian, data.Distance)
-}
+var DistanceFilterRecord = NewRecord[DistanceFilter]()
 
-func DistanceFilterUnmarshal(r *bytes.Reader) (data DistanceFilter, err error) {
-	_, err = io.ReadFull(r, data.ID[:])
+var distanceFilterProjection = NewProjection[Flight](DistanceFilterRecord)
 
-	if err == nil {
-		data.Origin, err = ReadString(r)
-	}
-	if err == nil {
-		data.Destination, err = ReadString(r)
-	}
+func DistanceFilterMarshal(b *bytes.Buffer, data *Flight) error {
+	return distanceFilterProjection.Marshal(b, data)
+}
 
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Distance)
-	}
+func DistanceFilterMarshalView(b *bytes.Buffer, v *View[Flight]) {
+	distanceFilterProjection.MarshalView(b, v)
+}
 
-	return data, err
+func DistanceFilterUnmarshal(r *bytes.Reader) (DistanceFilter, error) {
+	return DistanceFilterRecord.Unmarshal(r)
 }
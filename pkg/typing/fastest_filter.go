@@ -2,48 +2,32 @@ package typing
 
 import (
 	"bytes"
-	"encoding/binary"
-	"io"
 )
 
 type FastestFilter struct {
-	ID          [16]byte
-	Origin      string
-	Destination string
-	Duration    uint32
-	Stops       string
+	ID          [16]byte `rec:"legId"`
+	Origin      string   `rec:"startingAirport,intern"`
+	Destination string   `rec:"destinationAirport,intern"`
+	Duration    uint32   `rec:"travelDuration,iso8601"`
+	Stops       string   `rec:"segmentsDepartureAirportCode"`
 }
 
-func (data *FastestFilter) Marshal(b *bytes.Buffer) {
-	b.Write(data.ID[:])
-	WriteString(b, data.Origin)
-	WriteString(b, data.Destination)
-	binary.Write(b, binary.LittleEndian, data.Duration)
-	WriteString(b, data.Stops)
+var FastestFilterRecord = NewRecord[FastestFilter]()
+
+var fastestFilterProjection = NewProjection[Flight](FastestFilterRecord)
+
+func (data *FastestFilter) Marshal(b *bytes.Buffer) error {
+	return FastestFilterRecord.Marshal(b, data)
+}
+
+func FastestFilterMarshal(b *bytes.Buffer, data *Flight) error {
+	return fastestFilterProjection.Marshal(b, data)
 }
 
-func FastestFilterMarshal(b *bytes.Buffer, data *Flight) {
-	b.Write(data.ID[:])
-	WriteString(b, data.Origin)
-	WriteString(b, data.Destination)
-	binary.Write(b, binary.LittleEndian, data.Duration)
-	WriteString(b, data.Stops)
+func FastestFilterMarshalView(b *bytes.Buffer, v *View[Flight]) {
+	fastestFilterProjection.MarshalView(b, v)
 }
 
-func FastestFilterUnmarshal(r *bytes.Reader) (data FastestFilter, err error) {
-	_, err = io.ReadFull(r, data.ID[:])
-	if err == nil {
-		data.Origin, err = ReadString(r)
-	}
-	if err == nil {
-		data.Destination, err = ReadString(r)
-	}
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Duration)
-	}
-	if err == nil {
-		data.Stops, err = ReadString(r)
-	}
-
-	return data, err
+func FastestFilterUnmarshal(r *bytes.Reader) (FastestFilter, error) {
+	return FastestFilterRecord.Unmarshal(r)
 }
@@ -2,115 +2,69 @@ package typing
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"regexp"
 	"strconv"
 )
 
-const FlightSize = IdSize + OriginSize + DestinationSize + DurationSize + FareSize + DistanceSize + StopsSize
-
-var FlightFields = []string{
-	"legId",
-	"startingAirport",
-	"destinationAirport",
-	"travelDuration",
-	"totalFare",
-	"totalTravelDistance",
-	"segmentsDepartureAirportCode",
-}
-
-var DurationRegexp = regexp.MustCompile(`P(\d+D)?T?(\d+H)?(\d+M)?`)
+// Durations such as P1DT2H30M, as a whole.
+var DurationRegexp = regexp.MustCompile(`^P(\d+D)?T?(\d+H)?(\d+M)?$`)
 
 var (
 	ErrInvalidDuration = errors.New("invalid duration format")
 	ErrMissingDistance = errors.New("missing field 'totalTravelDistance'")
 )
 
+// Flight is what's read of each flight from the file, made available to every
+// filter. The records sent to each of them are projections of it, holding only
+// the fields they declare.
 type Flight struct {
-	ID          [16]byte
-	Origin      string
-	Destination string
-	Duration    uint32
-	Fare        float32
-	Distance    uint32
-	Stops       string
+	ID          [16]byte `rec:"legId"`
+	Origin      string   `rec:"startingAirport,intern"`
+	Destination string   `rec:"destinationAirport,intern"`
+	Duration    uint32   `rec:"travelDuration,iso8601"`
+	Fare        float32  `rec:"totalFare,prec=2"`
+	Distance    uint32   `rec:"totalTravelDistance,optional"`
+	Stops       string   `rec:"segmentsDepartureAirportCode"`
+	// as in 2022-04-16
+	Date string `rec:"flightDate,intern"`
+	// of each segment, separated by "||" as the stops
+	Airlines       string `rec:"segmentsAirlineCode"`
+	Cabins         string `rec:"segmentsCabinCode"`
+	NonStop        bool   `rec:"isNonStop,optional"`
+	SeatsRemaining uint8  `rec:"seatsRemaining,optional"`
 }
 
-const (
-	IdSize          = 16
-	OriginSize      = 4
-	DestinationSize = 4
-	DurationSize    = 4
-	FareSize        = 4
-	DistanceSize    = 4
-	StopsSize       = 24
-)
+var FlightRecord = NewRecord[Flight]()
+
+var FlightFields = FlightRecord.Header()
+
+var flightDistance = FlightRecord.Field("Distance")
 
+// Encodes the flight read from the CSV record. Flights with a missing
+// distance are encoded with a distance of 0, returning ErrMissingDistance.
 func FlightMarshal(b *bytes.Buffer, record []string, indices []int) error {
-	flightId, err := hex.DecodeString(record[indices[0]])
+	data, err := FlightRecord.Parse(record, indices)
 	if err != nil {
 		return err
 	}
-	duration, err := ParseDuration(record[indices[3]])
-	if err != nil {
-		return err
-	}
-	fare, err := strconv.ParseFloat(record[indices[4]], 32)
-	if err != nil {
+	if err := FlightRecord.Marshal(b, &data); err != nil {
 		return err
 	}
-	// maybe None, ignore error
-	distance, err := strconv.Atoi(record[indices[5]])
-	if err != nil && record[indices[5]] == "" {
-		err = ErrMissingDistance
+	if Column(record, indices, flightDistance) == "" {
+		return ErrMissingDistance
 	}
-	b.Write(flightId)
-	WriteString(b, record[indices[1]])
-	WriteString(b, record[indices[2]])
-	binary.Write(b, binary.LittleEndian, uint32(duration))
-	binary.Write(b, binary.LittleEndian, float32(fare))
-	binary.Write(b, binary.LittleEndian, uint32(distance))
-	WriteString(b, record[indices[6]])
-
-	return err
+	return nil
 }
 
-func FlightUnmarshal(r *bytes.Reader) (data Flight, err error) {
-	_, err = io.ReadFull(r, data.ID[:])
-
-	if err == nil {
-		data.Origin, err = ReadString(r)
-	}
-	if err == nil {
-		data.Destination, err = ReadString(r)
-	}
-
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Duration)
-	}
-
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Fare)
-	}
-
-	if err == nil {
-		err = binary.Read(r, binary.LittleEndian, &data.Distance)
-	}
-
-	if err == nil {
-		data.Stops, err = ReadString(r)
-	}
-
-	return data, err
+func FlightUnmarshal(r *bytes.Reader) (Flight, error) {
+	return FlightRecord.Unmarshal(r)
 }
 
 func ParseDuration(duration string) (minutes int, err error) {
 	values := DurationRegexp.FindStringSubmatch(duration)
-	if len(values) == 0 {
+	if len(values) == 0 || values[1]+values[2]+values[3] == "" {
 		return 0, fmt.Errorf("%w: '%s'", ErrInvalidDuration, duration)
 	}
 
@@ -39,7 +39,9 @@ func (h *BatchHeader) Unmarshal(r *bytes.Reader) error {
 	return err
 }
 
-func (h BatchHeader) Marshal(b *bytes.Buffer) {
-	WriteString(b, h.WorkerId)
-	binary.Write(b, binary.LittleEndian, h.MessageId)
+func (h BatchHeader) Marshal(b *bytes.Buffer) error {
+	if err := WriteString(b, h.WorkerId); err != nil {
+		return err
+	}
+	return binary.Write(b, binary.LittleEndian, h.MessageId)
 }
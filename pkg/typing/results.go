@@ -12,10 +12,56 @@ const (
 	Query2Flag
 	Query3Flag
 	Query4Flag
+	RejectsFlag
+	RejectedFlag
 
 	FlagSize = 1
 )
 
+// Results of a query, encoded preceded by its flag and written as CSV records
+// preceded by its field.
+type result[T any] struct {
+	*Record[T]
+	flag  byte
+	field string
+}
+
+func newResult[T any](flag byte, field string) result[T] {
+	return result[T]{NewRecord[T](), flag, field}
+}
+
+func (r result[T]) Header() []string {
+	return append([]string{r.field}, r.Record.Header()...)
+}
+
+func (r result[T]) MinSize() int {
+	return FlagSize + r.Record.MinSize()
+}
+
+func (r result[T]) MaxSize() int {
+	return FlagSize + r.Record.MaxSize()
+}
+
+func (r result[T]) Marshal(b *bytes.Buffer, data *T) error {
+	return marshalFlagged(b, r.flag, func() error {
+		return r.Record.Marshal(b, data)
+	})
+}
+
+// Writes a result already encoded, such as the Raw() of a View.
+func (r result[T]) MarshalRaw(b *bytes.Buffer, raw []byte) {
+	b.WriteByte(r.flag)
+	b.Write(raw)
+}
+
+func (r result[T]) unmarshal(rd *bytes.Reader) ([]string, error) {
+	data, err := r.Unmarshal(rd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{r.field}, r.Format(&data)...), nil
+}
+
 // returns the result as a record (a slice of fields)
 func ResultUnmarshal(r *bytes.Reader) ([]string, error) {
 	flag, err := r.ReadByte()
@@ -32,6 +78,10 @@ func ResultUnmarshal(r *bytes.Reader) ([]string, error) {
 		return ResultQ3Unmarshal(r)
 	case Query4Flag:
 		return ResultQ4Unmarshal(r)
+	case RejectsFlag:
+		return ResultRejectsUnmarshal(r)
+	case RejectedFlag:
+		return ResultRejectedUnmarshal(r)
 	default:
 		return nil, fmt.Errorf("Unknown format specifier: %d", flag)
 	}
@@ -2,58 +2,33 @@ package typing
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/hex"
-	"io"
-	"strconv"
 )
 
-const resultQ1Field = "1"
+type ResultQ1 struct {
+	ID          [16]byte `rec:"legId"`
+	Origin      string   `rec:"startingAirport,intern"`
+	Destination string   `rec:"destinationAirport,intern"`
+	Fare        float32  `rec:"totalFare,prec=2"`
+	Stops       string   `rec:"segmentsDepartureAirportCode"`
+}
+
+var ResultQ1Record = newResult[ResultQ1](Query1Flag, "1")
+
+var ResultQ1Header = ResultQ1Record.Header()
+
+var resultQ1Projection = NewProjection[Flight](ResultQ1Record.Record)
 
-var ResultQ1Header = []string{
-	resultQ1Field,
-	"legId",
-	"startingAirport",
-	"destinationAirport",
-	"totalFare",
-	"segmentsDepartureAirportCode",
+func ResultQ1Marshal(b *bytes.Buffer, data *Flight) error {
+	return marshalFlagged(b, Query1Flag, func() error {
+		return resultQ1Projection.Marshal(b, data)
+	})
 }
 
-func ResultQ1Marshal(b *bytes.Buffer, data *Flight) {
+func ResultQ1MarshalView(b *bytes.Buffer, v *View[Flight]) {
 	b.WriteByte(Query1Flag)
-	b.Write(data.ID[:])
-	WriteString(b, data.Origin)
-	WriteString(b, data.Destination)
-	binary.Write(b, binary.LittleEndian, data.Fare)
-	WriteString(b, data.Stops)
+	resultQ1Projection.MarshalView(b, v)
 }
 
 func ResultQ1Unmarshal(r *bytes.Reader) ([]string, error) {
-	record := make([]string, 6)
-	record[0] = resultQ1Field
-
-	var id [16]byte
-	_, err := io.ReadFull(r, id[:])
-	if err == nil {
-		record[1] = hex.EncodeToString(id[:])
-	}
-
-	if err == nil {
-		record[2], err = ReadString(r)
-	}
-	if err == nil {
-		record[3], err = ReadString(r)
-	}
-
-	if err == nil {
-		var price float32
-		err = binary.Read(r, binary.LittleEndian, &price)
-		record[4] = strconv.FormatFloat(float64(price), 'f', 2, 32)
-	}
-
-	if err == nil {
-		record[5], err = ReadString(r)
-	}
-
-	return record, err
+	return ResultQ1Record.unmarshal(r)
 }
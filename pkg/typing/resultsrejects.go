@@ -0,0 +1,64 @@
+package typing
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Flights of the file rejected for a reason, sent along with the results.
+type RejectCount struct {
+	Reason string `rec:"reason"`
+	Count  uint64 `rec:"rejected"`
+}
+
+var ResultRejectsRecord = newResult[RejectCount](RejectsFlag, "5")
+
+var ResultRejectsHeader = ResultRejectsRecord.Header()
+
+func ResultRejectsMarshal(b *bytes.Buffer, data *RejectCount) error {
+	return ResultRejectsRecord.Marshal(b, data)
+}
+
+func ResultRejectsUnmarshal(r *bytes.Reader) ([]string, error) {
+	return ResultRejectsRecord.unmarshal(r)
+}
+
+const resultRejectedField = "6"
+
+// A rejected flight, as the reason followed by the columns read of it.
+var ResultRejectedHeader = append([]string{resultRejectedField, "reason"}, FlightFields...)
+
+// Encodes the record as a count followed by each of its fields.
+func ResultRejectedMarshal(b *bytes.Buffer, record []string) error {
+	if len(record) != len(ResultRejectedHeader)-1 {
+		return fmt.Errorf("%w: %d fields, expected %d", ErrField, len(record), len(ResultRejectedHeader)-1)
+	}
+	return marshalFlagged(b, RejectedFlag, func() error {
+		b.WriteByte(byte(len(record)))
+		for _, field := range record {
+			if err := WriteString(b, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func ResultRejectedUnmarshal(r *bytes.Reader) ([]string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if int(n) != len(ResultRejectedHeader)-1 {
+		return nil, fmt.Errorf("%w: %d fields, expected %d", ErrField, n, len(ResultRejectedHeader)-1)
+	}
+	record := make([]string, 1, 1+n)
+	record[0] = resultRejectedField
+	for ; n > 0; n-- {
+		field, err := ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		record = append(record, field)
+	}
+	return record, nil
+}
@@ -2,6 +2,7 @@ package typing
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -12,27 +13,54 @@ type stringReader interface {
 	io.Reader
 }
 
+// Longest string encoded, so that any record fits in a message.
+const MaxStringLen = 4096
+
 var ErrLength = errors.New("string too long")
 
+// Writes the string preceded by its length as a uvarint, which takes a
+// single byte for strings shorter than 128 bytes. Nothing is written if it's
+// longer than MaxStringLen.
 func WriteString(b *bytes.Buffer, s string) error {
-	if len(s) > 255 {
+	if len(s) > MaxStringLen {
 		return fmt.Errorf("%w: len=%d", ErrLength, len(s))
 	}
 
-	b.WriteByte(byte(len(s)))
+	var buf [binary.MaxVarintLen32]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
 	b.WriteString(s)
 
 	return nil
 }
 
+// Bytes taken by the encoded string.
+func StringSize(s string) int {
+	return stringSize(len(s))
+}
+
+func stringSize(n int) int {
+	size := 1
+	for v := n; v >= 0x80; v >>= 7 {
+		size++
+	}
+	return size + n
+}
+
 func ReadString(r stringReader) (string, error) {
-	n, err := r.ReadByte()
+	n, err := binary.ReadUvarint(r)
 	if err != nil {
 		return "", err
 	}
+	if n > MaxStringLen {
+		return "", fmt.Errorf("%w: len=%d", ErrLength, n)
+	}
 
 	buf := make([]byte, n)
-	_, err = io.ReadFull(r, buf)
+	if _, err := io.ReadFull(r, buf); err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", err
+	}
 
-	return string(buf), err
+	return string(buf), nil
 }
@@ -0,0 +1,174 @@
+package typing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Interner keeps a single copy of the values of string fields tagged
+// `intern', which repeat across records such as airport codes. It grows with
+// every value seen, so it's not meant for fields with many distinct values.
+type Interner map[string]string
+
+func NewInterner() Interner {
+	return make(Interner)
+}
+
+func (in Interner) intern(b []byte) string {
+	if s, ok := in[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	in[s] = s
+	return s
+}
+
+// Position of a field in a Record, to read it off a View.
+type FieldIndex int
+
+// Index of the field named `name' in T, panics if it's not encoded.
+func (r *Record[T]) Field(name string) FieldIndex {
+	for i, f := range r.fields {
+		if f.goName == name {
+			return FieldIndex(i)
+		}
+	}
+	panic(fmt.Sprintf("typing.Record.Field: no field %s", name))
+}
+
+// Scanner walks the records encoded in a batch without decoding them, each
+// one read through a View of the batch. It's reused for every batch with
+// Reset(), so that scanning doesn't allocate.
+type Scanner[T any] struct {
+	buf  []byte
+	view View[T]
+	err  error
+}
+
+func (r *Record[T]) NewScanner(in Interner) *Scanner[T] {
+	return &Scanner[T]{view: View[T]{
+		r:    r,
+		in:   in,
+		offs: make([]int, len(r.fields)+1),
+		data: make([]int, len(r.fields)),
+	}}
+}
+
+func (s *Scanner[T]) Reset(buf []byte) {
+	s.buf, s.err = buf, nil
+	s.view.buf = nil
+}
+
+// Moves to the next record, returns false once the batch is over or a record
+// is malformed, see Err().
+func (s *Scanner[T]) Next() bool {
+	if s.err != nil || len(s.buf) == 0 {
+		return false
+	}
+	n, err := s.view.scan(s.buf)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	s.buf = s.buf[n:]
+	return true
+}
+
+// The current record, valid until the next call to Next().
+func (s *Scanner[T]) View() *View[T] {
+	return &s.view
+}
+
+func (s *Scanner[T]) Err() error {
+	return s.err
+}
+
+// View is a record encoded within a batch, whose fields are read off it at
+// the offsets found when scanning it.
+type View[T any] struct {
+	r   *Record[T]
+	in  Interner
+	buf []byte
+	// start of each field, and the end of the record
+	offs []int
+	// start of the value of each field, past the length of strings
+	data []int
+}
+
+func (v *View[T]) scan(buf []byte) (int, error) {
+	off := 0
+	for i, f := range v.r.fields {
+		v.offs[i] = off
+		size := f.size
+		if f.kind == stringKind {
+			n, k := binary.Uvarint(buf[off:])
+			if k <= 0 {
+				return 0, io.ErrUnexpectedEOF
+			} else if n > MaxStringLen {
+				return 0, fmt.Errorf("%w: len=%d", ErrLength, n)
+			}
+			off += k
+			size = int(n)
+		}
+		v.data[i] = off
+		if len(buf)-off < size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		off += size
+	}
+	v.offs[len(v.r.fields)] = off
+	v.buf = buf[:off]
+	return off, nil
+}
+
+// The record as encoded.
+func (v *View[T]) Raw() []byte {
+	return v.buf
+}
+
+// Value of a [N]byte or string field, a slice of the batch.
+func (v *View[T]) Bytes(i FieldIndex) []byte {
+	return v.buf[v.data[i]:v.offs[i+1]]
+}
+
+// Value of a string field, interned if tagged so and copied otherwise.
+func (v *View[T]) String(i FieldIndex) string {
+	if v.r.fields[i].intern && v.in != nil {
+		return v.in.intern(v.Bytes(i))
+	}
+	return string(v.Bytes(i))
+}
+
+func (v *View[T]) Bool(i FieldIndex) bool {
+	return v.buf[v.data[i]] != 0
+}
+
+func (v *View[T]) Uint8(i FieldIndex) uint8 {
+	return v.buf[v.data[i]]
+}
+
+func (v *View[T]) Uint32(i FieldIndex) uint32 {
+	return binary.LittleEndian.Uint32(v.buf[v.data[i]:])
+}
+
+func (v *View[T]) Uint64(i FieldIndex) uint64 {
+	return binary.LittleEndian.Uint64(v.buf[v.data[i]:])
+}
+
+func (v *View[T]) Float32(i FieldIndex) float32 {
+	return math.Float32frombits(v.Uint32(i))
+}
+
+func (v *View[T]) Float64(i FieldIndex) float64 {
+	return math.Float64frombits(v.Uint64(i))
+}
+
+// Writes the fields projected as they're encoded in the view.
+func (p *Projection[From]) MarshalView(b *bytes.Buffer, v *View[From]) {
+	for _, i := range p.pos {
+		b.Write(v.buf[v.offs[i]:v.offs[i+1]])
+	}
+}
@@ -0,0 +1,106 @@
+package typing
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Size of the batches published by the workers, middleware.MaxMessageSize.
+const batchSize = 8192
+
+var benchAirports = []string{"ATL", "BOS", "DEN", "JFK", "LAX", "MIA", "ORD", "SFO"}
+
+// A batch of flights as sent by the input boundary to the demux filter.
+func flightsBatch(b *testing.B) ([]byte, int) {
+	rnd := rand.New(rand.NewSource(1))
+	var batch, record bytes.Buffer
+	n := 0
+	for {
+		stops := []string{benchAirports[rnd.Intn(len(benchAirports))]}
+		for j := rnd.Intn(5); j > 0; j-- {
+			stops = append(stops, benchAirports[rnd.Intn(len(benchAirports))])
+		}
+		f := Flight{
+			Origin:         stops[0],
+			Destination:    benchAirports[rnd.Intn(len(benchAirports))],
+			Duration:       uint32(60 + rnd.Intn(1200)),
+			Fare:           50 + rnd.Float32()*900,
+			Distance:       uint32(500 + rnd.Intn(3000)),
+			Stops:          strings.Join(stops, "||"),
+			Date:           fmt.Sprintf("2022-04-%02d", 1+rnd.Intn(30)),
+			Airlines:       strings.Repeat("AA||", len(stops)-1) + "AA",
+			Cabins:         strings.Repeat("coach||", len(stops)-1) + "coach",
+			NonStop:        len(stops) == 1,
+			SeatsRemaining: uint8(rnd.Intn(10)),
+		}
+		rnd.Read(f.ID[:])
+		record.Reset()
+		if err := FlightRecord.Marshal(&record, &f); err != nil {
+			b.Fatal(err)
+		}
+		if batch.Len()+record.Len() > batchSize {
+			return batch.Bytes(), n
+		}
+		batch.Write(record.Bytes())
+		n++
+	}
+}
+
+// Routes every flight of the batch as the demux filter does, decoding them.
+func BenchmarkFlightUnmarshal(b *testing.B) {
+	batch, n := flightsBatch(b)
+	var out bytes.Buffer
+	b.SetBytes(int64(len(batch)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(batch)
+		for j := 0; j < n; j++ {
+			f, err := FlightRecord.Unmarshal(r)
+			if err != nil {
+				b.Fatal(err)
+			}
+			out.Reset()
+			DistanceFilterMarshal(&out, &f)
+			AverageFilterMarshal(&out, &f)
+			if strings.Count(f.Stops, "||") >= 3 {
+				FastestFilterMarshal(&out, &f)
+				ResultQ1Marshal(&out, &f)
+			}
+		}
+	}
+}
+
+// Routes every flight of the batch as the demux filter does, through views
+// of the batch.
+func BenchmarkFlightScanner(b *testing.B) {
+	batch, n := flightsBatch(b)
+	stops := FlightRecord.Field("Stops")
+	s := FlightRecord.NewScanner(NewInterner())
+	var out bytes.Buffer
+	b.SetBytes(int64(len(batch)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Reset(batch)
+		j := 0
+		for ; s.Next(); j++ {
+			v := s.View()
+			out.Reset()
+			DistanceFilterMarshalView(&out, v)
+			AverageFilterMarshalView(&out, v)
+			if bytes.Count(v.Bytes(stops), []byte("||")) >= 3 {
+				FastestFilterMarshalView(&out, v)
+				ResultQ1MarshalView(&out, v)
+			}
+		}
+		if err := s.Err(); err != nil {
+			b.Fatal(err)
+		} else if j != n {
+			b.Fatalf("scanned %d flights, want %d", j, n)
+		}
+	}
+}
@@ -33,7 +33,6 @@ echo "
       - testing_net
     environment:
       - IN_WORKERS=$((Q1 + Q2 + Q3 + Q4))
-      - IN_DEMUXERS=$Q1
       - IN_NAME="input"
     depends_on:
       rabbitmq:
@@ -49,7 +48,6 @@ echo "
     networks:
       - testing_net
     environment:
-      - OUT_WORKERS=$((Q1 + Q2 + Q3 + Q4))
       - OUT_NAME="output"
     depends_on:
       rabbitmq:
@@ -114,7 +112,6 @@ do
       - testing_net
     environment:
       - DISTANCE_ID=$n
-      - DISTANCE_DEMUXERS=$Q1
       - DISTANCE_NAME="distance_filter$n"
     volumes:
       - ./cmd/distanceFilter/config.yaml:/config.yaml
@@ -134,7 +131,6 @@ do
       - testing_net
     environment:
       - FAST_ID=$n
-      - FAST_DEMUXERS=$Q1
       - FAST_NAME="fastest_filter$n"
     volumes:
       - ./cmd/fastestFilter/config.yaml:/config.yaml
@@ -154,7 +150,6 @@ do
       - testing_net
     environment:
       - AVG_ID=$n
-      - AVG_DEMUXERS=$Q1
       - AVG_NAME="avg_filter$n"
     volumes:
       - ./cmd/avgFilter/config.yaml:/config.yaml
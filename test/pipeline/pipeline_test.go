@@ -0,0 +1,545 @@
+// Package pipeline runs every worker in-process over a MemoryBroker, wired as
+// in their main packages and configs, to test the whole pipeline in a single
+// binary.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	avg "github.com/franciscopereira987/tp1-distribuidos/cmd/avgFilter/common"
+	demux "github.com/franciscopereira987/tp1-distribuidos/cmd/demuxFilter/common"
+	dist "github.com/franciscopereira987/tp1-distribuidos/cmd/distanceFilter/common"
+	fastest "github.com/franciscopereira987/tp1-distribuidos/cmd/fastestFilter/common"
+	input "github.com/franciscopereira987/tp1-distribuidos/cmd/inputBoundary/common"
+	output "github.com/franciscopereira987/tp1-distribuidos/cmd/outputBoundary/common"
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/middleware/id"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/protocol"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/state"
+	"github.com/franciscopereira987/tp1-distribuidos/pkg/typing"
+)
+
+// Names of the exchanges and queues, as in the configs of the workers.
+const (
+	coordsSink  = "coords"
+	demuxSink   = "demux"
+	distSink    = "distance"
+	fastestSink = "fastest"
+	avgSink     = "average"
+	resultsSink = "results"
+	demuxEof    = "demux.eof"
+)
+
+// Nodes of each sharded worker.
+var nodes = map[string]int{
+	demuxSink:   2,
+	distSink:    2,
+	fastestSink: 2,
+	avgSink:     2,
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// A pipeline is a run of every worker over the same broker. Workers keep their
+// state in directories of a temporary working directory, which the process
+// moves to as the middleware keeps its own relative to it.
+type pipeline struct {
+	t    *testing.T
+	b    mid.Broker
+	dir  string
+	errs chan error
+}
+
+func newPipeline(t *testing.T, b mid.Broker) *pipeline {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.MkdirAll(mid.Workdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &pipeline{t: t, b: b, dir: dir, errs: make(chan error, 16)}
+}
+
+func (p *pipeline) fail(err error) {
+	if err != nil {
+		select {
+		case p.errs <- err:
+		default:
+		}
+	}
+}
+
+// Channels handing each client's queue to the goroutine running its job, for
+// workers consuming more than one queue.
+type clients struct {
+	mtx sync.Mutex
+	chs map[string]chan mid.Client
+}
+
+func (cs *clients) get(id string) chan mid.Client {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.chs == nil {
+		cs.chs = make(map[string]chan mid.Client)
+	}
+	ch, ok := cs.chs[id]
+	if !ok {
+		ch = make(chan mid.Client, 1)
+		cs.chs[id] = ch
+	}
+	return ch
+}
+
+// Starts every worker, returns once they're all registered.
+func (p *pipeline) start(ctx context.Context) {
+	for node := 1; node <= nodes[distSink]; node++ {
+		p.distance(ctx, strconv.Itoa(node))
+	}
+	for node := 1; node <= nodes[fastestSink]; node++ {
+		p.fastest(ctx, strconv.Itoa(node))
+	}
+	for node := 1; node <= nodes[avgSink]; node++ {
+		p.average(ctx, strconv.Itoa(node))
+	}
+	for node := 1; node <= nodes[demuxSink]; node++ {
+		p.demux(ctx, strconv.Itoa(node))
+	}
+}
+
+func (p *pipeline) must(err error) {
+	p.t.Helper()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *pipeline) workdir(worker string) string {
+	return filepath.Join(p.dir, "clients", worker)
+}
+
+func (p *pipeline) distance(ctx context.Context, node string) {
+	b := p.b
+	coords, err := b.ExchangeDeclare(coordsSink)
+	p.must(err)
+	qCoords, _ := mid.QueueName(coordsSink, node)
+	_, err = b.QueueDeclare(qCoords)
+	p.must(err)
+	p.must(b.QueueBind(qCoords, coords))
+	b.SetEofProducers(qCoords, input.WorkerId)
+	eof, err := b.ExchangeDeclare(demuxEof)
+	p.must(err)
+	qFlights, _ := mid.QueueName(distSink, node)
+	_, err = b.QueueDeclare(qFlights)
+	p.must(err)
+	p.must(b.QueueBind(qFlights, eof))
+	b.SetEofProducers(qFlights, demuxSink)
+	p.must(b.Ready(ctx, qCoords))
+
+	workerId := qCoords
+	coordsQueues, err := b.Consume(ctx, qCoords)
+	p.must(err)
+	flightsQueues, err := b.Consume(ctx, qFlights)
+	p.must(err)
+	var flights clients
+	go func() {
+		for q := range flightsQueues {
+			flights.get(q.Id) <- q
+		}
+	}()
+	go func() {
+		for coords := range coordsQueues {
+			go func(coords mid.Client) {
+				workdir := filepath.Join(p.workdir(workerId), hex.EncodeToString([]byte(coords.Id)))
+				f, err := dist.NewFilter(b, workerId, coords.Id, resultsSink, workdir)
+				if err != nil {
+					p.fail(err)
+					return
+				}
+				defer f.Close()
+				if err := f.AddCoords(ctx, coords); err != nil {
+					p.fail(err)
+					return
+				}
+				var q mid.Client
+				select {
+				case <-ctx.Done():
+					return
+				case q = <-flights.get(coords.Id):
+				}
+				if err := f.Run(ctx, q); err != nil {
+					p.fail(err)
+				} else {
+					p.fail(b.EOF(ctx, resultsSink, workerId, coords.Id, f.Sent()))
+				}
+			}(coords)
+		}
+	}()
+}
+
+// Declares the queue of a node of a worker sharded with a consistent hash
+// ring, which also gets its handed off batches, and announces the node.
+func (p *pipeline) shardedQueue(ctx context.Context, sink, node string, exchanges ...string) string {
+	b := p.b
+	eof, err := b.ExchangeDeclare(demuxEof)
+	p.must(err)
+	q, _ := mid.QueueName(sink, node)
+	_, err = b.QueueDeclare(q)
+	p.must(err)
+	handoff, err := b.ExchangeDeclare(q)
+	p.must(err)
+	_, err = b.ExchangeDeclare(mid.RebalanceExchange)
+	p.must(err)
+	p.must(b.QueueBind(q, append([]string{eof, handoff}, exchanges...)...))
+	b.SetEofProducers(q, demuxSink)
+	p.must(b.Ready(ctx, q))
+	n, _ := strconv.Atoi(node)
+	p.must(mid.Join(ctx, b, sink, n))
+	return q
+}
+
+func (p *pipeline) fastest(ctx context.Context, node string) {
+	b := p.b
+	workerId := p.shardedQueue(ctx, fastestSink, node)
+	queues, err := b.Consume(ctx, workerId)
+	p.must(err)
+	go func() {
+		for q := range queues {
+			go func(q mid.Client) {
+				workdir := filepath.Join(p.workdir(workerId), hex.EncodeToString([]byte(q.Id)))
+				f, err := fastest.NewFilter(b, workerId, q.Id, resultsSink, workdir)
+				if err != nil {
+					p.fail(err)
+					return
+				}
+				defer f.Close()
+				if err := f.Run(ctx, q); err != nil {
+					p.fail(err)
+				} else if err := b.EOF(ctx, resultsSink, workerId, q.Id, f.Sent(), f.Peers()...); err != nil {
+					p.fail(err)
+				} else {
+					p.fail(f.HandoffEOF(ctx))
+				}
+			}(q)
+		}
+	}()
+}
+
+func (p *pipeline) average(ctx context.Context, node string) {
+	b := p.b
+	average, err := b.ExchangeDeclare(avgSink)
+	p.must(err)
+	workerId := p.shardedQueue(ctx, avgSink, node, average)
+	queues, err := b.Consume(ctx, workerId)
+	p.must(err)
+	go func() {
+		for q := range queues {
+			go func(q mid.Client) {
+				workdir := filepath.Join(p.workdir(workerId), hex.EncodeToString([]byte(q.Id)))
+				f, err := avg.NewFilter(b, workerId, q.Id, resultsSink, workdir)
+				if err != nil {
+					p.fail(err)
+					return
+				}
+				defer f.Close()
+				if err := f.Run(ctx, q); err != nil {
+					p.fail(err)
+				} else if err := b.EOF(ctx, resultsSink, workerId, q.Id, f.Sent(), f.Peers()...); err != nil {
+					p.fail(err)
+				} else {
+					p.fail(f.HandoffEOF(ctx))
+				}
+			}(q)
+		}
+	}()
+}
+
+func (p *pipeline) demux(ctx context.Context, node string) {
+	b := p.b
+	source, err := b.ExchangeDeclare(demuxSink)
+	p.must(err)
+	q, _ := mid.QueueName(source, node)
+	_, err = b.QueueDeclare(q)
+	p.must(err)
+	p.must(b.QueueBind(q, source))
+	b.SetEofProducers(q, input.WorkerId)
+	p.must(b.Ready(ctx, q))
+	workerId := q
+
+	rebalance, err := b.ExchangeDeclare(mid.RebalanceExchange)
+	p.must(err)
+	qJoins, _ := mid.QueueName(rebalance, q)
+	_, err = b.QueueDeclare(qJoins)
+	p.must(err)
+	p.must(b.QueueBind(qJoins, rebalance))
+	joins, err := b.Subscribe(ctx, qJoins)
+	p.must(err)
+
+	sinks := []string{distSink, fastestSink, avgSink, resultsSink}
+	sharding, err := demux.NewSharding(filepath.Join(p.workdir(workerId), "sharding"), sinks,
+		[]int{nodes[distSink], nodes[fastestSink], nodes[avgSink]})
+	p.must(err)
+	ms, err := b.Membership()
+	p.must(err)
+	sharding.WithMembers(ms, coordsSink)
+	go sharding.Run(joins)
+
+	queues, err := b.Consume(ctx, q)
+	p.must(err)
+	go func() {
+		for q := range queues {
+			go func(q mid.Client) {
+				workdir := filepath.Join(p.workdir(workerId), hex.EncodeToString([]byte(q.Id)))
+				f, err := demux.NewFilter(b, workerId, q.Id, sinks, workdir, sharding)
+				if err != nil {
+					p.fail(err)
+					return
+				}
+				defer f.Close()
+				if err := f.Run(ctx, q); err != nil {
+					p.fail(err)
+				} else {
+					p.fail(b.EOF(ctx, demuxEof, workerId, q.Id, f.Sent()))
+				}
+			}(q)
+		}
+	}()
+}
+
+// Declares the results queue, whose results are written as CSV records to
+// the returned channel for every client.
+func (p *pipeline) output(ctx context.Context) <-chan []byte {
+	b := p.b
+	source, err := b.ExchangeDeclare(resultsSink)
+	p.must(err)
+	eof, err := b.ExchangeDeclare(demuxEof)
+	p.must(err)
+	_, err = b.QueueDeclare(source)
+	p.must(err)
+	p.must(b.QueueBind(source, source, eof))
+	b.SetEofProducers(source, demuxSink, coordsSink, fastestSink, avgSink, input.WorkerId)
+	p.must(b.Ready(ctx, source))
+
+	queues, err := b.Consume(ctx, source)
+	p.must(err)
+	out := make(chan []byte, 1)
+	go func() {
+		for q := range queues {
+			go func(q mid.Client) {
+				workdir := filepath.Join("clients", "output", hex.EncodeToString([]byte(q.Id)))
+				g, err := output.NewGateway(b, workdir)
+				if err != nil {
+					p.fail(err)
+					return
+				}
+				defer g.Close()
+				var buf bytes.Buffer
+				if err := g.Run(ctx, &buf, q, 0); err != nil {
+					p.fail(err)
+					return
+				}
+				out <- buf.Bytes()
+			}(q)
+		}
+	}()
+	return out
+}
+
+// Sends the client's files through the input boundary, as the client does.
+func (p *pipeline) input(ctx context.Context, clientId string, coords, flights []byte) {
+	b := p.b
+	coordsEx, err := b.ExchangeDeclare(coordsSink)
+	p.must(err)
+	flightsEx, err := b.ExchangeDeclare(demuxSink)
+	p.must(err)
+	p.must(b.Ready(ctx, input.WorkerId))
+	workers := 0
+	for _, n := range nodes {
+		workers += n
+	}
+	p.must(b.WaitReady(ctx, workers+2))
+	ms, err := b.Membership()
+	p.must(err)
+
+	var in bytes.Buffer
+	for _, file := range [][]byte{coords, flights} {
+		binary.Write(&in, binary.LittleEndian, int64(len(file)))
+		in.Write(file)
+	}
+	workdir := filepath.Join("clients", "input", hex.EncodeToString([]byte(clientId)))
+	sm := state.NewStateManager(workdir).WithSchema(input.Schema)
+	g, err := input.NewGateway(b, clientId, coordsEx, flightsEx, resultsSink, workdir, sm)
+	p.must(err)
+	g.WithRejectedRows(true)
+	go func() {
+		defer g.Close()
+		p.fail(g.Run(ctx, &in, ms.Shards(flightsEx)))
+	}()
+}
+
+// Runs a client's job through the whole pipeline, returning its results
+// sorted, as their order depends on the scheduling of the workers.
+func (p *pipeline) run(coords, flights []byte) []string {
+	p.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	out := p.output(ctx)
+	p.start(ctx)
+	p.input(ctx, string(id.Generate()), coords, flights)
+	select {
+	case results := <-out:
+		// the results EOF is an empty record
+		body, ok := strings.CutSuffix(string(results), "\n\n")
+		if !ok {
+			p.t.Fatal("missing results EOF")
+		}
+		lines := strings.Split(body, "\n")
+		slices.Sort(lines)
+		return lines
+	case err := <-p.errs:
+		p.t.Fatal(err)
+	case <-ctx.Done():
+		p.t.Fatal(ctx.Err())
+	}
+	return nil
+}
+
+var airports = map[string][2]float64{
+	"ATL": {33.6367, -84.4281},
+	"BOS": {42.3643, -71.0052},
+	"DEN": {39.8617, -104.6731},
+	"JFK": {40.6398, -73.7789},
+	"LAX": {33.9425, -118.4081},
+	"MIA": {25.7932, -80.2906},
+	"ORD": {41.9786, -87.9048},
+	"SFO": {37.6190, -122.3749},
+}
+
+// Files of airports and flights alike those of the dataset, along with a
+// few flights to be rejected.
+func dataset(flights int) ([]byte, []byte) {
+	var coords bytes.Buffer
+	codes := make([]string, 0, len(airports))
+	for code := range airports {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	w := csv.NewWriter(&coords)
+	w.Comma = ';'
+	w.Write(typing.CoordinatesFields)
+	for _, code := range codes {
+		c := airports[code]
+		w.Write([]string{code, strconv.FormatFloat(c[0], 'f', 4, 64), strconv.FormatFloat(c[1], 'f', 4, 64)})
+	}
+	w.Flush()
+
+	var buf bytes.Buffer
+	rnd := rand.New(rand.NewSource(1))
+	w = csv.NewWriter(&buf)
+	w.Write(typing.FlightFields)
+	for i := 0; i < flights; i++ {
+		origin := codes[rnd.Intn(len(codes))]
+		destination := codes[rnd.Intn(len(codes))]
+		for destination == origin {
+			destination = codes[rnd.Intn(len(codes))]
+		}
+		stops := []string{origin}
+		for j := rnd.Intn(5); j > 0; j-- {
+			stops = append(stops, codes[rnd.Intn(len(codes))])
+		}
+		distance := strconv.Itoa(500 + rnd.Intn(12000))
+		if i%50 == 0 {
+			distance = ""
+		}
+		w.Write([]string{
+			fmt.Sprintf("%032x", i),
+			origin,
+			destination,
+			fmt.Sprintf("PT%dH%dM", 1+rnd.Intn(20), rnd.Intn(60)),
+			strconv.FormatFloat(50+rnd.Float64()*900, 'f', 2, 64),
+			distance,
+			strings.Join(stops, "||"),
+			fmt.Sprintf("2022-04-%02d", 1+rnd.Intn(30)),
+			strings.Repeat("AA||", len(stops)-1) + "AA",
+			strings.Repeat("coach||", len(stops)-1) + "coach",
+			strconv.FormatBool(len(stops) == 1),
+			strconv.Itoa(rnd.Intn(10)),
+		})
+	}
+	w.Write([]string{"zz", "ATL", "BOS", "PT1H", "10", "100", "ATL", "2022-04-01", "AA", "coach", "true", "1"})
+	w.Write([]string{fmt.Sprintf("%032x", flights), "ATL", "XXX", "PT1H", "10", "100", "ATL", "2022-04-01", "AA", "coach", "true", "1"})
+	w.Write([]string{fmt.Sprintf("%032x", flights+1), "ATL", "BOS", "PT1H", "-10", "100", "ATL", "2022-04-01", "AA", "coach", "true", "1"})
+	w.Flush()
+	return coords.Bytes(), buf.Bytes()
+}
+
+// Results of each query, by their tag.
+func byQuery(t *testing.T, lines []string) map[int][]string {
+	queries := make(map[int][]string)
+	for _, line := range lines {
+		tag, record, err := protocol.SplitRecord([]byte(line))
+		if err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		queries[tag] = append(queries[tag], string(record))
+	}
+	return queries
+}
+
+func TestPipeline(t *testing.T) {
+	coords, flights := dataset(500)
+	lines := newPipeline(t, mid.NewMemoryBroker()).run(coords, flights)
+	queries := byQuery(t, lines)
+
+	// flights with 3 stops or more, and their header
+	var q1 int
+	r := csv.NewReader(bytes.NewReader(flights))
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records[1:] {
+		if strings.Count(record[6], "||") >= 3 && len(record[0]) == 32 && record[2] != "XXX" && !strings.HasPrefix(record[4], "-") {
+			q1++
+		}
+	}
+	if got := len(queries[1]) - 1; got != q1 {
+		t.Errorf("query 1: got %d results, want %d", got, q1)
+	}
+	for tag := 2; tag <= 4; tag++ {
+		if len(queries[tag]) < 2 {
+			t.Errorf("query %d: no results", tag)
+		}
+	}
+	want := []string{"invalid_leg_id,1", "missing_distance,10", "negative_fare,1", "reason,rejected", "unknown_airport,1"}
+	if got := queries[5]; !slices.Equal(got, want) {
+		t.Errorf("rejects: got %q, want %q", got, want)
+	}
+	if got := len(queries[6]) - 1; got != 3 {
+		t.Errorf("rejected: got %d flights, want 3", got)
+	}
+}
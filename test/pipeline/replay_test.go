@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	input "github.com/franciscopereira987/tp1-distribuidos/cmd/inputBoundary/common"
+	mid "github.com/franciscopereira987/tp1-distribuidos/pkg/middleware"
+)
+
+// An edge of the pipeline, the batches of a type published by a worker.
+type edge struct {
+	producer string
+	payload  mid.PayloadType
+}
+
+func (e edge) String() string {
+	return fmt.Sprintf("%s->%s", e.producer, e.payload)
+}
+
+var edges = []edge{
+	{input.WorkerId, mid.CoordsPayload},
+	{input.WorkerId, mid.FlightsPayload},
+	{input.WorkerId, mid.ResultsPayload},
+	{demuxSink, mid.DistancePayload},
+	{demuxSink, mid.FastestPayload},
+	{demuxSink, mid.AveragePayload},
+	{demuxSink, mid.ResultsPayload},
+	// the distance filter, named after the queue of coordinates
+	{coordsSink, mid.ResultsPayload},
+	{fastestSink, mid.ResultsPayload},
+	{avgSink, mid.ResultsPayload},
+}
+
+// replayBroker publishes every batch of an edge twice, as a producer does
+// when it's restarted before committing the batches it sent.
+type replayBroker struct {
+	*mid.MemoryBroker
+	edge     edge
+	replayed atomic.Int64
+}
+
+func (b *replayBroker) Publish(ctx context.Context, c mid.Confirmer, exchange, key string, body []byte) error {
+	if err := b.MemoryBroker.Publish(ctx, c, exchange, key, body); err != nil {
+		return err
+	}
+	e, _, err := mid.PeekEnvelope(body)
+	if err != nil || e.Type != b.edge.payload || mid.Role(e.Header.WorkerId) != b.edge.producer {
+		return nil
+	}
+	b.replayed.Add(1)
+	return b.MemoryBroker.Publish(ctx, c, exchange, key, body)
+}
+
+func TestReplay(t *testing.T) {
+	coords, flights := dataset(500)
+	want := newPipeline(t, mid.NewMemoryBroker()).run(coords, flights)
+	for _, e := range edges {
+		e := e
+		t.Run(e.String(), func(t *testing.T) {
+			b := &replayBroker{MemoryBroker: mid.NewMemoryBroker(), edge: e}
+			got := newPipeline(t, b).run(coords, flights)
+			if b.replayed.Load() == 0 {
+				t.Fatalf("no batches replayed")
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got %d results, want %d", len(got), len(want))
+			}
+		})
+	}
+}